@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -25,7 +26,159 @@ import (
 
 // ServiceRunnerImage defines the image used to manage the underlying service
 type ServiceRunnerImage struct {
-	CrudImage string `json:"crudImage"`
+	// CrudImage runs the operations of the job executor which don't select
+	// an image of their own
+	CrudImage string `json:"crudImage,omitempty"`
+
+	// Operations customizes how the job executor runs operations, keyed by
+	// operation name (create, read, update, delete, health, backup)
+	// +optional
+	Operations map[string]OperationSpec `json:"operations,omitempty"`
+
+	// Capabilities has the job executor ask each image which operations and
+	// parameters it supports, by running its /capabilities operation once
+	// per image digest, and refuse the others up front
+	// +optional
+	Capabilities bool `json:"capabilities,omitempty"`
+}
+
+// OperationSpec customizes how the job executor runs an operation.
+type OperationSpec struct {
+	// Image running the operation; defaults to the CRUD image
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Command running the operation; defaults to /<operation>, e.g. /create
+	// +optional
+	Command []string `json:"command,omitempty"`
+
+	// Args of the command
+	// +optional
+	Args []string `json:"args,omitempty"`
+
+	// Steps run the operation as a sequence of containers, in order, instead
+	// of a single one.  Steps share a volume at $STEPS_DIR: each may write
+	// to $STEP_OUTPUT ($STEPS_DIR/<name>) for the following ones to read.
+	// The last line logged by the final step is the output of the operation.
+	// +optional
+	Steps []OperationStep `json:"steps,omitempty"`
+}
+
+// OperationStep is a container running a step of an operation.
+type OperationStep struct {
+	// Name of the step, unique within the operation
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=63
+	Name string `json:"name"`
+
+	// Image of the step; defaults to the image of the operation
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Command of the step; defaults to the entrypoint of the image
+	// +optional
+	Command []string `json:"command,omitempty"`
+
+	// Args of the step
+	// +optional
+	Args []string `json:"args,omitempty"`
+}
+
+// ServiceRunnerExecutor selects the backend running the operations of a
+// runner
+type ServiceRunnerExecutor struct {
+	// Name of an executor registered with the operator; defaults to "job",
+	// which runs operations as Jobs of the CRUD image
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Webhook configures the "webhook" executor
+	// +optional
+	Webhook *WebhookExecutorSpec `json:"webhook,omitempty"`
+
+	// OSB configures the "osb" executor
+	// +optional
+	OSB *OSBExecutorSpec `json:"osb,omitempty"`
+
+	// Tekton configures the "tekton" executor
+	// +optional
+	Tekton *TektonExecutorSpec `json:"tekton,omitempty"`
+
+	// Helm configures the "helm" executor
+	// +optional
+	Helm *HelmExecutorSpec `json:"helm,omitempty"`
+}
+
+// HelmExecutorSpec declares the chart the "helm" executor installs as the
+// service, next to the runner.  Operations run as Jobs of a helm image:
+// create and update upgrade --install the release, with the service
+// parameters as string values ("a.b" setting the nested value b of a), and
+// delete uninstalls it.
+type HelmExecutorSpec struct {
+	// Chart is an OCI reference (oci://registry/repository/chart) or a path
+	// to a chart in the helm image
+	Chart string `json:"chart"`
+
+	// Version of the chart; defaults to the latest one
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// ReleaseName defaults to the name of the runner
+	// +optional
+	ReleaseName string `json:"releaseName,omitempty"`
+
+	// Image running helm; defaults to the image the operator is configured
+	// with
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// ServiceAccountName runs helm under a service account allowed to manage
+	// the objects of the chart
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Outputs maps binding keys to Go templates evaluated against the
+	// objects of the deployed release, e.g.
+	// '{{ (object "Service" "redis-master").metadata.name }}' or
+	// '{{ secretValue "redis" "redis-password" }}'
+	// +optional
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+// TektonExecutorSpec names the Tekton Pipelines the "tekton" executor runs,
+// one PipelineRun per operation.  Service parameters are passed as pipeline
+// params; the pipeline results of a read are the binding data.
+type TektonExecutorSpec struct {
+	// Pipelines maps operations (create, read, update, delete) to the
+	// Pipeline running them, in the namespace of the runner
+	Pipelines map[string]string `json:"pipelines"`
+
+	// ServiceAccountName runs the PipelineRuns under a service account other
+	// than the default one
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+}
+
+// OSBExecutorSpec selects the service and plan of the broker catalog the
+// "osb" executor provisions.  The broker is reached at the "url" key of
+// spec.controlPlaneSecret, with basic auth from its "username" and
+// "password" keys.
+type OSBExecutorSpec struct {
+	// ServiceID of the catalog service
+	ServiceID string `json:"serviceId"`
+
+	// PlanID of the catalog plan
+	PlanID string `json:"planId"`
+}
+
+// WebhookExecutorSpec declares the HTTP endpoint the "webhook" executor sends
+// operations to.  Credentials are read from spec.controlPlaneSecret: a
+// "token" key is sent as a bearer token, "username" and "password" keys as
+// basic auth, and keys prefixed with "header-" as headers of the same name.
+type WebhookExecutorSpec struct {
+	// URL of the endpoint; operations are posted to <url>/<operation>
+	// +kubebuilder:validation:Pattern=`^https?://`
+	URL string `json:"url"`
 }
 
 // ServiceRunnerSpec defines the desired state of ServiceRunner
@@ -37,9 +190,181 @@ type ServiceRunnerSpec struct {
 	ServiceParam map[string]string `json:"serviceParams,omitempty"`
 
 	// ServiceImage specifies the image to use for CRUD operations
-	ServiceImage ServiceRunnerImage `json:"serviceImage"`
+	// +optional
+	ServiceImage ServiceRunnerImage `json:"serviceImage,omitempty"`
+
+	// Executor selects the backend running the operations; operations run as
+	// Jobs of ServiceImage when it is unset
+	// +optional
+	Executor *ServiceRunnerExecutor `json:"executor,omitempty"`
+
+	// UpdateStrategy selects how spec changes to ImmutableParams are
+	// applied; other changes are always applied in place
+	// +optional
+	UpdateStrategy UpdateStrategy `json:"updateStrategy,omitempty"`
+
+	// ImmutableParams are the keys of ServiceParam the service can't change
+	// in place, e.g. a region or an engine version
+	// +optional
+	ImmutableParams []string `json:"immutableParams,omitempty"`
+
+	// RollbackPolicy selects how a failed update is rolled back to the
+	// parameters the runner was last Ready with
+	// +optional
+	RollbackPolicy RollbackPolicy `json:"rollbackPolicy,omitempty"`
+
+	// ManagementPolicy selects whether the runner manages its service, or
+	// only observes a service managed by others
+	// +optional
+	ManagementPolicy ManagementPolicy `json:"managementPolicy,omitempty"`
+
+	// RefreshInterval is how often an ObserveOnly runner reads its service
+	// again; it is only read on spec changes when unset
+	// +optional
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+
+	// DeletionPolicy selects whether deleting the runner deletes its
+	// service
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// TTL is how long the runner lives after it was created
+	// +optional
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+
+	// ExpiresAt is when the runner expires, if before its TTL elapses
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// ExpirationPolicy selects what happens once the runner expired
+	// +optional
+	ExpirationPolicy ExpirationPolicy `json:"expirationPolicy,omitempty"`
+
+	// Import adopts an existing service instead of creating one
+	// +optional
+	Import *ImportSpec `json:"import,omitempty"`
+
+	// LockKey identifies the external service the runner operates on, for
+	// runners sharing it to run their operations one at a time; defaults to
+	// the class of the service and its status.serviceId
+	// +optional
+	LockKey string `json:"lockKey,omitempty"`
+
+	// State provides the jobs of the runner with storage kept across
+	// operations, e.g. for Terraform or Pulumi state
+	// +optional
+	State *StateSpec `json:"state,omitempty"`
+}
+
+// ImportSpec identifies an existing service for a runner to adopt: the
+// import (or read) operation validates it and fetches its outputs, and the
+// runner gets Ready without creating it.
+type ImportSpec struct {
+	// ServiceID of the service; it becomes status.serviceId
+	// +kubebuilder:validation:MinLength=1
+	ServiceID string `json:"serviceId"`
+
+	// Operation importing the service; defaults to import, read suits images
+	// and executors without an import operation
+	// +kubebuilder:validation:Enum=import;read
+	// +optional
+	Operation string `json:"operation,omitempty"`
+}
+
+// StateSpec configures the state storage of a runner: a volume claim owned
+// by the runner, mounted in every job of the job executor.  Each job works
+// on a copy of the state the last successful operation left, which becomes
+// the next version of the state only if the job succeeds.
+type StateSpec struct {
+	// Size of the volume claim; defaults to 1Gi
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+
+	// StorageClassName of the volume claim; defaults to the default storage
+	// class
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// Image preparing the copy of the state each job works on; it needs a
+	// shell, cp and rm.  Defaults to busybox
+	// +optional
+	Image string `json:"image,omitempty"`
 }
 
+// ExpirationPolicy selects what happens to an expired runner.
+// +kubebuilder:validation:Enum=Delete;Deprovision
+type ExpirationPolicy string
+
+const (
+	// ExpirationDelete deletes the runner, as its deletion policy says; it
+	// is the default.
+	ExpirationDelete ExpirationPolicy = "Delete"
+
+	// ExpirationDeprovision deletes the service but keeps the runner, in the
+	// Expired state.
+	ExpirationDeprovision ExpirationPolicy = "Deprovision"
+)
+
+// ManagementPolicy selects the operations a runner runs on its service.
+// +kubebuilder:validation:Enum=Full;ObserveOnly
+type ManagementPolicy string
+
+const (
+	// ManagementFull creates, updates and deletes the service; it is the
+	// default.
+	ManagementFull ManagementPolicy = "Full"
+
+	// ManagementObserveOnly only ever reads the service, to maintain its
+	// binding; it is never created, updated nor deleted.
+	ManagementObserveOnly ManagementPolicy = "ObserveOnly"
+)
+
+// DeletionPolicy selects what happens to the service of a deleted runner.
+// +kubebuilder:validation:Enum=Delete;Orphan
+type DeletionPolicy string
+
+const (
+	// DeletionDelete runs the delete operation before the runner is
+	// released; it is the default.
+	DeletionDelete DeletionPolicy = "Delete"
+
+	// DeletionOrphan releases the runner right away, leaving the service
+	// around, e.g. for another runner to import it.
+	DeletionOrphan DeletionPolicy = "Orphan"
+)
+
+// RollbackPolicy selects how a runner rolls back a failed update.
+// +kubebuilder:validation:Enum=Automatic;Manual
+type RollbackPolicy string
+
+const (
+	// RollbackAutomatic rolls a failed update back right away.
+	RollbackAutomatic RollbackPolicy = "Automatic"
+
+	// RollbackManual leaves the runner Failed until it is annotated with
+	// servicerunner.io/rollback; it is the default.
+	RollbackManual RollbackPolicy = "Manual"
+)
+
+// UpdateStrategy selects how a runner applies changes to parameters its
+// service can't change in place.
+// +kubebuilder:validation:Enum=InPlace;Recreate;CreateBeforeDelete
+type UpdateStrategy string
+
+const (
+	// UpdateInPlace runs the update operation, whatever changed; it is the
+	// default.
+	UpdateInPlace UpdateStrategy = "InPlace"
+
+	// UpdateRecreate deletes the service, then creates it anew.
+	UpdateRecreate UpdateStrategy = "Recreate"
+
+	// UpdateCreateBeforeDelete creates the replacement service, publishes
+	// its binding, then deletes the replaced service.  Executors running a
+	// single service per runner, such as osb and helm, don't support it.
+	UpdateCreateBeforeDelete UpdateStrategy = "CreateBeforeDelete"
+)
+
 // ServiceRunnerBindingRef contains the secret pointing to binding information
 // for workloads.
 type ServiceRunnerBindingRef struct {
@@ -47,6 +372,115 @@ type ServiceRunnerBindingRef struct {
 	Name string `json:"name,omitempty"`
 }
 
+// ServiceRunnerOperation records an operation run against the underlying
+// service.
+type ServiceRunnerOperation struct {
+	// Name of the operation: create, read, update or delete.
+	Name string `json:"name"`
+
+	// Job running the operation; for executors other than Jobs, the
+	// reference of the run the executor launched.
+	Job string `json:"job,omitempty"`
+
+	// Executor which launched the operation; it is the one polled for its
+	// outcome, even if spec.executor has changed since.
+	Executor string `json:"executor,omitempty"`
+
+	// Attempt numbers the consecutive launches of the operation, from 1;
+	// it is raised when the operation is launched again after it failed.
+	// +optional
+	Attempt int32 `json:"attempt,omitempty"`
+
+	// FinishedAt is when the operation was seen to have finished; a failed
+	// delete is launched again after a backoff counted from then.
+	// +optional
+	FinishedAt *metav1.Time `json:"finishedAt,omitempty"`
+
+	// StateVersion is the version of the state the operation works on; it
+	// becomes the current version once the operation succeeded.
+	// +optional
+	StateVersion int64 `json:"stateVersion,omitempty"`
+
+	// Steps report the progress of an operation run in steps.
+	// +optional
+	Steps []OperationStepStatus `json:"steps,omitempty"`
+}
+
+// ServiceRunnerReplacement records the service a CreateBeforeDelete update
+// replaces, until it has been deleted.
+type ServiceRunnerReplacement struct {
+	// Generation the replaced service was applied with
+	Generation int64 `json:"generation"`
+
+	// Params the replaced service was applied with; it is deleted with them
+	// +optional
+	Params map[string]string `json:"params,omitempty"`
+
+	// ServiceId of the replaced service, when it has one; its delete runs
+	// against it rather than the replacement
+	// +optional
+	ServiceId string `json:"serviceId,omitempty"`
+}
+
+// ServiceRunnerLock records the lock a runner holds on its service while
+// one of its operations runs.
+type ServiceRunnerLock struct {
+	// Key identifying the service
+	Key string `json:"key"`
+
+	// Lease recording the holder, as namespace/name
+	Lease string `json:"lease"`
+}
+
+// StateStorageStatus records the versions of the state of a runner, oldest
+// first; the last one is current.
+type StateStorageStatus struct {
+	// Claim holding the state
+	Claim string `json:"claim"`
+
+	// Versions of the state kept on the claim
+	// +optional
+	Versions []StateVersion `json:"versions,omitempty"`
+}
+
+// StateVersion is a version of the state, left by a successful operation.
+type StateVersion struct {
+	// Version numbers the versions from 1; it names the directory of the
+	// version on the claim
+	Version int64 `json:"version"`
+
+	// Job which left it
+	Job string `json:"job"`
+}
+
+// ServiceRunnerSnapshot records the service as the runner last got Ready
+// with, for failed updates to be rolled back to.
+type ServiceRunnerSnapshot struct {
+	// Generation the snapshot was taken at
+	Generation int64 `json:"generation"`
+
+	// Params the service was applied with
+	// +optional
+	Params map[string]string `json:"params,omitempty"`
+
+	// OutputsSecret is the Secret, owned by the runner, holding the outputs
+	// the service was read with
+	OutputsSecret string `json:"outputsSecret"`
+}
+
+// OperationStepStatus reports the progress of a step of an operation.
+type OperationStepStatus struct {
+	// Name of the step
+	Name string `json:"name"`
+
+	// State of the step: Waiting, Running, Succeeded or Failed
+	State string `json:"state"`
+
+	// Message explains a failure.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
 // ServiceRunnerStatus defines the observed state of ServiceRunner
 type ServiceRunnerStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
@@ -55,17 +489,94 @@ type ServiceRunnerStatus struct {
 	// Binding specifies where binding information has been written.
 	Binding *ServiceRunnerBindingRef `json:"binding,omitempty"`
 
-	// ObservedGeneration keeps track of the last generation seen by the
-	// underlying controller
+	// ObservedGeneration keeps track of the last generation the runner got
+	// Ready with
 	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
 
+	// ApplyingGeneration is the generation the last create or update
+	// operation applied; spec changes made while it runs are picked up by a
+	// single follow-up update once it has finished
+	ApplyingGeneration int64 `json:"applyingGeneration,omitempty"`
+
+	// AppliedParams are the service parameters of ApplyingGeneration; read
+	// and delete operations run with them, so they address the service as it
+	// was provisioned even while the spec is being edited
+	AppliedParams map[string]string `json:"appliedParams,omitempty"`
+
+	// Replaced is the service a CreateBeforeDelete update replaces, while it
+	// is still around
+	// +optional
+	Replaced *ServiceRunnerReplacement `json:"replaced,omitempty"`
+
+	// Lock is the lock on the service held by the running operation
+	// +optional
+	Lock *ServiceRunnerLock `json:"lock,omitempty"`
+
+	// StateStorage records the versions of the state of the runner
+	// +optional
+	StateStorage *StateStorageStatus `json:"stateStorage,omitempty"`
+
+	// LastReady snapshots the service as the runner last got Ready with
+	// +optional
+	LastReady *ServiceRunnerSnapshot `json:"lastReady,omitempty"`
+
+	// ExpiresAt is when the runner expires, after its TTL, spec.expiresAt
+	// and the maximum TTL of its namespace
+	// +optional
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+
+	// RefreshTime is when an ObserveOnly runner last launched the read of
+	// its service
+	// +optional
+	RefreshTime *metav1.Time `json:"refreshTime,omitempty"`
+
 	// ServiceId sets the ID of the underlying service
 	ServiceId string `json:"serviceId,omitempty"`
 
 	// State stores the current state of the runner
 	State string `json:"state,omitempty"`
+
+	// Operation is the operation launched last; while the runner is Failed,
+	// it is the one that failed.
+	Operation *ServiceRunnerOperation `json:"operation,omitempty"`
+
+	// Conditions describe the latest observations of the runner
+	// +optional
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
 
+const (
+	// ConditionReady is true once the runner has published the binding for
+	// its current generation.
+	ConditionReady = "Ready"
+
+	// ConditionSynced reports whether the last reconcile of the runner
+	// succeeded; its reason classifies the error when it did not.
+	ConditionSynced = "Synced"
+
+	// ConditionRolledBack reports the rollback of a failed update: whether it
+	// is available, under way, done or failed.
+	ConditionRolledBack = "RolledBack"
+
+	// ConditionDeletionProtected is true while the runner is annotated with
+	// servicerunner.io/deletion-protection; its reason tells whether a
+	// deletion of the service was refused.
+	ConditionDeletionProtected = "DeletionProtected"
+
+	// ConditionExpired is true once the runner expired, and false while it
+	// is about to.
+	ConditionExpired = "Expired"
+
+	// ConditionLocked reports the lock the running operation holds on the
+	// service; it is false while the runner waits for another runner to
+	// release it.
+	ConditionLocked = "Locked"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 
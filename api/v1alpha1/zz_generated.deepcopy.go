@@ -22,9 +22,134 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *HelmExecutorSpec) DeepCopyInto(out *HelmExecutorSpec) {
+	*out = *in
+	if in.Outputs != nil {
+		in, out := &in.Outputs, &out.Outputs
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new HelmExecutorSpec.
+func (in *HelmExecutorSpec) DeepCopy() *HelmExecutorSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(HelmExecutorSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImportSpec) DeepCopyInto(out *ImportSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImportSpec.
+func (in *ImportSpec) DeepCopy() *ImportSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ImportSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OSBExecutorSpec) DeepCopyInto(out *OSBExecutorSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OSBExecutorSpec.
+func (in *OSBExecutorSpec) DeepCopy() *OSBExecutorSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(OSBExecutorSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OperationSpec) DeepCopyInto(out *OperationSpec) {
+	*out = *in
+	if in.Command != nil {
+		in, out := &in.Command, &out.Command
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Args != nil {
+		in, out := &in.Args, &out.Args
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Steps != nil {
+		in, out := &in.Steps, &out.Steps
+		*out = make([]OperationStep, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OperationSpec.
+func (in *OperationSpec) DeepCopy() *OperationSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(OperationSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OperationStep) DeepCopyInto(out *OperationStep) {
+	*out = *in
+	if in.Command != nil {
+		in, out := &in.Command, &out.Command
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Args != nil {
+		in, out := &in.Args, &out.Args
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OperationStep.
+func (in *OperationStep) DeepCopy() *OperationStep {
+	if in == nil {
+		return nil
+	}
+	out := new(OperationStep)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OperationStepStatus) DeepCopyInto(out *OperationStepStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OperationStepStatus.
+func (in *OperationStepStatus) DeepCopy() *OperationStepStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(OperationStepStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ServiceRunner) DeepCopyInto(out *ServiceRunner) {
 	*out = *in
@@ -67,9 +192,51 @@ func (in *ServiceRunnerBindingRef) DeepCopy() *ServiceRunnerBindingRef {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceRunnerExecutor) DeepCopyInto(out *ServiceRunnerExecutor) {
+	*out = *in
+	if in.Webhook != nil {
+		in, out := &in.Webhook, &out.Webhook
+		*out = new(WebhookExecutorSpec)
+		**out = **in
+	}
+	if in.OSB != nil {
+		in, out := &in.OSB, &out.OSB
+		*out = new(OSBExecutorSpec)
+		**out = **in
+	}
+	if in.Tekton != nil {
+		in, out := &in.Tekton, &out.Tekton
+		*out = new(TektonExecutorSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Helm != nil {
+		in, out := &in.Helm, &out.Helm
+		*out = new(HelmExecutorSpec)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceRunnerExecutor.
+func (in *ServiceRunnerExecutor) DeepCopy() *ServiceRunnerExecutor {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceRunnerExecutor)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ServiceRunnerImage) DeepCopyInto(out *ServiceRunnerImage) {
 	*out = *in
+	if in.Operations != nil {
+		in, out := &in.Operations, &out.Operations
+		*out = make(map[string]OperationSpec, len(*in))
+		for key, val := range *in {
+			(*out)[key] = *val.DeepCopy()
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceRunnerImage.
@@ -114,6 +281,89 @@ func (in *ServiceRunnerList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceRunnerLock) DeepCopyInto(out *ServiceRunnerLock) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceRunnerLock.
+func (in *ServiceRunnerLock) DeepCopy() *ServiceRunnerLock {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceRunnerLock)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceRunnerOperation) DeepCopyInto(out *ServiceRunnerOperation) {
+	*out = *in
+	if in.FinishedAt != nil {
+		in, out := &in.FinishedAt, &out.FinishedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.Steps != nil {
+		in, out := &in.Steps, &out.Steps
+		*out = make([]OperationStepStatus, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceRunnerOperation.
+func (in *ServiceRunnerOperation) DeepCopy() *ServiceRunnerOperation {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceRunnerOperation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceRunnerReplacement) DeepCopyInto(out *ServiceRunnerReplacement) {
+	*out = *in
+	if in.Params != nil {
+		in, out := &in.Params, &out.Params
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceRunnerReplacement.
+func (in *ServiceRunnerReplacement) DeepCopy() *ServiceRunnerReplacement {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceRunnerReplacement)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ServiceRunnerSnapshot) DeepCopyInto(out *ServiceRunnerSnapshot) {
+	*out = *in
+	if in.Params != nil {
+		in, out := &in.Params, &out.Params
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceRunnerSnapshot.
+func (in *ServiceRunnerSnapshot) DeepCopy() *ServiceRunnerSnapshot {
+	if in == nil {
+		return nil
+	}
+	out := new(ServiceRunnerSnapshot)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ServiceRunnerSpec) DeepCopyInto(out *ServiceRunnerSpec) {
 	*out = *in
@@ -124,7 +374,41 @@ func (in *ServiceRunnerSpec) DeepCopyInto(out *ServiceRunnerSpec) {
 			(*out)[key] = val
 		}
 	}
-	out.ServiceImage = in.ServiceImage
+	in.ServiceImage.DeepCopyInto(&out.ServiceImage)
+	if in.Executor != nil {
+		in, out := &in.Executor, &out.Executor
+		*out = new(ServiceRunnerExecutor)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ImmutableParams != nil {
+		in, out := &in.ImmutableParams, &out.ImmutableParams
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RefreshInterval != nil {
+		in, out := &in.RefreshInterval, &out.RefreshInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.TTL != nil {
+		in, out := &in.TTL, &out.TTL
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ExpiresAt != nil {
+		in, out := &in.ExpiresAt, &out.ExpiresAt
+		*out = (*in).DeepCopy()
+	}
+	if in.Import != nil {
+		in, out := &in.Import, &out.Import
+		*out = new(ImportSpec)
+		**out = **in
+	}
+	if in.State != nil {
+		in, out := &in.State, &out.State
+		*out = new(StateSpec)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceRunnerSpec.
@@ -145,6 +429,53 @@ func (in *ServiceRunnerStatus) DeepCopyInto(out *ServiceRunnerStatus) {
 		*out = new(ServiceRunnerBindingRef)
 		**out = **in
 	}
+	if in.AppliedParams != nil {
+		in, out := &in.AppliedParams, &out.AppliedParams
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Replaced != nil {
+		in, out := &in.Replaced, &out.Replaced
+		*out = new(ServiceRunnerReplacement)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Lock != nil {
+		in, out := &in.Lock, &out.Lock
+		*out = new(ServiceRunnerLock)
+		**out = **in
+	}
+	if in.StateStorage != nil {
+		in, out := &in.StateStorage, &out.StateStorage
+		*out = new(StateStorageStatus)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.LastReady != nil {
+		in, out := &in.LastReady, &out.LastReady
+		*out = new(ServiceRunnerSnapshot)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ExpiresAt != nil {
+		in, out := &in.ExpiresAt, &out.ExpiresAt
+		*out = (*in).DeepCopy()
+	}
+	if in.RefreshTime != nil {
+		in, out := &in.RefreshTime, &out.RefreshTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Operation != nil {
+		in, out := &in.Operation, &out.Operation
+		*out = new(ServiceRunnerOperation)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ServiceRunnerStatus.
@@ -156,3 +487,100 @@ func (in *ServiceRunnerStatus) DeepCopy() *ServiceRunnerStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StateSpec) DeepCopyInto(out *StateSpec) {
+	*out = *in
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.StorageClassName != nil {
+		in, out := &in.StorageClassName, &out.StorageClassName
+		*out = new(string)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StateSpec.
+func (in *StateSpec) DeepCopy() *StateSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(StateSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StateStorageStatus) DeepCopyInto(out *StateStorageStatus) {
+	*out = *in
+	if in.Versions != nil {
+		in, out := &in.Versions, &out.Versions
+		*out = make([]StateVersion, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StateStorageStatus.
+func (in *StateStorageStatus) DeepCopy() *StateStorageStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(StateStorageStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StateVersion) DeepCopyInto(out *StateVersion) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StateVersion.
+func (in *StateVersion) DeepCopy() *StateVersion {
+	if in == nil {
+		return nil
+	}
+	out := new(StateVersion)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TektonExecutorSpec) DeepCopyInto(out *TektonExecutorSpec) {
+	*out = *in
+	if in.Pipelines != nil {
+		in, out := &in.Pipelines, &out.Pipelines
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TektonExecutorSpec.
+func (in *TektonExecutorSpec) DeepCopy() *TektonExecutorSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TektonExecutorSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookExecutorSpec) DeepCopyInto(out *WebhookExecutorSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookExecutorSpec.
+func (in *WebhookExecutorSpec) DeepCopy() *WebhookExecutorSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookExecutorSpec)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -18,11 +18,20 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 
-	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 
 	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
@@ -30,19 +39,42 @@ import (
 	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
 )
 
+// FieldManager identifies the controller as the writer of runner status.
+const FieldManager = "service-runner"
+
 // ServiceRunnerReconciler reconciles a ServiceRunner object
 type ServiceRunnerReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// Executors run the operations of runners, selected by spec.executor.
+	Executors *resolve.Registry
+
+	// Recorder reports changes of the EventConditions of runners as events.
+	Recorder record.EventRecorder
 }
 
+// EventConditions are the runner conditions whose changes are reported as
+// events: Normal ones when they turn true, Warning ones otherwise.
+var EventConditions = []string{v1alpha1.ConditionRolledBack, v1alpha1.ConditionExpired}
+
+// WarningConditions are the EventConditions whose changes are always
+// reported as Warning events, since it is bad news when they turn true.
+var WarningConditions = []string{v1alpha1.ConditionExpired}
+
 //+kubebuilder:rbac:groups=servicecatalog.io,resources=servicerunners,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=servicecatalog.io,resources=servicerunners/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=servicecatalog.io,resources=servicerunners/finalizers,verbs=update
 //+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;delete
 //+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
 //+kubebuilder:rbac:groups="",resources=pods/log,verbs=get
-//+kubebuilder:rbac:groups="",resources=secrets,verbs=create;delete
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;create;update;delete
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;create;update
+//+kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;create
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get
+//+kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups=tekton.dev,resources=pipelineruns,verbs=get;list;watch;create;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -58,27 +90,138 @@ func (r *ServiceRunnerReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 
 	runner := &v1alpha1.ServiceRunner{}
 	err := r.Client.Get(ctx, req.NamespacedName, runner)
+	if apierrors.IsNotFound(err) {
+		// the runner is gone; everything it owns is garbage collected
+		return ctrl.Result{}, nil
+	}
 	if err != nil {
 		return ctrl.Result{}, err
 	}
-	res, err := resolve.GetResolver(runner, r.Client).Resolve(ctx)
-	if err != nil {
-		l.Error(err, "Failed to resolve service runner", "runner", runner.Name, "namespace", runner.Namespace, "stage", runner.Status.State)
+	if runner.DeletionTimestamp.IsZero() && !controllerutil.ContainsFinalizer(runner, resolve.Finalizer) {
+		patch := client.MergeFrom(runner.DeepCopy())
+		controllerutil.AddFinalizer(runner, resolve.Finalizer)
+		if err = r.Client.Patch(ctx, runner, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	original := runner.DeepCopy()
+	res, resolveErr := resolve.Advance(ctx, runner, r.Client, r.Executors)
+	if resolveErr != nil {
+		l.Error(resolveErr, "Failed to resolve service runner", "runner", runner.Name, "namespace", runner.Namespace, "stage", runner.Status.State, "class", resolve.Classify(resolveErr))
 	} else {
 		l.Info("Resolved runner", "runner", runner.Name, "namespace", runner.Namespace, "stage", runner.Status.State)
 	}
-	err = r.Client.Status().Update(ctx, runner)
+	resolve.SetConditions(runner, resolveErr)
+	err = r.patchStatus(ctx, original, runner)
 	if err != nil {
-		res.Requeue = true
+		l.Error(err, "Failed to record runner status", "runner", runner.Name, "namespace", runner.Namespace, "stage", runner.Status.State)
+		return ctrl.Result{}, err
+	}
+	r.recordEvents(original, runner)
+
+	// finished runs are only released once the stage they belong to has been
+	// recorded as done; until then they are how the stage is resumed
+	if runner.Status.State == resolve.PIPELINE_DELETED {
+		return ctrl.Result{}, nil
+	}
+	if err = resolve.Release(ctx, r.Executors, original, runner); err != nil {
+		l.Error(err, "Failed to release finished run", "runner", runner.Name, "namespace", runner.Namespace)
+		return ctrl.Result{}, err
 	}
 
-	return res, nil
+	return resolve.Requeue(res, resolveErr)
+}
+
+// recordEvents reports the EventConditions which changed since original.
+func (r *ServiceRunnerReconciler) recordEvents(original, runner *v1alpha1.ServiceRunner) {
+	for _, conditionType := range EventConditions {
+		condition := meta.FindStatusCondition(runner.Status.Conditions, conditionType)
+		if condition == nil {
+			continue
+		}
+		previous := meta.FindStatusCondition(original.Status.Conditions, conditionType)
+		if previous != nil && previous.Status == condition.Status && previous.Reason == condition.Reason {
+			continue
+		}
+		eventType := corev1.EventTypeWarning
+		if condition.Status == metav1.ConditionTrue && !warning(conditionType) {
+			eventType = corev1.EventTypeNormal
+		}
+		r.Recorder.Event(runner, eventType, condition.Reason, condition.Message)
+	}
+}
+
+// warning reports whether conditionType is one of the WarningConditions.
+func warning(conditionType string) bool {
+	for _, t := range WarningConditions {
+		if t == conditionType {
+			return true
+		}
+	}
+	return false
+}
+
+// patchStatus persists the status changes made to runner since original as a
+// merge patch guarded by the resource version.  On conflict the runner is
+// re-read: if only its spec or metadata moved, the status changes are rebased
+// on top of the latest version and retried; if its status moved as well,
+// another reconcile already acted on the runner and ours was computed from a
+// stale copy, so the conflict is returned and the request is requeued.
+func (r *ServiceRunnerReconciler) patchStatus(ctx context.Context, original, runner *v1alpha1.ServiceRunner) error {
+	if equality.Semantic.DeepEqual(original.Status, runner.Status) || runner.Status.State == resolve.PIPELINE_DELETED {
+		// a deleted runner has been released and is going away
+		return nil
+	}
+	status := runner.Status.DeepCopy()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		patch := client.MergeFromWithOptions(original, client.MergeFromWithOptimisticLock{})
+		err := r.Client.Status().Patch(ctx, runner, patch, client.FieldOwner(FieldManager))
+		if !apierrors.IsConflict(err) {
+			return err
+		}
+
+		latest := &v1alpha1.ServiceRunner{}
+		if getErr := r.Client.Get(ctx, client.ObjectKeyFromObject(runner), latest); getErr != nil {
+			return getErr
+		}
+		if !equality.Semantic.DeepEqual(latest.Status, original.Status) {
+			return fmt.Errorf("runner status changed concurrently: %v", err)
+		}
+		original = latest.DeepCopy()
+		latest.Status = *status.DeepCopy()
+		*runner = *latest
+		return err
+	})
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ServiceRunnerReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&servicecatalogiov1alpha1.ServiceRunner{}).
-		Owns(&batchv1.Job{}).
-		Complete(r)
+	if err := resolve.SetupIndexes(context.Background(), mgr.GetFieldIndexer()); err != nil {
+		return err
+	}
+	builder := ctrl.NewControllerManagedBy(mgr).
+		For(&servicecatalogiov1alpha1.ServiceRunner{})
+	// runs of kinds the cluster doesn't serve (e.g. PipelineRuns without
+	// Tekton) aren't watched: their executors report them as invalid, and
+	// should the kind be served later, their runs are polled
+	for _, name := range r.Executors.Names() {
+		for _, run := range r.Executors.WatchesOf(name) {
+			gvk, err := apiutil.GVKForObject(run, mgr.GetScheme())
+			if err != nil {
+				return err
+			}
+			_, err = mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version)
+			if meta.IsNoMatchError(err) {
+				log.Log.Info("Not watching runs of a kind the cluster doesn't serve, polling them", "kind", gvk.String(), "executor", name)
+				r.Executors.Unwatch(name)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			builder = builder.Owns(run)
+		}
+	}
+	return builder.Complete(r)
 }
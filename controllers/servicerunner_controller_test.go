@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"github.com/openshift-app-service-poc/service-runner/pkg/executors/tekton"
+	"github.com/openshift-app-service-poc/service-runner/pkg/executors/webhook"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+	"github.com/openshift-app-service-poc/service-runner/pkg/testsupport"
+)
+
+// timeout leaves room for a NotFound requeue, in case a reconcile sees a
+// finished job before the cache has caught up with its pod.
+const (
+	timeout  = 2*resolve.NotFoundRequeueDelay + 10*time.Second
+	interval = 100 * time.Millisecond
+)
+
+var namespaces = 0
+
+var _ = Describe("ServiceRunner controller", func() {
+	var (
+		ctx       context.Context
+		namespace string
+		key       client.ObjectKey
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		// namespaces can't be deleted in envtest, every spec gets its own
+		namespaces++
+		namespace = fmt.Sprintf("runners-%d", namespaces)
+		Expect(k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})).To(Succeed())
+		key = client.ObjectKey{Namespace: namespace, Name: "db"}
+	})
+
+	newRunner := func(params map[string]string) *v1alpha1.ServiceRunner {
+		return &v1alpha1.ServiceRunner{
+			ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+			Spec: v1alpha1.ServiceRunnerSpec{
+				ServiceImage: v1alpha1.ServiceRunnerImage{CrudImage: "quay.io/example/crud:latest"},
+				ServiceParam: params,
+			},
+		}
+	}
+
+	getRunner := func() *v1alpha1.ServiceRunner {
+		runner := &v1alpha1.ServiceRunner{}
+		Expect(k8sClient.Get(ctx, key, runner)).To(Succeed())
+		return runner
+	}
+
+	state := func() string {
+		return getRunner().Status.State
+	}
+
+	synced := func() string {
+		cond := meta.FindStatusCondition(getRunner().Status.Conditions, v1alpha1.ConditionSynced)
+		if cond == nil || cond.Status == metav1.ConditionTrue {
+			return ""
+		}
+		return cond.Reason
+	}
+
+	setParams := func(params map[string]string) {
+		runner := getRunner()
+		patch := client.MergeFrom(runner.DeepCopy())
+		runner.Spec.ServiceParam = params
+		Expect(k8sClient.Patch(ctx, runner, patch)).To(Succeed())
+	}
+
+	script := func(operation string, behavior testsupport.Behavior) {
+		executor.Script(key.Namespace, key.Name, operation, behavior)
+	}
+
+	It("provisions, reads, updates and deletes a service", func() {
+		script(resolve.OPERATION_READ, testsupport.Behavior{Outcome: testsupport.Succeed, Output: `{"host":"db.example.com"}`})
+		Expect(k8sClient.Create(ctx, newRunner(map[string]string{"SIZE": "small"}))).To(Succeed())
+
+		By("creating the service and publishing its binding")
+		Eventually(state, timeout, interval).Should(Equal(resolve.PIPELINE_READY))
+		runner := getRunner()
+		Expect(runner.Finalizers).To(ContainElement(resolve.Finalizer))
+		Expect(runner.Status.ObservedGeneration).To(Equal(int64(1)))
+		Expect(meta.IsStatusConditionTrue(runner.Status.Conditions, v1alpha1.ConditionReady)).To(BeTrue())
+		Expect(runner.Status.Binding).NotTo(BeNil())
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: runner.Status.Binding.Name}, secret)).To(Succeed())
+		Expect(secret.Data).To(HaveKeyWithValue("host", []byte("db.example.com")))
+		Expect(executor.Launched(namespace, "db")).To(Equal([]string{"db-create-1", "db-read-1"}))
+
+		By("updating the service once its spec changes")
+		setParams(map[string]string{"SIZE": "large"})
+		Eventually(func() int64 {
+			return getRunner().Status.ObservedGeneration
+		}, timeout, interval).Should(Equal(int64(2)))
+		Expect(state()).To(Equal(resolve.PIPELINE_READY))
+		Expect(getRunner().Status.AppliedParams).To(HaveKeyWithValue("SIZE", "large"))
+		Expect(executor.Launched(namespace, "db")).To(Equal([]string{"db-create-1", "db-read-1", "db-update-2", "db-read-2"}))
+
+		By("deleting the service before releasing the runner")
+		Expect(k8sClient.Delete(ctx, getRunner())).To(Succeed())
+		Eventually(func() bool {
+			return apierrors.IsNotFound(k8sClient.Get(ctx, key, &v1alpha1.ServiceRunner{}))
+		}, timeout, interval).Should(BeTrue())
+		Expect(executor.Launched(namespace, "db")).To(ContainElement("db-delete-2"))
+	})
+
+	It("fails on a failed create job and retries once the spec is fixed", func() {
+		script(resolve.OPERATION_CREATE, testsupport.Behavior{Outcome: testsupport.Fail})
+		Expect(k8sClient.Create(ctx, newRunner(map[string]string{"SIZE": "huge"}))).To(Succeed())
+
+		Eventually(state, timeout, interval).Should(Equal(resolve.PIPELINE_FAILED))
+		Expect(synced()).To(Equal(string(resolve.ErrorJobFailed)))
+
+		script(resolve.OPERATION_CREATE, testsupport.DefaultBehavior)
+		setParams(map[string]string{"SIZE": "small"})
+		Eventually(state, timeout, interval).Should(Equal(resolve.PIPELINE_READY))
+		Expect(synced()).To(BeEmpty())
+		Expect(executor.Launched(namespace, "db")).To(Equal([]string{"db-create-1", "db-create-2", "db-read-2"}))
+	})
+
+	It("fails on a timed out create job", func() {
+		script(resolve.OPERATION_CREATE, testsupport.Behavior{Outcome: testsupport.TimeOut})
+		Expect(k8sClient.Create(ctx, newRunner(nil))).To(Succeed())
+
+		Eventually(state, timeout, interval).Should(Equal(resolve.PIPELINE_FAILED))
+		Expect(synced()).To(Equal(string(resolve.ErrorJobFailed)))
+	})
+
+	It("fails on malformed read output", func() {
+		script(resolve.OPERATION_READ, testsupport.Behavior{Outcome: testsupport.Succeed, Output: "not json"})
+		Expect(k8sClient.Create(ctx, newRunner(nil))).To(Succeed())
+
+		Eventually(state, timeout, interval).Should(Equal(resolve.PIPELINE_FAILED))
+		Expect(synced()).To(Equal(string(resolve.ErrorJobFailed)))
+		Expect(getRunner().Status.Binding).To(BeNil())
+	})
+
+	It("keeps the runner when its delete job fails", func() {
+		script(resolve.OPERATION_DELETE, testsupport.Behavior{Outcome: testsupport.Fail})
+		Expect(k8sClient.Create(ctx, newRunner(nil))).To(Succeed())
+		Eventually(state, timeout, interval).Should(Equal(resolve.PIPELINE_READY))
+
+		Expect(k8sClient.Delete(ctx, getRunner())).To(Succeed())
+		Eventually(state, timeout, interval).Should(Equal(resolve.PIPELINE_FAILED))
+		Consistently(func() []string {
+			return getRunner().Finalizers
+		}, time.Second, interval).Should(ContainElement(resolve.Finalizer))
+		Expect(getRunner().DeletionTimestamp).NotTo(BeNil())
+	})
+
+	It("runs operations as Tekton PipelineRuns", func() {
+		runner := newRunner(map[string]string{"SIZE": "small"})
+		runner.Spec.ServiceImage.CrudImage = ""
+		runner.Spec.Executor = &v1alpha1.ServiceRunnerExecutor{
+			Name: tekton.Name,
+			Tekton: &v1alpha1.TektonExecutorSpec{Pipelines: map[string]string{
+				resolve.OPERATION_CREATE: "provision-db",
+				resolve.OPERATION_READ:   "describe-db",
+				resolve.OPERATION_DELETE: "deprovision-db",
+			}},
+		}
+		Expect(k8sClient.Create(ctx, runner)).To(Succeed())
+
+		// finish stands in for Tekton, completing a run once it exists
+		finish := func(name string, results ...interface{}) {
+			run := tekton.NewPipelineRun()
+			Eventually(func() error {
+				return k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, run)
+			}, timeout, interval).Should(Succeed())
+			run.Object["status"] = map[string]interface{}{
+				"conditions":      []interface{}{map[string]interface{}{"type": "Succeeded", "status": "True", "reason": "Succeeded"}},
+				"pipelineResults": results,
+			}
+			Expect(k8sClient.Status().Update(ctx, run)).To(Succeed())
+		}
+
+		By("creating the service and publishing the pipeline results")
+		finish("db-create-1")
+		finish("db-read-1", map[string]interface{}{"name": "host", "value": "db.example.com"})
+		Eventually(state, timeout, interval).Should(Equal(resolve.PIPELINE_READY))
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: getRunner().Status.Binding.Name}, secret)).To(Succeed())
+		Expect(secret.Data).To(HaveKeyWithValue("host", []byte("db.example.com")))
+		Expect(executor.Launched(namespace, "db")).To(BeEmpty())
+
+		By("deleting the service with its pipeline")
+		Expect(k8sClient.Delete(ctx, getRunner())).To(Succeed())
+		finish("db-delete-1")
+		Eventually(func() bool {
+			return apierrors.IsNotFound(k8sClient.Get(ctx, key, &v1alpha1.ServiceRunner{}))
+		}, timeout, interval).Should(BeTrue())
+	})
+
+	It("polls asynchronous webhook operations until they are done", func() {
+		// the control plane takes a couple of polls to create the service
+		var polls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPost && r.URL.Path == "/create":
+				w.Header().Set("Location", "/operations/create")
+				w.WriteHeader(http.StatusAccepted)
+			case r.Method == http.MethodGet && atomic.AddInt32(&polls, 1) < 3:
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusAccepted)
+			case r.Method == http.MethodGet:
+				w.WriteHeader(http.StatusOK)
+			default:
+				_, _ = w.Write([]byte(`{"host":"db.example.com"}`))
+			}
+		}))
+		defer server.Close()
+		runner := newRunner(map[string]string{"SIZE": "small"})
+		runner.Spec.ServiceImage.CrudImage = ""
+		runner.Spec.Executor = &v1alpha1.ServiceRunnerExecutor{
+			Name:    webhook.Name,
+			Webhook: &v1alpha1.WebhookExecutorSpec{URL: server.URL},
+		}
+		Expect(k8sClient.Create(ctx, runner)).To(Succeed())
+
+		By("creating the service although nothing signals its progress")
+		Eventually(state, timeout, interval).Should(Equal(resolve.PIPELINE_READY))
+		Expect(atomic.LoadInt32(&polls)).To(BeNumerically(">=", 3))
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: getRunner().Status.Binding.Name}, secret)).To(Succeed())
+		Expect(secret.Data).To(HaveKeyWithValue("host", []byte("db.example.com")))
+	})
+})
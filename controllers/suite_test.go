@@ -17,6 +17,7 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
 	"path/filepath"
 	"testing"
 
@@ -24,6 +25,8 @@ import (
 	. "github.com/onsi/gomega"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 	"sigs.k8s.io/controller-runtime/pkg/envtest/printer"
@@ -31,6 +34,10 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	servicecatalogiov1alpha1 "github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"github.com/openshift-app-service-poc/service-runner/pkg/executors/tekton"
+	"github.com/openshift-app-service-poc/service-runner/pkg/executors/webhook"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+	"github.com/openshift-app-service-poc/service-runner/pkg/testsupport"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -40,6 +47,8 @@ import (
 var cfg *rest.Config
 var k8sClient client.Client
 var testEnv *envtest.Environment
+var executor *testsupport.FakeJobExecutor
+var cancel context.CancelFunc
 
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -54,7 +63,11 @@ var _ = BeforeSuite(func() {
 
 	By("bootstrapping test environment")
 	testEnv = &envtest.Environment{
-		CRDDirectoryPaths:     []string{filepath.Join("..", "config", "crd", "bases")},
+		CRDDirectoryPaths: []string{
+			filepath.Join("..", "config", "crd", "bases"),
+			// served so that the tekton executor can be exercised
+			filepath.Join("..", "test", "crds"),
+		},
 		ErrorIfCRDPathMissing: true,
 	}
 
@@ -73,10 +86,45 @@ var _ = BeforeSuite(func() {
 	Expect(err).NotTo(HaveOccurred())
 	Expect(k8sClient).NotTo(BeNil())
 
+	By("starting the controller, with fake jobs")
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:             scheme.Scheme,
+		MetricsBindAddress: "0",
+		NewCache: cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: resolve.CacheSelectors(),
+		}),
+		ClientDisableCacheFor: resolve.UncachedObjects(),
+	})
+	Expect(err).NotTo(HaveOccurred())
+
+	executor = testsupport.NewFakeJobExecutor(mgr.GetClient())
+	Expect(executor.SetupWithManager(mgr)).To(Succeed())
+	executors := resolve.NewRegistry()
+	executors.Register(resolve.JobExecutorName, resolve.NewJobExecutor(mgr.GetClient(), mgr.GetAPIReader(), executor, ""))
+	executors.Register(tekton.Name, tekton.New(mgr.GetClient()))
+	executors.Register(webhook.Name, webhook.New(mgr.GetClient(), nil))
+	err = (&ServiceRunnerReconciler{
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Executors: executors,
+		Recorder:  mgr.GetEventRecorderFor("servicerunner-controller"),
+	}).SetupWithManager(mgr)
+	Expect(err).NotTo(HaveOccurred())
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		defer GinkgoRecover()
+		Expect(mgr.Start(ctx)).To(Succeed())
+	}()
+
 }, 60)
 
 var _ = AfterSuite(func() {
 	By("tearing down the test environment")
+	if cancel != nil {
+		cancel()
+	}
 	err := testEnv.Stop()
 	Expect(err).NotTo(HaveOccurred())
 })
@@ -0,0 +1,49 @@
+/*
+Copyright 2022 Red Hat.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// statediagram prints the ServiceRunner pipeline state machine, either as a
+// markdown document embedding a Mermaid diagram or as a Graphviz digraph.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+const header = `# ServiceRunner state machine
+
+Generated from the transition table in pkg/resolve/machine.go by
+` + "`make state-diagram`" + `; do not edit by hand.
+
+`
+
+func main() {
+	format := flag.String("format", "markdown", "Output format: markdown or dot.")
+	flag.Parse()
+
+	switch *format {
+	case "markdown":
+		fmt.Print(header + "```mermaid\n" + resolve.Mermaid() + "```\n")
+	case "dot":
+		fmt.Print(resolve.DOT())
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		os.Exit(1)
+	}
+}
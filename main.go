@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 
@@ -24,15 +25,23 @@ import (
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	servicecatalogiov1alpha1 "github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
 	"github.com/openshift-app-service-poc/service-runner/controllers"
+	"github.com/openshift-app-service-poc/service-runner/pkg/executors/helm"
+	"github.com/openshift-app-service-poc/service-runner/pkg/executors/osb"
+	"github.com/openshift-app-service-poc/service-runner/pkg/executors/tekton"
+	"github.com/openshift-app-service-poc/service-runner/pkg/executors/webhook"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -52,11 +61,17 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var helmImage string
+	var clusterID string
+	var lockNamespace string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&helmImage, "helm-image", helm.DefaultImage, "The image running helm for runners which don't select one.")
+	flag.StringVar(&clusterID, "cluster-id", "", "The cluster identifier handed to jobs; defaults to the UID of the kube-system namespace.")
+	flag.StringVar(&lockNamespace, "lock-namespace", "", "The namespace of the Leases locking services runners share; defaults to the namespace of each runner.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -72,15 +87,45 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "cb40079e.servicecatalog.io",
+		// only the jobs and pods launched by runners are cached
+		NewCache: cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: resolve.CacheSelectors(),
+		}),
+		ClientDisableCacheFor: resolve.UncachedObjects(),
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
+	if clusterID == "" {
+		kubeSystem := &corev1.Namespace{}
+		if err := mgr.GetAPIReader().Get(context.Background(), client.ObjectKey{Name: "kube-system"}, kubeSystem); err != nil {
+			setupLog.Error(err, "unable to identify the cluster, jobs run without a cluster ID")
+		}
+		clusterID = string(kubeSystem.UID)
+	}
+
+	logs, err := resolve.NewLogReader(mgr.GetConfig())
+	if err != nil {
+		setupLog.Error(err, "unable to create log reader")
+		os.Exit(1)
+	}
+
+	executors := resolve.NewRegistry()
+	executors.LockNamespace = lockNamespace
+	executors.Reader = mgr.GetAPIReader()
+	executors.Register(resolve.JobExecutorName, resolve.NewJobExecutor(mgr.GetClient(), mgr.GetAPIReader(), logs, clusterID))
+	executors.Register(webhook.Name, webhook.New(mgr.GetClient(), nil))
+	executors.Register(osb.Name, osb.New(mgr.GetClient(), nil))
+	executors.Register(tekton.Name, tekton.New(mgr.GetClient()))
+	executors.Register(helm.Name, helm.New(mgr.GetClient(), mgr.GetAPIReader(), helmImage))
+
 	if err = (&controllers.ServiceRunnerReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Executors: executors,
+		Recorder:  mgr.GetEventRecorderFor("servicerunner-controller"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ServiceRunner")
 		os.Exit(1)
@@ -0,0 +1,377 @@
+// Package helm installs a Helm chart as the service of a runner, running
+// helm in Jobs so that the pipeline follows them as it follows the Jobs of
+// the job executor:
+//
+//	create, update  helm upgrade --install <release> <chart> --values <params>
+//	read            helm status <release>
+//	delete          helm uninstall <release>, unless it is gone already
+//
+// The binding data isn't read from the Job: the templates of
+// spec.executor.helm.outputs are evaluated against the objects of the
+// deployed release, as helm recorded them in its release Secret.
+package helm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+// Name is the name the executor is registered under.
+const Name = "helm"
+
+// DefaultImage runs helm for runners which don't select an image.
+const DefaultImage = "docker.io/alpine/helm:3.9.0"
+
+// registryConfig is where the control-plane Secret is mounted; its
+// config.json key authenticates to OCI registries.
+const registryConfig = "/var/run/secrets/servicerunner.io/control-plane"
+
+// Executor runs helm in Jobs.  Polling and cancelling them is left to a
+// JobExecutor; their kind is watched on behalf of the job executor.
+type Executor struct {
+	client client.Client
+	reader client.Reader
+	jobs   *resolve.JobExecutor
+	image  string
+}
+
+var _ resolve.Executor = &Executor{}
+var _ resolve.SingleInstance = &Executor{}
+
+// New returns an executor creating Jobs through client, of image or
+// DefaultImage.  Release Secrets are listed with reader, which should not
+// be cached; when nil, they are listed through client.
+func New(client client.Client, reader client.Reader, image string) *Executor {
+	if image == "" {
+		image = DefaultImage
+	}
+	if reader == nil {
+		reader = client
+	}
+	return &Executor{client: client, reader: reader, jobs: resolve.NewJobExecutor(client, nil, nil, ""), image: image}
+}
+
+// SingleInstance marks the executor: a runner has a single release, named
+// after it.
+func (e *Executor) SingleInstance() {}
+
+func spec(runner *v1alpha1.ServiceRunner) (*v1alpha1.HelmExecutorSpec, error) {
+	if runner.Spec.Executor == nil || runner.Spec.Executor.Helm == nil || runner.Spec.Executor.Helm.Chart == "" {
+		return nil, resolve.InvalidSpec("spec.executor.helm.chart must be set")
+	}
+	return runner.Spec.Executor.Helm, nil
+}
+
+// ReleaseName returns the name of the release of runner.
+func ReleaseName(runner *v1alpha1.ServiceRunner) string {
+	if runner.Spec.Executor != nil && runner.Spec.Executor.Helm != nil && runner.Spec.Executor.Helm.ReleaseName != "" {
+		return runner.Spec.Executor.Helm.ReleaseName
+	}
+	return runner.Name
+}
+
+// Values nests the service parameters into chart values: "a.b" sets the value
+// b of the map a.  All values are strings, as with helm --set-string.
+func Values(params map[string]string) (map[string]interface{}, error) {
+	var keys []string
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := map[string]interface{}{}
+	for _, key := range keys {
+		path := strings.Split(key, ".")
+		current := values
+		for i, name := range path {
+			if name == "" {
+				return nil, resolve.InvalidSpec("spec.serviceParams key %q is not a valid value path", key)
+			}
+			if i == len(path)-1 {
+				if _, ok := current[name]; ok {
+					return nil, resolve.InvalidSpec("spec.serviceParams key %q conflicts with another key", key)
+				}
+				current[name] = params[key]
+				break
+			}
+			next, ok := current[name]
+			if !ok {
+				next = map[string]interface{}{}
+				current[name] = next
+			}
+			nested, ok := next.(map[string]interface{})
+			if !ok {
+				return nil, resolve.InvalidSpec("spec.serviceParams key %q conflicts with another key", key)
+			}
+			current = nested
+		}
+	}
+	return values, nil
+}
+
+// script runs helm with the values passed in $VALUES, written to a file
+// first as helm only reads values from files.
+const script = `printf '%s' "$VALUES" > /tmp/values.json && exec helm "$@" --values /tmp/values.json`
+
+// uninstall tolerates a release which is gone already, so that a delete
+// launched again after a lost status write succeeds.
+const uninstall = `helm status "$1" --namespace "$2" > /dev/null 2>&1 || exit 0; exec helm uninstall "$1" --namespace "$2" --wait`
+
+// JobTemplate builds the Job running op for runner.
+func (e *Executor) JobTemplate(runner *v1alpha1.ServiceRunner, op resolve.Operation) (*batchv1.Job, error) {
+	helm, err := spec(runner)
+	if err != nil {
+		return nil, err
+	}
+	release := ReleaseName(runner)
+	container := corev1.Container{Name: "helm", Image: e.image}
+	if helm.Image != "" {
+		container.Image = helm.Image
+	}
+
+	switch op.Name {
+	case resolve.OPERATION_CREATE, resolve.OPERATION_UPDATE:
+		values, err := Values(op.Params)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		container.Command = []string{"/bin/sh", "-c", script, "helm"}
+		container.Args = []string{"upgrade", "--install", release, helm.Chart, "--namespace", runner.Namespace, "--wait"}
+		if helm.Version != "" {
+			container.Args = append(container.Args, "--version", helm.Version)
+		}
+		container.Env = []corev1.EnvVar{{Name: "VALUES", Value: string(raw)}}
+	case resolve.OPERATION_READ:
+		container.Command = []string{"helm"}
+		container.Args = []string{"status", release, "--namespace", runner.Namespace}
+	case resolve.OPERATION_DELETE:
+		container.Command = []string{"/bin/sh", "-c", uninstall, "helm"}
+		container.Args = []string{release, runner.Namespace}
+	default:
+		return nil, resolve.InvalidSpec("the helm executor has no %s operation", op.Name)
+	}
+
+	job := &batchv1.Job{}
+	job.Name = op.ID
+	job.Namespace = runner.Namespace
+	job.Labels = map[string]string{resolve.JobLabel: runner.Name}
+	job.Spec.Template.Labels = map[string]string{resolve.JobLabel: runner.Name}
+	job.OwnerReferences = []metav1.OwnerReference{resolve.RunnerOwner(runner)}
+	if runner.Spec.ControlPlaneSecret != "" {
+		job.Spec.Template.Spec.Volumes = []corev1.Volume{{
+			Name: resolve.CONTROL_PLANE_SECRET,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: runner.Spec.ControlPlaneSecret},
+			},
+		}}
+		container.VolumeMounts = []corev1.VolumeMount{{Name: resolve.CONTROL_PLANE_SECRET, MountPath: registryConfig, ReadOnly: true}}
+		container.Env = append(container.Env, corev1.EnvVar{Name: "HELM_REGISTRY_CONFIG", Value: registryConfig + "/config.json"})
+	}
+	job.Spec.Template.Spec.Containers = []corev1.Container{container}
+	job.Spec.Template.Spec.ServiceAccountName = helm.ServiceAccountName
+	job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyOnFailure
+	deadline := int64(resolve.JobDeadline.Seconds())
+	job.Spec.ActiveDeadlineSeconds = &deadline
+	return job, nil
+}
+
+// Launch creates the Job running op; as with the job executor, a Job which
+// exists already is adopted.
+func (e *Executor) Launch(ctx context.Context, runner *v1alpha1.ServiceRunner, op resolve.Operation) (string, error) {
+	job, err := e.JobTemplate(runner, op)
+	if err != nil {
+		return "", err
+	}
+	if err := e.client.Create(ctx, job); err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", err
+	}
+	return job.Name, nil
+}
+
+// Poll reports the state of the Job.
+func (e *Executor) Poll(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (resolve.RunStatus, error) {
+	return e.jobs.Poll(ctx, runner, ref)
+}
+
+// Cancel deletes the Job.
+func (e *Executor) Cancel(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) error {
+	return e.jobs.Cancel(ctx, runner, ref)
+}
+
+// Outputs evaluates the output templates against the deployed release.
+func (e *Executor) Outputs(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (map[string]string, error) {
+	helm, err := spec(runner)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := e.releaseObjects(ctx, runner)
+	if err != nil {
+		return nil, err
+	}
+	return Render(helm.Outputs, Release{Name: ReleaseName(runner), Namespace: runner.Namespace, Objects: objects})
+}
+
+// Release is what output templates are evaluated against.
+type Release struct {
+	Name      string
+	Namespace string
+
+	// Objects are the rendered objects of the release.
+	Objects []map[string]interface{}
+}
+
+// object returns the object of the release with the given kind and name.
+func (r Release) object(kind, name string) (map[string]interface{}, error) {
+	for _, obj := range r.Objects {
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		if obj["kind"] == kind && metadata != nil && metadata["name"] == name {
+			return obj, nil
+		}
+	}
+	return nil, fmt.Errorf("release %s has no %s %s", r.Name, kind, name)
+}
+
+// secretValue returns the decoded value of key in the Secret name of the
+// release, e.g. a password the chart generated.
+func (r Release) secretValue(name, key string) (string, error) {
+	secret, err := r.object("Secret", name)
+	if err != nil {
+		return "", err
+	}
+	if data, ok := secret["stringData"].(map[string]interface{}); ok {
+		if value, ok := data[key].(string); ok {
+			return value, nil
+		}
+	}
+	if data, ok := secret["data"].(map[string]interface{}); ok {
+		if value, ok := data[key].(string); ok {
+			decoded, err := base64.StdEncoding.DecodeString(value)
+			return string(decoded), err
+		}
+	}
+	return "", fmt.Errorf("secret %s of release %s has no key %s", name, r.Name, key)
+}
+
+// Render evaluates the output templates against release.  Templates which
+// don't parse are an invalid spec; templates which fail against the release
+// fail the read.
+func Render(outputs map[string]string, release Release) (map[string]string, error) {
+	funcs := template.FuncMap{
+		"object":      release.object,
+		"secretValue": release.secretValue,
+		"b64dec": func(s string) (string, error) {
+			decoded, err := base64.StdEncoding.DecodeString(s)
+			return string(decoded), err
+		},
+	}
+	rendered := map[string]string{}
+	for key, text := range outputs {
+		tmpl, err := template.New(key).Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, resolve.InvalidSpec("spec.executor.helm.outputs[%s]: %v", key, err)
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, release); err != nil {
+			return nil, resolve.JobFailed("output %s: %v", key, err)
+		}
+		rendered[key] = out.String()
+	}
+	return rendered, nil
+}
+
+// releaseObjects decodes the manifest of the deployed release, from the
+// latest release Secret helm wrote, selected by the labels helm sets.
+func (e *Executor) releaseObjects(ctx context.Context, runner *v1alpha1.ServiceRunner) ([]map[string]interface{}, error) {
+	release := ReleaseName(runner)
+	secrets := &corev1.SecretList{}
+	err := e.reader.List(ctx, secrets,
+		client.InNamespace(runner.Namespace),
+		client.MatchingLabels{"owner": "helm", "name": release, "status": "deployed"},
+	)
+	if err != nil {
+		return nil, err
+	}
+	var latest *corev1.Secret
+	latestVersion := -1
+	for i := range secrets.Items {
+		version, err := strconv.Atoi(secrets.Items[i].Labels["version"])
+		if err == nil && version > latestVersion {
+			latest, latestVersion = &secrets.Items[i], version
+		}
+	}
+	if latest == nil {
+		return nil, resolve.NotFound("no deployed helm release %s found", release)
+	}
+	manifest, err := decodeManifest(latest.Data["release"])
+	if err != nil {
+		return nil, resolve.JobFailed("helm release %s: %v", latest.Name, err)
+	}
+	return decodeObjects(manifest)
+}
+
+// decodeManifest extracts the manifest from a release as helm stores it:
+// base64-encoded, gzipped JSON.
+func decodeManifest(raw []byte) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(string(raw))
+	if err != nil {
+		return "", err
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		if data, err = io.ReadAll(reader); err != nil {
+			return "", err
+		}
+	}
+	var release struct {
+		Manifest string `json:"manifest"`
+	}
+	if err := json.Unmarshal(data, &release); err != nil {
+		return "", err
+	}
+	return release.Manifest, nil
+}
+
+func decodeObjects(manifest string) ([]map[string]interface{}, error) {
+	decoder := utilyaml.NewYAMLOrJSONDecoder(strings.NewReader(manifest), 4096)
+	var objects []map[string]interface{}
+	for {
+		obj := map[string]interface{}{}
+		err := decoder.Decode(&obj)
+		if errors.Is(err, io.EOF) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, resolve.JobFailed("malformed release manifest: %v", err)
+		}
+		if len(obj) != 0 {
+			objects = append(objects, obj)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package helm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+const manifest = `---
+# Source: redis/templates/secret.yaml
+apiVersion: v1
+kind: Secret
+metadata:
+  name: cache-redis
+data:
+  redis-password: "czNjcjN0"
+---
+# Source: redis/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: cache-redis-master
+spec:
+  ports:
+  - name: redis
+    port: 6379
+`
+
+func newTestRunner() *v1alpha1.ServiceRunner {
+	return &v1alpha1.ServiceRunner{
+		ObjectMeta: metav1.ObjectMeta{Name: "cache", Namespace: "apps", UID: "4a3c"},
+		Spec: v1alpha1.ServiceRunnerSpec{
+			ControlPlaneSecret: "registry",
+			Executor: &v1alpha1.ServiceRunnerExecutor{
+				Name: Name,
+				Helm: &v1alpha1.HelmExecutorSpec{
+					Chart:              "oci://registry.example.com/charts/redis",
+					Version:            "17.0.1",
+					ServiceAccountName: "installer",
+					Outputs: map[string]string{
+						"host":     `{{ (object "Service" "cache-redis-master").metadata.name }}.{{ .Namespace }}.svc`,
+						"port":     `{{ (index (object "Service" "cache-redis-master").spec.ports 0).port }}`,
+						"password": `{{ secretValue "cache-redis" "redis-password" }}`,
+					},
+				},
+			},
+		},
+	}
+}
+
+// newReleaseSecret stores manifest as helm stores release version of cache.
+func newReleaseSecret(t *testing.T, version, status, manifest string) *corev1.Secret {
+	t.Helper()
+	raw, err := json.Marshal(map[string]interface{}{"name": "cache", "manifest": manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zipped bytes.Buffer
+	w := gzip.NewWriter(&zipped)
+	if _, err := w.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sh.helm.release.v1.cache.v" + version,
+			Namespace: "apps",
+			Labels:    map[string]string{"owner": "helm", "name": "cache", "status": status, "version": version},
+		},
+		Type: "helm.sh/release.v1",
+		Data: map[string][]byte{"release": []byte(base64.StdEncoding.EncodeToString(zipped.Bytes()))},
+	}
+}
+
+func TestValues(t *testing.T) {
+	values, err := Values(map[string]string{"auth.password": "s3cr3t", "auth.enabled": "true", "replicas": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"auth":     map[string]interface{}{"password": "s3cr3t", "enabled": "true"},
+		"replicas": "3",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Values() = %v, want %v", values, want)
+	}
+
+	for _, params := range []map[string]string{
+		{"auth": "none", "auth.password": "s3cr3t"},
+		{"auth..password": "s3cr3t"},
+	} {
+		if _, err := Values(params); resolve.Classify(err) != resolve.ErrorInvalidSpec {
+			t.Errorf("Values(%v) error = %v, want an invalid spec", params, err)
+		}
+	}
+}
+
+func TestLaunch(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	e := New(c, nil, "")
+	runner := newTestRunner()
+
+	ref, err := e.Launch(ctx, runner, resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "cache-create-1", Params: map[string]string{"auth.password": "s3cr3t"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &batchv1.Job{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: ref}, job); err != nil {
+		t.Fatal(err)
+	}
+	pod := job.Spec.Template.Spec
+	container := pod.Containers[0]
+	if container.Image != DefaultImage || pod.ServiceAccountName != "installer" {
+		t.Errorf("job runs %s as %q, want the default image as the installer", container.Image, pod.ServiceAccountName)
+	}
+	args := strings.Join(container.Args, " ")
+	if args != "upgrade --install cache oci://registry.example.com/charts/redis --namespace apps --wait --version 17.0.1" {
+		t.Errorf("args = %q, want an upgrade --install of the chart version", args)
+	}
+	env := map[string]string{}
+	for _, v := range container.Env {
+		env[v.Name] = v.Value
+	}
+	if env["VALUES"] != `{"auth":{"password":"s3cr3t"}}` || env["HELM_REGISTRY_CONFIG"] == "" {
+		t.Errorf("env = %v, want the values and the registry config", env)
+	}
+	if job.Labels[resolve.JobLabel] != "cache" || job.Spec.Template.Labels[resolve.JobLabel] != "cache" {
+		t.Errorf("job labels %v, pod labels %v; want both labelled for the cache", job.Labels, job.Spec.Template.Labels)
+	}
+
+	// the Job is followed as the job executor follows its own
+	job.Status.Succeeded = 1
+	if err := c.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := e.Poll(ctx, runner, ref); err != nil || status.State != resolve.RunSucceeded {
+		t.Fatalf("Poll() = %+v, %v; want succeeded", status, err)
+	}
+}
+
+func TestDeleteTemplate(t *testing.T) {
+	runner := newTestRunner()
+	runner.Spec.Executor.Helm.ReleaseName = "shared-cache"
+	job, err := New(nil, nil, "").JobTemplate(runner, resolve.Operation{Name: resolve.OPERATION_DELETE, ID: "cache-delete-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	if !strings.Contains(container.Command[2], "helm uninstall") || !reflect.DeepEqual(container.Args, []string{"shared-cache", "apps"}) {
+		t.Errorf("command %v %v, want an uninstall of the release", container.Command, container.Args)
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	ctx := context.Background()
+	// release Secrets are listed with the reader, never through the client
+	reader := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(
+		newReleaseSecret(t, "1", "superseded", "---\n"),
+		newReleaseSecret(t, "2", "deployed", manifest),
+	).Build()
+	e := New(fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build(), reader, "")
+
+	outputs, err := e.Outputs(ctx, newTestRunner(), "cache-read-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"host": "cache-redis-master.apps.svc", "port": "6379", "password": "s3cr3t"}
+	if !reflect.DeepEqual(outputs, want) {
+		t.Errorf("Outputs() = %v, want %v", outputs, want)
+	}
+}
+
+func TestOutputErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		release  bool
+		want     resolve.ErrorClass
+	}{
+		{name: "no deployed release", template: "{{ .Name }}", want: resolve.ErrorNotFound},
+		{name: "malformed template", template: "{{ .Name ", release: true, want: resolve.ErrorInvalidSpec},
+		{name: "missing object", template: `{{ object "Service" "cache" }}`, release: true, want: resolve.ErrorJobFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme)
+			if tt.release {
+				builder = builder.WithObjects(newReleaseSecret(t, "1", "deployed", manifest))
+			}
+			runner := newTestRunner()
+			runner.Spec.Executor.Helm.Outputs = map[string]string{"out": tt.template}
+			_, err := New(builder.Build(), nil, "").Outputs(context.Background(), runner, "cache-read-1")
+			if got := resolve.Classify(err); got != tt.want {
+				t.Fatalf("Outputs() error = %v (class %q), want class %q", err, got, tt.want)
+			}
+		})
+	}
+}
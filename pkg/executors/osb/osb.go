@@ -0,0 +1,470 @@
+// Package osb runs the operations of a runner against a broker implementing
+// the Open Service Broker API v2.17.
+//
+// Operations map to broker calls on a service instance and a binding, both
+// identified by the runner UID; the instance of a service known by its ID,
+// e.g. an imported one, is identified by that ID instead:
+//
+//	create  provision   PUT    /v2/service_instances/:id
+//	update  update      PATCH  /v2/service_instances/:id
+//	read    bind        PUT    /v2/service_instances/:id/service_bindings/:id
+//	delete  unbind      DELETE /v2/service_instances/:id/service_bindings/:id
+//	        deprovision DELETE /v2/service_instances/:id
+//
+// Asynchronous operations are polled through last_operation, again after the
+// Retry-After the broker answers with, or resolve.PollInterval without one;
+// the credentials of the binding are the binding data of the runner.
+package osb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+// Name is the name the executor is registered under.
+const Name = "osb"
+
+// APIVersion is the version of the broker API spoken.
+const APIVersion = "2.17"
+
+// Timeout bounds every call to a broker.
+const Timeout = 30 * time.Second
+
+// maxBody bounds how much of a response is read.
+const maxBody = 1 << 20
+
+// Executor drives the broker declared by the control-plane Secret of a
+// runner.
+type Executor struct {
+	client client.Client
+	http   *http.Client
+}
+
+var _ resolve.Executor = &Executor{}
+var _ resolve.SingleInstance = &Executor{}
+
+// New returns an executor reading broker credentials through client; a nil
+// httpClient defaults to one bounded by Timeout.
+func New(client client.Client, httpClient *http.Client) *Executor {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: Timeout}
+	}
+	return &Executor{client: client, http: httpClient}
+}
+
+// SingleInstance marks the executor: the instance and the binding of a runner
+// are identified by its UID, whatever the operation.
+func (e *Executor) SingleInstance() {}
+
+// broker is a broker endpoint, for one runner.
+type broker struct {
+	url      *url.URL
+	username string
+	password string
+	http     *http.Client
+
+	serviceID string
+	planID    string
+	instance  string
+	binding   string
+}
+
+// broker returns the broker of runner, addressing the instance with the given
+// ID, or the one of the runner when empty.
+func (e *Executor) broker(ctx context.Context, runner *v1alpha1.ServiceRunner, instance string) (*broker, error) {
+	spec := runner.Spec.Executor
+	if spec == nil || spec.OSB == nil || spec.OSB.ServiceID == "" || spec.OSB.PlanID == "" {
+		return nil, resolve.InvalidSpec("spec.executor.osb.serviceId and planId must be set")
+	}
+	if runner.Spec.ControlPlaneSecret == "" {
+		return nil, resolve.InvalidSpec("spec.controlPlaneSecret must name the Secret holding the broker url and credentials")
+	}
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: runner.Namespace, Name: runner.Spec.ControlPlaneSecret}
+	if err := e.client.Get(ctx, key, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, resolve.NotFound("control-plane secret %s not found", key.Name)
+		}
+		return nil, err
+	}
+	u, err := url.Parse(string(secret.Data["url"]))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, resolve.InvalidSpec("control-plane secret %s has no http(s) broker url", key.Name)
+	}
+	if instance == "" {
+		instance = string(runner.UID)
+	}
+	return &broker{
+		url:       u,
+		username:  string(secret.Data["username"]),
+		password:  string(secret.Data["password"]),
+		http:      e.http,
+		serviceID: spec.OSB.ServiceID,
+		planID:    spec.OSB.PlanID,
+		instance:  instance,
+		binding:   string(runner.UID),
+	}, nil
+}
+
+func (b *broker) instancePath() string {
+	return "/v2/service_instances/" + url.PathEscape(b.instance)
+}
+
+// bindingPath addresses the single binding of the runner, identified by its
+// UID.
+func (b *broker) bindingPath() string {
+	return b.instancePath() + "/service_bindings/" + url.PathEscape(b.binding)
+}
+
+// query returns the query parameters of a call; the catalog IDs are sent
+// along with every call, as some calls require them.
+func (b *broker) query(extra ...string) url.Values {
+	q := url.Values{"service_id": {b.serviceID}, "plan_id": {b.planID}}
+	for i := 0; i+1 < len(extra); i += 2 {
+		q.Set(extra[i], extra[i+1])
+	}
+	return q
+}
+
+func (b *broker) do(ctx context.Context, method, path string, query url.Values, body interface{}) (int, []byte, error) {
+	status, _, respBody, err := b.send(ctx, method, path, query, body)
+	return status, respBody, err
+}
+
+// send is do, also returning the headers of the answer.
+func (b *broker) send(ctx context.Context, method, path string, query url.Values, body interface{}) (int, http.Header, []byte, error) {
+	target := *b.url
+	target.Path = strings.TrimSuffix(b.url.Path, "/") + path
+	target.RawQuery = query.Encode()
+
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), reader)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	req.Header.Set("X-Broker-API-Version", APIVersion)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if b.username != "" {
+		req.SetBasicAuth(b.username, b.password)
+	}
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	return resp.StatusCode, resp.Header, respBody, err
+}
+
+// requestContext is the kubernetes platform profile of the OSB context.
+type requestContext struct {
+	Platform     string `json:"platform"`
+	Namespace    string `json:"namespace"`
+	InstanceName string `json:"instance_name"`
+}
+
+type instanceRequest struct {
+	ServiceID        string            `json:"service_id"`
+	PlanID           string            `json:"plan_id"`
+	OrganizationGUID string            `json:"organization_guid,omitempty"`
+	SpaceGUID        string            `json:"space_guid,omitempty"`
+	Context          requestContext    `json:"context"`
+	Parameters       map[string]string `json:"parameters,omitempty"`
+}
+
+type bindingRequest struct {
+	ServiceID string         `json:"service_id"`
+	PlanID    string         `json:"plan_id"`
+	Context   requestContext `json:"context"`
+}
+
+// asyncResponse is the body of a 202 answer.
+type asyncResponse struct {
+	Operation string `json:"operation,omitempty"`
+}
+
+// errorResponse is the body of an error answer.
+type errorResponse struct {
+	Error       string `json:"error,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type lastOperation struct {
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+}
+
+type bindingResponse struct {
+	Credentials map[string]interface{} `json:"credentials,omitempty"`
+}
+
+// run is what the status records of a launched operation, encoded as a query
+// string.
+type run struct {
+	op        string
+	id        string
+	instance  string
+	async     bool
+	operation string
+	failure   string
+}
+
+func (r run) String() string {
+	v := url.Values{"op": {r.op}, "id": {r.id}}
+	if r.instance != "" {
+		v.Set("instance", r.instance)
+	}
+	if r.async {
+		v.Set("async", "true")
+	}
+	if r.operation != "" {
+		v.Set("operation", r.operation)
+	}
+	if r.failure != "" {
+		v.Set("failure", r.failure)
+	}
+	return v.Encode()
+}
+
+func parseRun(ref string) (run, error) {
+	v, err := url.ParseQuery(ref)
+	if err != nil || v.Get("op") == "" {
+		return run{}, resolve.NotFound("unknown broker run %q", ref)
+	}
+	async, _ := strconv.ParseBool(v.Get("async"))
+	return run{
+		op:        v.Get("op"),
+		id:        v.Get("id"),
+		instance:  v.Get("instance"),
+		async:     async,
+		operation: v.Get("operation"),
+		failure:   v.Get("failure"),
+	}, nil
+}
+
+func describe(status int, body []byte) string {
+	var e errorResponse
+	if json.Unmarshal(body, &e) == nil && (e.Error != "" || e.Description != "") {
+		return strings.TrimSpace(fmt.Sprintf("%s %s", e.Error, e.Description))
+	}
+	return fmt.Sprintf("broker answered %d", status)
+}
+
+// result turns the answer to an operation call into the run to record: done,
+// asynchronous, or refused by the broker.
+func result(op resolve.Operation, status int, body []byte) (run, error) {
+	r := run{op: op.Name, id: op.ID, instance: op.ServiceID}
+	switch {
+	case status == http.StatusOK || status == http.StatusCreated:
+		return r, nil
+	case status == http.StatusGone && op.Name == resolve.OPERATION_DELETE:
+		return r, nil
+	case status == http.StatusAccepted:
+		var async asyncResponse
+		_ = json.Unmarshal(body, &async)
+		r.async = true
+		r.operation = async.Operation
+		return r, nil
+	case status >= 400 && status < 500:
+		r.failure = describe(status, body)
+		return r, nil
+	default:
+		return run{}, fmt.Errorf("broker call for %s failed: %s", op.ID, describe(status, body))
+	}
+}
+
+func (b *broker) context(runner *v1alpha1.ServiceRunner) requestContext {
+	return requestContext{Platform: "kubernetes", Namespace: runner.Namespace, InstanceName: runner.Name}
+}
+
+func (b *broker) bind(ctx context.Context, runner *v1alpha1.ServiceRunner) (int, []byte, error) {
+	return b.do(ctx, http.MethodPut, b.bindingPath(), b.query("accepts_incomplete", "true"),
+		bindingRequest{ServiceID: b.serviceID, PlanID: b.planID, Context: b.context(runner)})
+}
+
+// Launch calls the broker for op.  Calls are idempotent by the OSB API: a
+// provision or bind with identical content answers 200 rather than 201.
+func (e *Executor) Launch(ctx context.Context, runner *v1alpha1.ServiceRunner, op resolve.Operation) (string, error) {
+	b, err := e.broker(ctx, runner, op.ServiceID)
+	if err != nil {
+		return "", err
+	}
+	instance := instanceRequest{
+		ServiceID:  b.serviceID,
+		PlanID:     b.planID,
+		Context:    b.context(runner),
+		Parameters: op.Params,
+	}
+
+	var status int
+	var body []byte
+	switch op.Name {
+	case resolve.OPERATION_CREATE:
+		instance.OrganizationGUID = runner.Namespace
+		instance.SpaceGUID = runner.Namespace
+		status, body, err = b.do(ctx, http.MethodPut, b.instancePath(), b.query("accepts_incomplete", "true"), instance)
+	case resolve.OPERATION_UPDATE:
+		status, body, err = b.do(ctx, http.MethodPatch, b.instancePath(), b.query("accepts_incomplete", "true"), instance)
+	case resolve.OPERATION_READ:
+		status, body, err = b.bind(ctx, runner)
+	case resolve.OPERATION_DELETE:
+		// the binding goes first; while the broker unbinds asynchronously,
+		// the launch is retried until the binding is gone
+		status, body, err = b.do(ctx, http.MethodDelete, b.bindingPath(), b.query("accepts_incomplete", "true"), nil)
+		switch {
+		case err != nil:
+			return "", err
+		case status == http.StatusAccepted:
+			return "", fmt.Errorf("broker is unbinding %s, deprovisioning waits", b.instance)
+		case status != http.StatusOK && status != http.StatusGone:
+			r, err := result(op, status, body)
+			if err == nil {
+				r.failure = "unbind: " + r.failure
+			}
+			return r.String(), err
+		}
+		status, body, err = b.do(ctx, http.MethodDelete, b.instancePath(), b.query("accepts_incomplete", "true"), nil)
+	default:
+		return "", resolve.InvalidSpec("the osb executor has no %s operation", op.Name)
+	}
+	if err != nil {
+		return "", err
+	}
+	r, err := result(op, status, body)
+	if err != nil {
+		return "", err
+	}
+	return r.String(), nil
+}
+
+// Poll reports the state of the operation: synchronous ones are over
+// already, asynchronous ones are polled through last_operation, and say when
+// the broker wants to be polled again.
+func (e *Executor) Poll(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (resolve.RunStatus, error) {
+	r, err := parseRun(ref)
+	if err != nil {
+		return resolve.RunStatus{}, err
+	}
+	switch {
+	case r.failure != "":
+		return resolve.RunStatus{State: resolve.RunFailed, Message: fmt.Sprintf("broker refused %s: %s", r.id, r.failure)}, nil
+	case !r.async:
+		return resolve.RunStatus{State: resolve.RunSucceeded}, nil
+	}
+
+	b, err := e.broker(ctx, runner, r.instance)
+	if err != nil {
+		return resolve.RunStatus{}, err
+	}
+	path := b.instancePath()
+	if r.op == resolve.OPERATION_READ {
+		path = b.bindingPath()
+	}
+	query := b.query()
+	if r.operation != "" {
+		query.Set("operation", r.operation)
+	}
+	status, header, body, err := b.send(ctx, http.MethodGet, path+"/last_operation", query, nil)
+	if err != nil {
+		return resolve.RunStatus{}, err
+	}
+	retryAfter := resolve.ParseRetryAfter(header.Get("Retry-After"))
+	switch {
+	case status == http.StatusGone && r.op == resolve.OPERATION_DELETE:
+		return resolve.RunStatus{State: resolve.RunSucceeded}, nil
+	case status == http.StatusGone || status == http.StatusNotFound:
+		return resolve.RunStatus{}, resolve.NotFound("broker lost track of %s", r.id)
+	case status != http.StatusOK:
+		return resolve.RunStatus{}, resolve.Unavailable(retryAfter, "polling %s failed: %s", r.id, describe(status, body))
+	}
+	var last lastOperation
+	if err := json.Unmarshal(body, &last); err != nil {
+		return resolve.RunStatus{}, fmt.Errorf("polling %s: malformed last_operation: %v", r.id, err)
+	}
+	switch last.State {
+	case "succeeded":
+		return resolve.RunStatus{State: resolve.RunSucceeded}, nil
+	case "failed":
+		return resolve.RunStatus{State: resolve.RunFailed, Message: fmt.Sprintf("broker operation %s failed: %s", r.id, last.Description)}, nil
+	default:
+		return resolve.RunStatus{State: resolve.RunRunning, RetryAfter: retryAfter}, nil
+	}
+}
+
+// Outputs returns the credentials of the binding.  A binding created
+// asynchronously is fetched; one created synchronously is bound again, which
+// the broker answers with the same binding.
+func (e *Executor) Outputs(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (map[string]string, error) {
+	r, err := parseRun(ref)
+	if err != nil {
+		return nil, err
+	}
+	if r.op != resolve.OPERATION_READ {
+		return nil, resolve.JobFailed("broker run %s has no outputs", r.id)
+	}
+	b, err := e.broker(ctx, runner, r.instance)
+	if err != nil {
+		return nil, err
+	}
+	var status int
+	var body []byte
+	if r.async {
+		status, body, err = b.do(ctx, http.MethodGet, b.bindingPath(), b.query(), nil)
+	} else {
+		status, body, err = b.bind(ctx, runner)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		return nil, fmt.Errorf("fetching binding %s failed: %s", b.instance, describe(status, body))
+	}
+
+	var binding bindingResponse
+	if err := json.Unmarshal(body, &binding); err != nil {
+		return nil, resolve.JobFailed("broker binding %s: malformed response: %v", b.instance, err)
+	}
+	outputs := map[string]string{}
+	for key, value := range binding.Credentials {
+		if s, ok := value.(string); ok {
+			outputs[key] = s
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		outputs[key] = string(raw)
+	}
+	return outputs, nil
+}
+
+// Cancel has nothing to release: OSB operations can't be cancelled, and the
+// binding lives as long as the instance.
+func (e *Executor) Cancel(context.Context, *v1alpha1.ServiceRunner, string) error {
+	return nil
+}
@@ -0,0 +1,329 @@
+package osb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+// fakeBroker is an in-memory service broker.  With async set, it answers
+// provisions, updates, binds and deprovisions with 202 and completes them on
+// the next last_operation poll.
+type fakeBroker struct {
+	t     *testing.T
+	async bool
+
+	mu        sync.Mutex
+	instances map[string]map[string]string
+	bindings  map[string]bool
+	pending   map[string]string
+}
+
+func newFakeBroker(t *testing.T, async bool) *fakeBroker {
+	return &fakeBroker{
+		t:         t,
+		async:     async,
+		instances: map[string]map[string]string{},
+		bindings:  map[string]bool{},
+		pending:   map[string]string{},
+	}
+}
+
+func (b *fakeBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if user, password, ok := r.BasicAuth(); !ok || user != "broker" || password != "pw" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-Broker-API-Version") != APIVersion {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/broker/v2/service_instances/"), "/")
+	id := parts[0]
+	binding := len(parts) >= 3 && parts[1] == "service_bindings"
+	if parts[len(parts)-1] == "last_operation" {
+		b.lastOperation(w, id, r.URL.Query().Get("operation"))
+		return
+	}
+
+	switch {
+	case binding && r.Method == http.MethodPut:
+		if _, ok := b.instances[id]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"NoInstance","description":"instance does not exist"}`))
+			return
+		}
+		b.bindings[id] = true
+		if b.async {
+			b.accept(w, "bind")
+			return
+		}
+		b.writeBinding(w, id)
+	case binding && r.Method == http.MethodGet:
+		b.writeBinding(w, id)
+	case binding && r.Method == http.MethodDelete:
+		if !b.bindings[id] {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		delete(b.bindings, id)
+		_, _ = w.Write([]byte(`{}`))
+	case r.Method == http.MethodPut || r.Method == http.MethodPatch:
+		var body instanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ServiceID != "postgres" || body.PlanID != "small" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if body.Context.Platform != "kubernetes" || body.Context.Namespace != "apps" {
+			b.t.Errorf("context = %+v, want the kubernetes profile of the runner", body.Context)
+		}
+		b.instances[id] = body.Parameters
+		if b.async {
+			b.accept(w, strings.ToLower(r.Method))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{}`))
+	case r.Method == http.MethodDelete:
+		if _, ok := b.instances[id]; !ok {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if b.bindings[id] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if b.async {
+			b.accept(w, "deprovision")
+			return
+		}
+		delete(b.instances, id)
+		_, _ = w.Write([]byte(`{}`))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (b *fakeBroker) accept(w http.ResponseWriter, operation string) {
+	b.pending[operation] = "in progress"
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte(`{"operation":"` + operation + `"}`))
+}
+
+// lastOperation reports an operation in progress on its first poll, and
+// succeeded afterwards.
+func (b *fakeBroker) lastOperation(w http.ResponseWriter, id, operation string) {
+	state, ok := b.pending[operation]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if state == "in progress" {
+		b.pending[operation] = "succeeded"
+	} else if operation == "deprovision" {
+		delete(b.instances, id)
+		w.WriteHeader(http.StatusGone)
+		_, _ = w.Write([]byte(`{}`))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(lastOperation{State: state})
+}
+
+func (b *fakeBroker) writeBinding(w http.ResponseWriter, id string) {
+	if !b.bindings[id] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	credentials := map[string]interface{}{"host": "db.example.com", "port": 5432}
+	for k, v := range b.instances[id] {
+		credentials[k] = v
+	}
+	_ = json.NewEncoder(w).Encode(bindingResponse{Credentials: credentials})
+}
+
+func newTestRunner() *v1alpha1.ServiceRunner {
+	return &v1alpha1.ServiceRunner{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "apps", UID: "4a3c"},
+		Spec: v1alpha1.ServiceRunnerSpec{
+			ControlPlaneSecret: "broker",
+			Executor: &v1alpha1.ServiceRunnerExecutor{
+				Name: Name,
+				OSB:  &v1alpha1.OSBExecutorSpec{ServiceID: "postgres", PlanID: "small"},
+			},
+		},
+	}
+}
+
+func newTestExecutor(t *testing.T, url string) *Executor {
+	t.Helper()
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "broker", Namespace: "apps"},
+		Data: map[string][]byte{
+			"url":      []byte(url + "/broker"),
+			"username": []byte("broker"),
+			"password": []byte("pw"),
+		},
+	}).Build()
+	return New(c, nil)
+}
+
+// complete launches op and polls it until it is over.
+func complete(t *testing.T, e *Executor, runner *v1alpha1.ServiceRunner, op resolve.Operation) string {
+	t.Helper()
+	ctx := context.Background()
+	ref, err := e.Launch(ctx, runner, op)
+	if err != nil {
+		t.Fatalf("Launch(%s) error = %v", op.ID, err)
+	}
+	for i := 0; i < 3; i++ {
+		status, err := e.Poll(ctx, runner, ref)
+		if err != nil {
+			t.Fatalf("Poll(%s) error = %v", op.ID, err)
+		}
+		switch status.State {
+		case resolve.RunSucceeded:
+			return ref
+		case resolve.RunRunning:
+			continue
+		default:
+			t.Fatalf("Poll(%s) = %+v, want it to succeed", op.ID, status)
+		}
+	}
+	t.Fatalf("%s still running", op.ID)
+	return ""
+}
+
+func TestLifecycle(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		name := "synchronous"
+		if async {
+			name = "asynchronous"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			b := newFakeBroker(t, async)
+			server := httptest.NewServer(b)
+			defer server.Close()
+			runner := newTestRunner()
+			e := newTestExecutor(t, server.URL)
+
+			complete(t, e, runner, resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1", Params: map[string]string{"size": "10Gi"}})
+			ref := complete(t, e, runner, resolve.Operation{Name: resolve.OPERATION_READ, ID: "db-read-1"})
+			outputs, err := e.Outputs(ctx, runner, ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outputs["host"] != "db.example.com" || outputs["port"] != "5432" || outputs["size"] != "10Gi" {
+				t.Errorf("Outputs() = %v, want the binding credentials", outputs)
+			}
+
+			complete(t, e, runner, resolve.Operation{Name: resolve.OPERATION_UPDATE, ID: "db-update-2", Params: map[string]string{"size": "20Gi"}})
+			if got := b.instances["4a3c"]["size"]; got != "20Gi" {
+				t.Errorf("instance size = %q, want the updated parameter", got)
+			}
+
+			complete(t, e, runner, resolve.Operation{Name: resolve.OPERATION_DELETE, ID: "db-delete-2"})
+			if len(b.instances) != 0 || len(b.bindings) != 0 {
+				t.Errorf("broker holds %v and %v, want the instance unbound and deprovisioned", b.instances, b.bindings)
+			}
+			// a delete launched again after a lost status write finds the instance gone
+			complete(t, e, runner, resolve.Operation{Name: resolve.OPERATION_DELETE, ID: "db-delete-2"})
+		})
+	}
+}
+
+func TestImportedInstance(t *testing.T) {
+	ctx := context.Background()
+	b := newFakeBroker(t, true)
+	b.instances["pg-42"] = map[string]string{"size": "5Gi"}
+	server := httptest.NewServer(b)
+	defer server.Close()
+	runner := newTestRunner()
+	e := newTestExecutor(t, server.URL)
+
+	// the runner binds the instance it imported rather than one of its own
+	ref := complete(t, e, runner, resolve.Operation{Name: resolve.OPERATION_READ, ID: "db-import-1", ServiceID: "pg-42"})
+	outputs, err := e.Outputs(ctx, runner, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outputs["size"] != "5Gi" || !b.bindings["pg-42"] || len(b.instances) != 1 {
+		t.Errorf("Outputs() = %v, broker holds %v; want the imported instance bound", outputs, b.instances)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		launch     int
+		state      string
+		wantLaunch resolve.ErrorClass
+		wantState  resolve.RunState
+	}{
+		{name: "refused operation", launch: http.StatusBadRequest, wantState: resolve.RunFailed},
+		{name: "unavailable broker", launch: http.StatusServiceUnavailable, wantLaunch: resolve.ErrorTransient},
+		{name: "failed operation", launch: http.StatusAccepted, state: "failed", wantState: resolve.RunFailed},
+		{name: "running operation", launch: http.StatusAccepted, state: "in progress", wantState: resolve.RunRunning},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, "/last_operation") {
+					w.Header().Set("Retry-After", "7")
+					_ = json.NewEncoder(w).Encode(lastOperation{State: tt.state, Description: "quota exceeded"})
+					return
+				}
+				w.WriteHeader(tt.launch)
+				_, _ = w.Write([]byte(`{"description":"quota exceeded"}`))
+			}))
+			defer server.Close()
+			runner := newTestRunner()
+			e := newTestExecutor(t, server.URL)
+
+			ref, err := e.Launch(ctx, runner, resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1"})
+			if got := resolve.Classify(err); got != tt.wantLaunch {
+				t.Fatalf("Launch() error = %v (class %q), want class %q", err, got, tt.wantLaunch)
+			}
+			if err != nil {
+				return
+			}
+			status, err := e.Poll(ctx, runner, ref)
+			if err != nil || status.State != tt.wantState {
+				t.Fatalf("Poll() = %+v, %v; want %q", status, err, tt.wantState)
+			}
+			if tt.wantState == resolve.RunFailed && !strings.Contains(status.Message, "quota exceeded") {
+				t.Errorf("Poll() message = %q, want the broker description", status.Message)
+			}
+			if tt.wantState == resolve.RunRunning && status.RetryAfter != 7*time.Second {
+				t.Errorf("Poll() retry after %v, want the Retry-After of the broker", status.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestInvalidSpec(t *testing.T) {
+	runner := newTestRunner()
+	runner.Spec.Executor.OSB = nil
+	e := newTestExecutor(t, "http://broker.example.com")
+	_, err := e.Launch(context.Background(), runner, resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1"})
+	if resolve.Classify(err) != resolve.ErrorInvalidSpec {
+		t.Fatalf("Launch() error = %v, want an invalid spec", err)
+	}
+}
@@ -0,0 +1,204 @@
+// Package tekton runs the operations of a runner as Tekton PipelineRuns of
+// the Pipelines named in spec.executor.tekton.
+//
+// PipelineRuns are handled as unstructured objects, so that the operator
+// doesn't depend on Tekton: on a cluster which doesn't serve them, runners
+// selecting the executor are reported as invalid.
+//
+// Service parameters are passed as string params of the pipeline; the
+// pipeline results of a read are the binding data, results which aren't
+// strings being JSON-encoded.
+package tekton
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+// Name is the name the executor is registered under.
+const Name = "tekton"
+
+// PipelineRunKind is the kind of the runs.
+var PipelineRunKind = schema.GroupVersionKind{Group: "tekton.dev", Version: "v1beta1", Kind: "PipelineRun"}
+
+// Executor creates PipelineRuns through client.
+type Executor struct {
+	client client.Client
+}
+
+var _ resolve.Executor = &Executor{}
+var _ resolve.Watcher = &Executor{}
+
+// New returns an executor creating PipelineRuns through client.
+func New(client client.Client) *Executor {
+	return &Executor{client: client}
+}
+
+// NewPipelineRun returns an empty PipelineRun.
+func NewPipelineRun() *unstructured.Unstructured {
+	run := &unstructured.Unstructured{}
+	run.SetGroupVersionKind(PipelineRunKind)
+	return run
+}
+
+// Watches returns the kind of the runs.
+func (e *Executor) Watches() []client.Object {
+	return []client.Object{NewPipelineRun()}
+}
+
+func pipeline(runner *v1alpha1.ServiceRunner, operation string) (string, error) {
+	spec := runner.Spec.Executor
+	if spec == nil || spec.Tekton == nil {
+		return "", resolve.InvalidSpec("spec.executor.tekton must be set")
+	}
+	name := spec.Tekton.Pipelines[operation]
+	if name == "" {
+		return "", resolve.InvalidSpec("spec.executor.tekton.pipelines has no pipeline for %s", operation)
+	}
+	return name, nil
+}
+
+func notServed(err error) error {
+	return resolve.InvalidSpec("the cluster doesn't serve %s, is Tekton installed? %v", PipelineRunKind.Kind, err)
+}
+
+// PipelineRunTemplate builds the PipelineRun running op for runner.
+func PipelineRunTemplate(runner *v1alpha1.ServiceRunner, op resolve.Operation, pipeline string) *unstructured.Unstructured {
+	run := NewPipelineRun()
+	run.SetName(op.ID)
+	run.SetNamespace(runner.Namespace)
+	run.SetLabels(map[string]string{resolve.JobLabel: runner.Name})
+	run.SetOwnerReferences([]metav1.OwnerReference{resolve.RunnerOwner(runner)})
+
+	var keys []string
+	for key := range op.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := []interface{}{}
+	for _, key := range keys {
+		params = append(params, map[string]interface{}{"name": key, "value": op.Params[key]})
+	}
+	spec := map[string]interface{}{
+		"pipelineRef": map[string]interface{}{"name": pipeline},
+		"params":      params,
+	}
+	if sa := runner.Spec.Executor.Tekton.ServiceAccountName; sa != "" {
+		spec["serviceAccountName"] = sa
+	}
+	run.Object["spec"] = spec
+	return run
+}
+
+// Launch creates the PipelineRun running op.  Runs are named after op.ID, so
+// launching one which already exists adopts it.
+func (e *Executor) Launch(ctx context.Context, runner *v1alpha1.ServiceRunner, op resolve.Operation) (string, error) {
+	name, err := pipeline(runner, op.Name)
+	if err != nil {
+		return "", err
+	}
+	run := PipelineRunTemplate(runner, op, name)
+	err = e.client.Create(ctx, run)
+	switch {
+	case meta.IsNoMatchError(err):
+		return "", notServed(err)
+	case err != nil && !apierrors.IsAlreadyExists(err):
+		return "", err
+	}
+	return run.GetName(), nil
+}
+
+func (e *Executor) pipelineRun(ctx context.Context, runner *v1alpha1.ServiceRunner, name string) (*unstructured.Unstructured, error) {
+	run := NewPipelineRun()
+	err := e.client.Get(ctx, client.ObjectKey{Namespace: runner.Namespace, Name: name}, run)
+	switch {
+	case apierrors.IsNotFound(err):
+		return nil, resolve.NotFound("pipelinerun %s not found", name)
+	case meta.IsNoMatchError(err):
+		return nil, notServed(err)
+	case err != nil:
+		return nil, err
+	}
+	return run, nil
+}
+
+// Poll reports the state of the PipelineRun from its Succeeded condition.
+func (e *Executor) Poll(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (resolve.RunStatus, error) {
+	run, err := e.pipelineRun(ctx, runner, ref)
+	if err != nil {
+		return resolve.RunStatus{}, err
+	}
+	conditions, _, _ := unstructured.NestedSlice(run.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if !ok || cond["type"] != "Succeeded" {
+			continue
+		}
+		message, _ := cond["message"].(string)
+		switch cond["status"] {
+		case "True":
+			return resolve.RunStatus{State: resolve.RunSucceeded}, nil
+		case "False":
+			status := resolve.RunStatus{State: resolve.RunFailed, Message: fmt.Sprintf("pipelinerun %s failed: %s", ref, message)}
+			if cond["reason"] == "PipelineRunTimeout" {
+				status.State = resolve.RunTimedOut
+			}
+			return status, nil
+		}
+	}
+	return resolve.RunStatus{State: resolve.RunRunning}, nil
+}
+
+// Outputs returns the pipeline results of the PipelineRun.
+func (e *Executor) Outputs(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (map[string]string, error) {
+	run, err := e.pipelineRun(ctx, runner, ref)
+	if err != nil {
+		return nil, err
+	}
+	results, _, err := unstructured.NestedSlice(run.Object, "status", "pipelineResults")
+	if err != nil {
+		return nil, resolve.JobFailed("pipelinerun %s: malformed results: %v", ref, err)
+	}
+	outputs := map[string]string{}
+	for _, r := range results {
+		result, ok := r.(map[string]interface{})
+		name, _ := result["name"].(string)
+		if !ok || name == "" {
+			return nil, resolve.JobFailed("pipelinerun %s: malformed result %v", ref, r)
+		}
+		if value, ok := result["value"].(string); ok {
+			outputs[name] = value
+			continue
+		}
+		raw, err := json.Marshal(result["value"])
+		if err != nil {
+			return nil, resolve.JobFailed("pipelinerun %s: result %s: %v", ref, name, err)
+		}
+		outputs[name] = string(raw)
+	}
+	return outputs, nil
+}
+
+// Cancel deletes the PipelineRun along with its TaskRuns.
+func (e *Executor) Cancel(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) error {
+	run := NewPipelineRun()
+	run.SetNamespace(runner.Namespace)
+	run.SetName(ref)
+	err := e.client.Delete(ctx, run, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	if meta.IsNoMatchError(err) {
+		return nil
+	}
+	return client.IgnoreNotFound(err)
+}
@@ -0,0 +1,190 @@
+package tekton
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+func newTestRunner() *v1alpha1.ServiceRunner {
+	return &v1alpha1.ServiceRunner{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "apps", UID: "4a3c"},
+		Spec: v1alpha1.ServiceRunnerSpec{
+			Executor: &v1alpha1.ServiceRunnerExecutor{
+				Name: Name,
+				Tekton: &v1alpha1.TektonExecutorSpec{
+					Pipelines: map[string]string{
+						resolve.OPERATION_CREATE: "provision-db",
+						resolve.OPERATION_READ:   "describe-db",
+					},
+					ServiceAccountName: "provisioner",
+				},
+			},
+		},
+	}
+}
+
+// finish sets the Succeeded condition of a PipelineRun, with results.
+func finish(t *testing.T, c client.Client, name, status, reason string, results ...interface{}) {
+	t.Helper()
+	run := NewPipelineRun()
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "apps", Name: name}, run); err != nil {
+		t.Fatal(err)
+	}
+	condition := map[string]interface{}{"type": "Succeeded", "status": status, "reason": reason, "message": "step provision exited 1"}
+	run.Object["status"] = map[string]interface{}{
+		"conditions":      []interface{}{condition},
+		"pipelineResults": results,
+	}
+	if err := c.Update(context.Background(), run); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLaunch(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	e := New(c)
+	runner := newTestRunner()
+	op := resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1", Params: map[string]string{"size": "small", "region": "eu"}}
+
+	ref, err := e.Launch(ctx, runner, op)
+	if err != nil || ref != "db-create-1" {
+		t.Fatalf("Launch() = %q, %v; want the run named after the operation", ref, err)
+	}
+	// launched again after a lost status write, the run is adopted
+	if ref, err = e.Launch(ctx, runner, op); err != nil || ref != "db-create-1" {
+		t.Fatalf("Launch() again = %q, %v; want the run adopted", ref, err)
+	}
+
+	run := NewPipelineRun()
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: ref}, run); err != nil {
+		t.Fatal(err)
+	}
+	if pipeline, _, _ := unstructured.NestedString(run.Object, "spec", "pipelineRef", "name"); pipeline != "provision-db" {
+		t.Errorf("pipelineRef = %q, want the create pipeline", pipeline)
+	}
+	if sa, _, _ := unstructured.NestedString(run.Object, "spec", "serviceAccountName"); sa != "provisioner" {
+		t.Errorf("serviceAccountName = %q, want the one of the spec", sa)
+	}
+	params, _, _ := unstructured.NestedSlice(run.Object, "spec", "params")
+	if len(params) != 2 || params[0].(map[string]interface{})["name"] != "region" || params[1].(map[string]interface{})["value"] != "small" {
+		t.Errorf("params = %v, want the service parameters in order", params)
+	}
+	if run.GetLabels()[resolve.JobLabel] != "db" || len(run.GetOwnerReferences()) != 1 || run.GetOwnerReferences()[0].UID != "4a3c" {
+		t.Errorf("run labels %v, owners %v; want it labelled and owned by the runner", run.GetLabels(), run.GetOwnerReferences())
+	}
+}
+
+func TestPoll(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		reason string
+		want   resolve.RunState
+	}{
+		{name: "running", status: "Unknown", reason: "Running", want: resolve.RunRunning},
+		{name: "succeeded", status: "True", reason: "Succeeded", want: resolve.RunSucceeded},
+		{name: "failed", status: "False", reason: "Failed", want: resolve.RunFailed},
+		{name: "timed out", status: "False", reason: "PipelineRunTimeout", want: resolve.RunTimedOut},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+			e := New(c)
+			runner := newTestRunner()
+			ref, err := e.Launch(ctx, runner, resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status, err := e.Poll(ctx, runner, ref); err != nil || status.State != resolve.RunRunning {
+				t.Fatalf("Poll() of a new run = %+v, %v; want running", status, err)
+			}
+			finish(t, c, ref, tt.status, tt.reason)
+			status, err := e.Poll(ctx, runner, ref)
+			if err != nil || status.State != tt.want {
+				t.Fatalf("Poll() = %+v, %v; want %q", status, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	e := New(c)
+	runner := newTestRunner()
+	ref, err := e.Launch(ctx, runner, resolve.Operation{Name: resolve.OPERATION_READ, ID: "db-read-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	finish(t, c, ref, "True", "Succeeded",
+		map[string]interface{}{"name": "host", "value": "db.example.com"},
+		map[string]interface{}{"name": "ports", "value": []interface{}{"5432", "5433"}},
+	)
+	outputs, err := e.Outputs(ctx, runner, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outputs["host"] != "db.example.com" || outputs["ports"] != `["5432","5433"]` {
+		t.Errorf("Outputs() = %v, want the pipeline results", outputs)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	e := New(c)
+	runner := newTestRunner()
+	ref, err := e.Launch(ctx, runner, resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Cancel(ctx, runner, ref); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Poll(ctx, runner, ref); resolve.Classify(err) != resolve.ErrorNotFound {
+		t.Fatalf("Poll() error = %v, want the run gone", err)
+	}
+	if err := e.Cancel(ctx, runner, ref); err != nil {
+		t.Fatalf("Cancel() of a gone run = %v, want no error", err)
+	}
+}
+
+// withoutTekton answers like a cluster which doesn't serve PipelineRuns.
+type withoutTekton struct {
+	client.Client
+}
+
+func (c withoutTekton) Create(context.Context, client.Object, ...client.CreateOption) error {
+	return &meta.NoKindMatchError{GroupKind: PipelineRunKind.GroupKind(), SearchedVersions: []string{PipelineRunKind.Version}}
+}
+
+func TestInvalidSpec(t *testing.T) {
+	tests := []struct {
+		name   string
+		client client.Client
+		op     string
+	}{
+		{name: "operation without pipeline", client: fake.NewClientBuilder().Build(), op: resolve.OPERATION_DELETE},
+		{name: "tekton not installed", client: withoutTekton{fake.NewClientBuilder().Build()}, op: resolve.OPERATION_CREATE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.client).Launch(context.Background(), newTestRunner(), resolve.Operation{Name: tt.op, ID: "db-" + tt.op + "-1"})
+			if resolve.Classify(err) != resolve.ErrorInvalidSpec {
+				t.Fatalf("Launch() error = %v, want an invalid spec", err)
+			}
+		})
+	}
+}
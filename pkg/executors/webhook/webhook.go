@@ -0,0 +1,295 @@
+// Package webhook runs the operations of a runner as calls to an HTTP
+// endpoint, for control planes which already expose a REST API.
+//
+// Each operation is a POST to <url>/<operation> (see
+// v1alpha1.WebhookExecutorSpec) with a JSON body
+//
+//	{"id": "db-read-1", "operation": "read", "serviceId": "db-42", "params": {"size": "small"}}
+//
+// and an Idempotency-Key header set to the id.  The serviceId identifies the
+// service once known, e.g. an imported one; it is left out until then.  The endpoint answers:
+//
+//   - 200, 201 or 204 once the operation is done; the body of a read is the
+//     binding data, a JSON object of strings, as jobs output it;
+//   - 202 with a Location header for an operation which goes on
+//     asynchronously.  The location is polled with GET: 202 while the
+//     operation runs, 200 with the same body as above once it is done.
+//     The location is polled again after the Retry-After of a 202, or
+//     resolve.PollInterval without one;
+//   - 4xx when the operation failed; the body explains why.
+//
+// Any other answer, including 408 and 429, is considered transient and
+// retried, after its Retry-After if it has one.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+// Name is the name the executor is registered under.
+const Name = "webhook"
+
+// Timeout bounds every call to an endpoint.
+const Timeout = 30 * time.Second
+
+// maxBody bounds how much of a response is read.
+const maxBody = 1 << 20
+
+// HeaderPrefix marks the control-plane Secret keys sent as headers.
+const HeaderPrefix = "header-"
+
+// Run references recorded in the runner status:
+//
+//	poll:<url>          an asynchronous operation, polled at url
+//	done:<id>           an operation which completed synchronously
+//	failed:<id>:<code>  an operation which was refused with a 4xx status
+const (
+	refPoll   = "poll:"
+	refDone   = "done:"
+	refFailed = "failed:"
+)
+
+// Executor sends operations to the endpoint declared by the runner.
+type Executor struct {
+	client client.Client
+	http   *http.Client
+}
+
+var _ resolve.Executor = &Executor{}
+
+// New returns an executor reading credentials through client; a nil
+// httpClient defaults to one bounded by Timeout.
+func New(client client.Client, httpClient *http.Client) *Executor {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: Timeout}
+	}
+	return &Executor{client: client, http: httpClient}
+}
+
+// request is the body of an operation call.
+type request struct {
+	ID        string            `json:"id"`
+	Operation string            `json:"operation"`
+	ServiceID string            `json:"serviceId,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+}
+
+func endpoint(runner *v1alpha1.ServiceRunner) (*url.URL, error) {
+	if runner.Spec.Executor == nil || runner.Spec.Executor.Webhook == nil || runner.Spec.Executor.Webhook.URL == "" {
+		return nil, resolve.InvalidSpec("spec.executor.webhook.url must be set")
+	}
+	u, err := url.Parse(runner.Spec.Executor.Webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, resolve.InvalidSpec("spec.executor.webhook.url %q is not an http(s) URL", runner.Spec.Executor.Webhook.URL)
+	}
+	return u, nil
+}
+
+// authenticate adds the credentials of the control-plane Secret to req.
+// They are only ever sent to the host of the declared endpoint.
+func (e *Executor) authenticate(ctx context.Context, runner *v1alpha1.ServiceRunner, base *url.URL, req *http.Request) error {
+	if runner.Spec.ControlPlaneSecret == "" || req.URL.Host != base.Host {
+		return nil
+	}
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: runner.Namespace, Name: runner.Spec.ControlPlaneSecret}
+	if err := e.client.Get(ctx, key, secret); err != nil {
+		return err
+	}
+	for k, v := range secret.Data {
+		if strings.HasPrefix(k, HeaderPrefix) {
+			req.Header.Set(strings.TrimPrefix(k, HeaderPrefix), string(v))
+		}
+	}
+	if token, ok := secret.Data["token"]; ok {
+		req.Header.Set("Authorization", "Bearer "+string(token))
+	} else if user, ok := secret.Data["username"]; ok {
+		credentials := string(user) + ":" + string(secret.Data["password"])
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	return nil
+}
+
+// do sends req and returns the status and body of the response.
+func (e *Executor) do(ctx context.Context, runner *v1alpha1.ServiceRunner, base *url.URL, req *http.Request) (*http.Response, []byte, error) {
+	if err := e.authenticate(ctx, runner, base, req); err != nil {
+		return nil, nil, err
+	}
+	resp, err := e.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+// call sends op to the endpoint.
+func (e *Executor) call(ctx context.Context, runner *v1alpha1.ServiceRunner, op resolve.Operation) (*url.URL, *http.Response, []byte, error) {
+	base, err := endpoint(runner)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	body, err := json.Marshal(request{ID: op.ID, Operation: op.Name, ServiceID: op.ServiceID, Params: op.Params})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	target := *base
+	target.Path = strings.TrimSuffix(base.Path, "/") + "/" + op.Name
+	req, err := http.NewRequest(http.MethodPost, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", op.ID)
+	resp, respBody, err := e.do(ctx, runner, base, req)
+	return &target, resp, respBody, err
+}
+
+// failed tells whether resp reports a failed operation, rather than an
+// endpoint which timed out or is throttling calls.
+func failed(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return resp.StatusCode >= 400 && resp.StatusCode < 500
+}
+
+func unexpected(resp *http.Response, body []byte) error {
+	return resolve.Unavailable(resolve.ParseRetryAfter(resp.Header.Get("Retry-After")),
+		"webhook answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// Launch posts op.  Calls carry op.ID as idempotency key, so that the
+// endpoint can recognize an operation launched again after a lost status
+// write.
+func (e *Executor) Launch(ctx context.Context, runner *v1alpha1.ServiceRunner, op resolve.Operation) (string, error) {
+	target, resp, body, err := e.call(ctx, runner, op)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		location, err := resp.Location()
+		if err != nil {
+			return "", fmt.Errorf("webhook accepted operation %s without a Location to poll: %v", op.ID, err)
+		}
+		return refPoll + target.ResolveReference(location).String(), nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return refDone + op.ID, nil
+	case failed(resp):
+		return fmt.Sprintf("%s%s:%d", refFailed, op.ID, resp.StatusCode), nil
+	default:
+		return "", unexpected(resp, body)
+	}
+}
+
+// poll fetches the state of an asynchronous operation.
+func (e *Executor) poll(ctx context.Context, runner *v1alpha1.ServiceRunner, location string) (*http.Response, []byte, error) {
+	base, err := endpoint(runner)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.do(ctx, runner, base, req)
+}
+
+// Poll reports the state of the operation: operations which answered
+// synchronously are over already, asynchronous ones are polled.
+func (e *Executor) Poll(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (resolve.RunStatus, error) {
+	switch {
+	case strings.HasPrefix(ref, refDone):
+		return resolve.RunStatus{State: resolve.RunSucceeded}, nil
+	case strings.HasPrefix(ref, refFailed):
+		return resolve.RunStatus{
+			State:   resolve.RunFailed,
+			Message: fmt.Sprintf("webhook refused operation %s", strings.TrimPrefix(ref, refFailed)),
+		}, nil
+	case !strings.HasPrefix(ref, refPoll):
+		return resolve.RunStatus{}, resolve.NotFound("unknown webhook run %q", ref)
+	}
+
+	resp, body, err := e.poll(ctx, runner, strings.TrimPrefix(ref, refPoll))
+	if err != nil {
+		return resolve.RunStatus{}, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		return resolve.RunStatus{
+			State:      resolve.RunRunning,
+			RetryAfter: resolve.ParseRetryAfter(resp.Header.Get("Retry-After")),
+		}, nil
+	case resp.StatusCode == http.StatusOK:
+		return resolve.RunStatus{State: resolve.RunSucceeded}, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return resolve.RunStatus{}, resolve.NotFound("webhook lost track of operation at %s", strings.TrimPrefix(ref, refPoll))
+	case failed(resp):
+		return resolve.RunStatus{
+			State:   resolve.RunFailed,
+			Message: fmt.Sprintf("webhook operation failed (%s): %s", resp.Status, strings.TrimSpace(string(body))),
+		}, nil
+	default:
+		return resolve.RunStatus{}, unexpected(resp, body)
+	}
+}
+
+// Outputs decodes the binding data of a succeeded read.  An asynchronous
+// read is fetched from its polling location; a read which answered
+// synchronously is posted again, reads being free of side effects.
+func (e *Executor) Outputs(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (map[string]string, error) {
+	var resp *http.Response
+	var body []byte
+	var err error
+	switch {
+	case strings.HasPrefix(ref, refPoll):
+		resp, body, err = e.poll(ctx, runner, strings.TrimPrefix(ref, refPoll))
+	case strings.HasPrefix(ref, refDone):
+		op := resolve.Operation{
+			Name:      resolve.OPERATION_READ,
+			ID:        strings.TrimPrefix(ref, refDone),
+			Params:    runner.Status.AppliedParams,
+			ServiceID: runner.Status.ServiceId,
+		}
+		_, resp, body, err = e.call(ctx, runner, op)
+	default:
+		return nil, resolve.JobFailed("webhook run %q has no outputs", ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, unexpected(resp, body)
+	}
+	outputs, err := resolve.DecodeOutputs(body)
+	if err != nil {
+		return nil, resolve.JobFailed("webhook read: %v", err)
+	}
+	return outputs, nil
+}
+
+// Cancel has nothing to release: the endpoint owns its operations.
+func (e *Executor) Cancel(context.Context, *v1alpha1.ServiceRunner, string) error {
+	return nil
+}
@@ -0,0 +1,285 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+// stub is a control plane answering operations as scripted.
+type stub struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []request
+
+	// answer writes the response to an operation call or a poll
+	answer func(w http.ResponseWriter, r *http.Request)
+}
+
+func (s *stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	if r.Method == http.MethodPost {
+		var body request
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		s.bodies = append(s.bodies, body)
+	}
+	s.mu.Unlock()
+	s.answer(w, r)
+}
+
+func newTestRunner(url string) *v1alpha1.ServiceRunner {
+	return &v1alpha1.ServiceRunner{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "apps"},
+		Spec: v1alpha1.ServiceRunnerSpec{
+			ControlPlaneSecret: "control-plane",
+			Executor: &v1alpha1.ServiceRunnerExecutor{
+				Name:    Name,
+				Webhook: &v1alpha1.WebhookExecutorSpec{URL: url + "/api/services"},
+			},
+		},
+	}
+}
+
+func newTestExecutor(t *testing.T, secret map[string]string) *Executor {
+	t.Helper()
+	data := map[string][]byte{}
+	for k, v := range secret {
+		data[k] = []byte(v)
+	}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "control-plane", Namespace: "apps"},
+		Data:       data,
+	}).Build()
+	return New(c, nil)
+}
+
+func TestSynchronousOperations(t *testing.T) {
+	ctx := context.Background()
+	s := &stub{answer: func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/services/read" {
+			_, _ = w.Write([]byte(`{"host":"db.example.com"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	runner := newTestRunner(server.URL)
+	runner.Status.AppliedParams = map[string]string{"size": "small"}
+	e := newTestExecutor(t, map[string]string{"token": "s3cr3t"})
+
+	op := resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1", Params: map[string]string{"size": "small"}}
+	ref, err := e.Launch(ctx, runner, op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := e.Poll(ctx, runner, ref); err != nil || status.State != resolve.RunSucceeded {
+		t.Fatalf("Poll() = %+v, %v; want succeeded", status, err)
+	}
+	req, body := s.requests[0], s.bodies[0]
+	if req.URL.Path != "/api/services/create" || req.Header.Get("Idempotency-Key") != "db-create-1" {
+		t.Errorf("request = %s %s (key %q), want a create keyed by its id", req.Method, req.URL.Path, req.Header.Get("Idempotency-Key"))
+	}
+	if req.Header.Get("Authorization") != "Bearer s3cr3t" {
+		t.Errorf("Authorization = %q, want the token of the control-plane secret", req.Header.Get("Authorization"))
+	}
+	if body.ID != "db-create-1" || body.Operation != "create" || body.Params["size"] != "small" {
+		t.Errorf("body = %+v, want the operation", body)
+	}
+
+	ref, err = e.Launch(ctx, runner, resolve.Operation{Name: resolve.OPERATION_READ, ID: "db-read-1", Params: runner.Status.AppliedParams})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs, err := e.Outputs(ctx, runner, ref)
+	if err != nil || outputs["host"] != "db.example.com" {
+		t.Fatalf("Outputs() = %v, %v; want the read answer", outputs, err)
+	}
+}
+
+func TestImportedService(t *testing.T) {
+	s := &stub{answer: func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"host":"db.example.com"}`))
+	}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	runner := newTestRunner(server.URL)
+	e := newTestExecutor(t, nil)
+
+	op := resolve.Operation{Name: resolve.OPERATION_IMPORT, ID: "db-import-1", ServiceID: "db-42"}
+	if _, err := e.Launch(context.Background(), runner, op); err != nil {
+		t.Fatal(err)
+	}
+	if req, body := s.requests[0], s.bodies[0]; req.URL.Path != "/api/services/import" || body.ServiceID != "db-42" {
+		t.Errorf("request = %s with %+v, want the import of db-42", req.URL.Path, body)
+	}
+}
+
+func TestAsynchronousOperation(t *testing.T) {
+	ctx := context.Background()
+	var done int32
+	s := &stub{answer: func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost:
+			w.Header().Set("Location", "../operations/42")
+			w.WriteHeader(http.StatusAccepted)
+		case atomic.LoadInt32(&done) == 0:
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			_, _ = w.Write([]byte(`{"host":"db.example.com"}`))
+		}
+	}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	runner := newTestRunner(server.URL)
+	e := newTestExecutor(t, map[string]string{"username": "admin", "password": "pw", "header-X-Tenant": "apps"})
+
+	ref, err := e.Launch(ctx, runner, resolve.Operation{Name: resolve.OPERATION_READ, ID: "db-read-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := e.Poll(ctx, runner, ref); err != nil || status.State != resolve.RunRunning || status.RetryAfter != 5*time.Second {
+		t.Fatalf("Poll() = %+v, %v; want running, polled again after 5s", status, err)
+	}
+	atomic.StoreInt32(&done, 1)
+	if status, err := e.Poll(ctx, runner, ref); err != nil || status.State != resolve.RunSucceeded {
+		t.Fatalf("Poll() = %+v, %v; want succeeded", status, err)
+	}
+	outputs, err := e.Outputs(ctx, runner, ref)
+	if err != nil || outputs["host"] != "db.example.com" {
+		t.Fatalf("Outputs() = %v, %v; want the polled answer", outputs, err)
+	}
+
+	poll := s.requests[1]
+	if poll.Method != http.MethodGet || poll.URL.Path != "/api/operations/42" {
+		t.Errorf("poll = %s %s, want GET /api/operations/42", poll.Method, poll.URL.Path)
+	}
+	if user, password, ok := poll.BasicAuth(); !ok || user != "admin" || password != "pw" {
+		t.Errorf("poll credentials = %q, %q; want basic auth from the control-plane secret", user, password)
+	}
+	if poll.Header.Get("X-Tenant") != "apps" {
+		t.Errorf("X-Tenant = %q, want the header of the control-plane secret", poll.Header.Get("X-Tenant"))
+	}
+}
+
+func TestCredentialsStayWithTheEndpoint(t *testing.T) {
+	ctx := context.Background()
+	elsewhere := &stub{answer: func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}}
+	other := httptest.NewServer(elsewhere)
+	defer other.Close()
+	s := &stub{answer: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", other.URL+"/operations/42")
+		w.WriteHeader(http.StatusAccepted)
+	}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	runner := newTestRunner(server.URL)
+	e := newTestExecutor(t, map[string]string{"token": "s3cr3t"})
+
+	ref, err := e.Launch(ctx, runner, resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Poll(ctx, runner, ref); err != nil {
+		t.Fatal(err)
+	}
+	if auth := elsewhere.requests[0].Header.Get("Authorization"); auth != "" {
+		t.Errorf("Authorization sent to another host = %q, want none", auth)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		launch     int
+		poll       int
+		wantLaunch resolve.ErrorClass
+		wantState  resolve.RunState
+		wantPoll   resolve.ErrorClass
+	}{
+		{name: "refused operation", launch: http.StatusBadRequest, wantState: resolve.RunFailed},
+		{name: "unavailable endpoint", launch: http.StatusServiceUnavailable, wantLaunch: resolve.ErrorTransient},
+		{name: "failed operation", launch: http.StatusAccepted, poll: http.StatusConflict, wantState: resolve.RunFailed},
+		{name: "lost operation", launch: http.StatusAccepted, poll: http.StatusNotFound, wantPoll: resolve.ErrorNotFound},
+		{name: "unavailable poll", launch: http.StatusAccepted, poll: http.StatusBadGateway, wantPoll: resolve.ErrorTransient},
+		{name: "throttled launch", launch: http.StatusTooManyRequests, wantLaunch: resolve.ErrorTransient},
+		{name: "timed out poll", launch: http.StatusAccepted, poll: http.StatusRequestTimeout, wantPoll: resolve.ErrorTransient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := &stub{answer: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPost {
+					w.Header().Set("Location", "/operations/42")
+					w.WriteHeader(tt.launch)
+					return
+				}
+				w.WriteHeader(tt.poll)
+				_, _ = w.Write([]byte("quota exceeded"))
+			}}
+			server := httptest.NewServer(s)
+			defer server.Close()
+			runner := newTestRunner(server.URL)
+			e := newTestExecutor(t, nil)
+
+			ref, err := e.Launch(ctx, runner, resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1"})
+			if got := resolve.Classify(err); got != tt.wantLaunch {
+				t.Fatalf("Launch() error = %v (class %q), want class %q", err, got, tt.wantLaunch)
+			}
+			if err != nil {
+				return
+			}
+			status, err := e.Poll(ctx, runner, ref)
+			if got := resolve.Classify(err); got != tt.wantPoll {
+				t.Fatalf("Poll() error = %v (class %q), want class %q", err, got, tt.wantPoll)
+			}
+			if status.State != tt.wantState {
+				t.Fatalf("Poll() = %+v, want %q", status, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestThrottled(t *testing.T) {
+	s := &stub{answer: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "20")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	runner := newTestRunner(server.URL)
+	e := newTestExecutor(t, nil)
+
+	_, err := e.Launch(context.Background(), runner, resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1"})
+	if res, err := resolve.Requeue(ctrl.Result{}, err); err != nil || res.RequeueAfter != 20*time.Second {
+		t.Fatalf("Requeue() = %+v, %v; want a retry after the Retry-After of the endpoint", res, err)
+	}
+}
+
+func TestInvalidEndpoint(t *testing.T) {
+	runner := newTestRunner("")
+	runner.Spec.Executor.Webhook.URL = "ftp://example.com"
+	e := newTestExecutor(t, nil)
+	_, err := e.Launch(context.Background(), runner, resolve.Operation{Name: resolve.OPERATION_CREATE, ID: "db-create-1"})
+	if resolve.Classify(err) != resolve.ErrorInvalidSpec {
+		t.Fatalf("Launch() error = %v, want an invalid spec", err)
+	}
+}
@@ -0,0 +1,307 @@
+package resolve
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// OPERATION_CAPABILITIES asks an image what it supports.  It outputs, as the
+// last line of its log like a read:
+//
+//	{"operations": "create,read,delete", "protocolVersion": "1", "parameters": "SIZE,REGION"}
+//
+// Keys left out don't restrict anything.
+const OPERATION_CAPABILITIES = "capabilities"
+
+// OutputProtocolVersion is the version of the output protocol jobs are read
+// with: a JSON object of strings as the last line of the log.
+const OutputProtocolVersion = "1"
+
+// CapabilitiesConfigMap caches, in each namespace, the capabilities of the
+// images the runners of the namespace probed, keyed by image digest, along
+// with the digests the tags of the images were resolved to.
+const CapabilitiesConfigMap = "service-runner-capabilities"
+
+// CapabilitiesTagTTL is how long the digest an image tag was resolved to is
+// trusted; the tag is probed again afterwards, in case it was moved.
+const CapabilitiesTagTTL = time.Hour
+
+// CapabilitiesFailureTTL is how long a failed probe is trusted: an image
+// which doesn't implement the capabilities operation fails it, but so does
+// one whose probe couldn't run, e.g. as its registry was unavailable.
+const CapabilitiesFailureTTL = time.Hour
+
+// CapabilitiesLabel marks the capabilities caches.
+const CapabilitiesLabel = "servicerunner.io/capabilities"
+
+// probeDeadline bounds how long an image may take to answer; an image which
+// doesn't implement the operation usually fails right away.
+const probeDeadline = 300
+
+// Capabilities are what an image supports; nil slices don't restrict
+// anything.
+type Capabilities struct {
+	// Handshake is false for images which don't implement the operation.
+	Handshake bool `json:"handshake"`
+
+	// Expires is when a failed probe is to be run again.
+	Expires *metav1.Time `json:"expires,omitempty"`
+
+	Operations      []string `json:"operations,omitempty"`
+	ProtocolVersion string   `json:"protocolVersion,omitempty"`
+	Parameters      []string `json:"parameters,omitempty"`
+}
+
+// Check refuses op if the image doesn't support it or its parameters.
+func (c *Capabilities) Check(image string, op Operation) error {
+	if c.Operations != nil && !contains(c.Operations, op.Name) {
+		return InvalidSpec("image %s doesn't support the %s operation (supported: %v)", image, op.Name, c.Operations)
+	}
+	if c.ProtocolVersion != "" && c.ProtocolVersion != OutputProtocolVersion {
+		return InvalidSpec("image %s outputs protocol version %s, only %s is supported", image, c.ProtocolVersion, OutputProtocolVersion)
+	}
+	if c.Parameters == nil {
+		return nil
+	}
+	var unsupported []string
+	for key := range op.Params {
+		if !contains(c.Parameters, key) {
+			unsupported = append(unsupported, key)
+		}
+	}
+	if len(unsupported) != 0 {
+		sort.Strings(unsupported)
+		return InvalidSpec("image %s doesn't support the parameters %v (supported: %v)", image, unsupported, c.Parameters)
+	}
+	return nil
+}
+
+// parseCapabilities decodes the output of a capabilities operation.
+func parseCapabilities(outputs map[string]string) *Capabilities {
+	list := func(key string) []string {
+		value, ok := outputs[key]
+		if !ok {
+			return nil
+		}
+		items := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	return &Capabilities{
+		Handshake:       true,
+		Operations:      list("operations"),
+		ProtocolVersion: outputs["protocolVersion"],
+		Parameters:      list("parameters"),
+	}
+}
+
+// digestKey returns the cache key of an image digest ("sha256:..."); keys
+// can't hold colons.
+func digestKey(digest string) string {
+	return strings.ReplaceAll(digest, ":", ".")
+}
+
+// tagResolution records the digest an image referenced by tag was resolved
+// to by a probe.
+type tagResolution struct {
+	Image      string      `json:"image"`
+	Digest     string      `json:"digest"`
+	ResolvedAt metav1.Time `json:"resolvedAt"`
+}
+
+// tagKey returns the cache key of the resolution of an image tag.
+func tagKey(image string) string {
+	return fmt.Sprintf("tag.%x", sha256.Sum256([]byte(image)))
+}
+
+// imageDigest returns the digest an image reference is pinned to, if any.
+func imageDigest(image string) string {
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		return image[i+1:]
+	}
+	return ""
+}
+
+// podDigest returns the digest of the image the first container of pod ran,
+// as reported by the kubelet (e.g. "docker-pullable://repo@sha256:...").
+func podDigest(pod *corev1.Pod) string {
+	if pod == nil || len(pod.Status.ContainerStatuses) == 0 {
+		return ""
+	}
+	imageID := pod.Status.ContainerStatuses[0].ImageID
+	if digest := imageDigest(imageID); digest != "" {
+		return digest
+	}
+	if strings.HasPrefix(imageID, "sha256:") {
+		return imageID
+	}
+	return ""
+}
+
+func (e *JobExecutor) capabilitiesCache(ctx context.Context, namespace string) (*corev1.ConfigMap, error) {
+	cache := &corev1.ConfigMap{}
+	err := e.reader.Get(ctx, client.ObjectKey{Namespace: namespace, Name: CapabilitiesConfigMap}, cache)
+	if apierrors.IsNotFound(err) {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      CapabilitiesConfigMap,
+			Labels:    map[string]string{CapabilitiesLabel: "true"},
+		}}, nil
+	}
+	return cache, err
+}
+
+// cachedCapabilities looks image up in cache, by its digest: the one it is
+// pinned to, or the one its tag was last resolved to.  Tag resolutions and
+// failed probes are only trusted until they expire.
+func cachedCapabilities(cache *corev1.ConfigMap, image string) *Capabilities {
+	digest := imageDigest(image)
+	if digest == "" {
+		resolution := &tagResolution{}
+		raw, ok := cache.Data[tagKey(image)]
+		if !ok || json.Unmarshal([]byte(raw), resolution) != nil || time.Since(resolution.ResolvedAt.Time) > CapabilitiesTagTTL {
+			return nil
+		}
+		digest = resolution.Digest
+	}
+	caps := &Capabilities{}
+	raw, ok := cache.Data[digestKey(digest)]
+	if !ok || json.Unmarshal([]byte(raw), caps) != nil || (caps.Expires != nil && !time.Now().Before(caps.Expires.Time)) {
+		return nil
+	}
+	return caps
+}
+
+// probeJobName names the job probing image for runner.
+func probeJobName(runner *v1alpha1.ServiceRunner, image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return fmt.Sprintf("%s-%s-%x", runner.Name, OPERATION_CAPABILITIES, sum[:6])
+}
+
+// probeJob builds the job probing image for runner: a single run of its
+// capabilities operation, pulling the image anew so that its tag, if any, is
+// resolved to the digest it currently points at.
+func probeJob(runner *v1alpha1.ServiceRunner, image, name string) *batchv1.Job {
+	job := newJob(runner, name)
+	job.Spec.Template.Spec.Containers = []corev1.Container{{
+		Name:            "runner",
+		Image:           image,
+		Command:         DefaultCommand(OPERATION_CAPABILITIES),
+		ImagePullPolicy: corev1.PullAlways,
+	}}
+	job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	backoff, deadline := int32(0), int64(probeDeadline)
+	job.Spec.BackoffLimit = &backoff
+	job.Spec.ActiveDeadlineSeconds = &deadline
+	return job
+}
+
+// capabilities returns what image supports, from the cache of the namespace
+// of runner.  An image which hasn't been probed yet is, by a job running its
+// capabilities operation, and NotFound is returned until the job is over.
+// Images whose probe fails, most likely as they don't implement the
+// operation, are cached as supporting anything until CapabilitiesFailureTTL
+// has passed.
+func (e *JobExecutor) capabilities(ctx context.Context, runner *v1alpha1.ServiceRunner, image string) (*Capabilities, error) {
+	cache, err := e.capabilitiesCache(ctx, runner.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if caps := cachedCapabilities(cache, image); caps != nil {
+		return caps, nil
+	}
+
+	name := probeJobName(runner, image)
+	job, err := e.job(ctx, runner, name)
+	if Classify(err) == ErrorNotFound {
+		if err := e.client.Create(ctx, probeJob(runner, image, name)); err != nil && !apierrors.IsAlreadyExists(err) {
+			return nil, err
+		}
+		return nil, NotFound("probing the capabilities of image %s with job %s", image, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	status, err := e.Poll(ctx, runner, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var caps *Capabilities
+	var pod *corev1.Pod
+	switch status.State {
+	case RunRunning:
+		return nil, NotFound("probing the capabilities of image %s with job %s", image, name)
+	case RunSucceeded:
+		if pod, err = e.jobPod(ctx, runner, job); err != nil {
+			return nil, err
+		}
+		log, err := e.logs.TailLog(ctx, pod)
+		if err != nil {
+			return nil, err
+		}
+		outputs, err := DecodeOutputs(log)
+		if err != nil {
+			return nil, InvalidSpec("image %s answered its capabilities operation with %v", image, err)
+		}
+		caps = parseCapabilities(outputs)
+	default:
+		caps = &Capabilities{Expires: &metav1.Time{Time: time.Now().Add(CapabilitiesFailureTTL)}}
+		if pod, err = e.latestPod(ctx, runner, job, func(*corev1.Pod) bool { return true }); err != nil {
+			return nil, err
+		}
+	}
+
+	digest := imageDigest(image)
+	if digest == "" {
+		digest = podDigest(pod)
+	}
+	if digest == "" {
+		// without a digest, the reference itself is the key
+		digest = fmt.Sprintf("image:%x", sha256.Sum256([]byte(image)))
+	}
+	if err := e.cacheCapabilities(ctx, cache, digest, image, caps); err != nil {
+		return nil, err
+	}
+	return caps, e.Cancel(ctx, runner, name)
+}
+
+// cacheCapabilities records caps for digest, and the resolution of image to
+// digest when image is referenced by tag.
+func (e *JobExecutor) cacheCapabilities(ctx context.Context, cache *corev1.ConfigMap, digest, image string, caps *Capabilities) error {
+	if cache.Data == nil {
+		cache.Data = map[string]string{}
+	}
+	raw, err := json.Marshal(caps)
+	if err != nil {
+		return err
+	}
+	cache.Data[digestKey(digest)] = string(raw)
+	if imageDigest(image) == "" {
+		raw, err := json.Marshal(tagResolution{Image: image, Digest: digest, ResolvedAt: metav1.Now()})
+		if err != nil {
+			return err
+		}
+		cache.Data[tagKey(image)] = string(raw)
+	}
+	if cache.ResourceVersion == "" {
+		return e.client.Create(ctx, cache)
+	}
+	return e.client.Update(ctx, cache)
+}
@@ -0,0 +1,218 @@
+package resolve
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const probedImage = "quay.io/example/crud:latest"
+
+// finishProbe completes the probe job of probedImage for the runner, with a
+// pod which ran the image with the given digest and logged output.
+func finishProbe(t *testing.T, c client.Client, logs *FakeLogReader, condition batchv1.JobConditionType, digest, output string) {
+	t.Helper()
+	ctx := context.Background()
+	job := &batchv1.Job{}
+	name := probeJobName(newTestRunner(PIPELINE_NEW), probedImage)
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: name}, job); err != nil {
+		t.Fatalf("probe job: %v", err)
+	}
+	if job.Spec.Template.Spec.Containers[0].Command[0] != "/capabilities" || job.Spec.Template.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Fatalf("probe job runs %v, want a single run of /capabilities", job.Spec.Template.Spec.Containers[0].Command)
+	}
+	// every probe of the image runs in its own job and pod
+	uid := types.UID("job-" + digestKey(digest))
+	job.UID = uid
+	if err := c.Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	finishJob(t, c, name, condition, "")
+
+	pod := newTestPod("apps", name+"-"+digestKey(digest), uid, map[string]string{JobLabel: "db"})
+	if condition == batchv1.JobFailed {
+		pod.Status.Phase = corev1.PodFailed
+	}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "runner", ImageID: "docker-pullable://quay.io/example/crud@" + digest}}
+	if err := c.Create(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	logs.SetLog("apps", pod.Name, output)
+}
+
+// expireCache rewrites the entry of the capabilities cache with the given key
+// as of when it is past trusting.
+func expireCache(t *testing.T, c client.Client, key string) {
+	t.Helper()
+	ctx := context.Background()
+	cache := &corev1.ConfigMap{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: CapabilitiesConfigMap}, cache); err != nil {
+		t.Fatal(err)
+	}
+	past := metav1.NewTime(time.Now().Add(-2 * CapabilitiesTagTTL))
+	var entry interface{}
+	if key == tagKey(probedImage) {
+		resolution := &tagResolution{}
+		if err := json.Unmarshal([]byte(cache.Data[key]), resolution); err != nil {
+			t.Fatal(err)
+		}
+		resolution.ResolvedAt = past
+		entry = resolution
+	} else {
+		caps := &Capabilities{}
+		if err := json.Unmarshal([]byte(cache.Data[key]), caps); err != nil {
+			t.Fatal(err)
+		}
+		caps.Expires = &past
+		entry = caps
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Data[key] = string(raw)
+	if err := c.Update(ctx, cache); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_NEW)
+	runner.Spec.ServiceImage.Capabilities = true
+	runner.Spec.ServiceParam = map[string]string{"SIZE": "small"}
+	c := newTestClient(t, runner)
+	logs := &FakeLogReader{}
+	e := NewJobExecutor(c, nil, logs, "")
+	create := Operation{Name: OPERATION_CREATE, ID: "db-create-1", Params: runner.Spec.ServiceParam}
+
+	if _, err := e.Launch(ctx, runner, create); Classify(err) != ErrorNotFound {
+		t.Fatalf("Launch() before the probe = %v, want to wait for it", err)
+	}
+	finishProbe(t, c, logs, batchv1.JobComplete, "sha256:0123", `{"operations":"create,read,delete","protocolVersion":"1","parameters":"SIZE"}`)
+
+	if _, err := e.Launch(ctx, runner, create); err != nil {
+		t.Fatalf("Launch() of a supported create = %v", err)
+	}
+	update := Operation{Name: OPERATION_UPDATE, ID: "db-update-2", Params: runner.Spec.ServiceParam}
+	if _, err := e.Launch(ctx, runner, update); Classify(err) != ErrorInvalidSpec {
+		t.Errorf("Launch() of an unsupported update = %v, want an invalid spec", err)
+	}
+	create.Params = map[string]string{"SIZE": "small", "REGION": "eu"}
+	if _, err := e.Launch(ctx, runner, create); Classify(err) != ErrorInvalidSpec {
+		t.Errorf("Launch() with an unsupported parameter = %v, want an invalid spec", err)
+	}
+
+	// the probe is gone, its answer is cached by digest
+	probe := &batchv1.Job{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: probeJobName(runner, probedImage)}, probe); Classify(err) != ErrorNotFound {
+		t.Errorf("probe job = %v, want it deleted", err)
+	}
+	cache := &corev1.ConfigMap{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: CapabilitiesConfigMap}, cache); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Data["sha256.0123"]; !ok || cache.Labels[CapabilitiesLabel] == "" {
+		t.Errorf("cache = %v, want the capabilities keyed by digest", cache)
+	}
+
+	// other runners of the image, by tag or digest, don't probe it again
+	other := newTestRunner(PIPELINE_NEW)
+	other.Name = "cache"
+	other.Spec.ServiceImage.Capabilities = true
+	for _, image := range []string{probedImage, "quay.io/example/crud@sha256:0123"} {
+		other.Spec.ServiceImage.CrudImage = image
+		if _, err := e.Launch(ctx, other, Operation{Name: OPERATION_UPDATE, ID: "cache-update-2"}); Classify(err) != ErrorInvalidSpec {
+			t.Errorf("Launch() of an update of %s = %v, want it refused from the cache", image, err)
+		}
+	}
+
+	// once its resolution expired, the tag is probed again, in case it moved
+	expireCache(t, c, tagKey(probedImage))
+	if _, err := e.Launch(ctx, runner, create); Classify(err) != ErrorNotFound {
+		t.Fatalf("Launch() once the tag resolution expired = %v, want to wait for a new probe", err)
+	}
+	finishProbe(t, c, logs, batchv1.JobComplete, "sha256:89ab", `{"operations":"create,read,update,delete"}`)
+	if _, err := e.Launch(ctx, runner, update); err != nil {
+		t.Fatalf("Launch() of an update supported by the image the tag moved to = %v", err)
+	}
+
+	// the cache is read with the reader, not the (cached) client
+	other.Spec.ServiceImage.CrudImage = "quay.io/example/crud@sha256:0123"
+	uncached := NewJobExecutor(newTestClient(t), c, logs, "")
+	if _, err := uncached.Launch(ctx, other, Operation{Name: OPERATION_UPDATE, ID: "cache-update-2"}); Classify(err) != ErrorInvalidSpec {
+		t.Errorf("Launch() of an update with the cache read by the reader = %v, want it refused from the cache", err)
+	}
+}
+
+func TestCapabilitiesWithoutHandshake(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_NEW)
+	runner.Spec.ServiceImage.Capabilities = true
+	c := newTestClient(t, runner)
+	logs := &FakeLogReader{}
+	e := NewJobExecutor(c, nil, logs, "")
+	update := Operation{Name: OPERATION_UPDATE, ID: "db-update-2", Params: map[string]string{"ANY": "value"}}
+
+	if _, err := e.Launch(ctx, runner, update); Classify(err) != ErrorNotFound {
+		t.Fatalf("Launch() before the probe = %v, want to wait for it", err)
+	}
+	finishProbe(t, c, logs, batchv1.JobFailed, "sha256:4567", "exec /capabilities: no such file or directory")
+	if _, err := e.Launch(ctx, runner, update); err != nil {
+		t.Fatalf("Launch() for an image without the handshake = %v, want anything allowed", err)
+	}
+
+	// the failure is only trusted for a while: the probe may not have run
+	expireCache(t, c, digestKey("sha256:4567"))
+	if _, err := e.Launch(ctx, runner, update); Classify(err) != ErrorNotFound {
+		t.Fatalf("Launch() once the failure expired = %v, want to wait for a new probe", err)
+	}
+}
+
+func TestCapabilitiesNotCheckedForDelete(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_DELETE)
+	runner.Spec.ServiceImage.Capabilities = true
+	c := newTestClient(t, runner)
+	e := NewJobExecutor(c, nil, &FakeLogReader{}, "")
+
+	ref, err := e.Launch(ctx, runner, Operation{Name: OPERATION_DELETE, ID: "db-delete-1"})
+	if err != nil {
+		t.Fatalf("Launch() of a delete = %v, want it launched without a probe", err)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: ref}, &batchv1.Job{}); err != nil {
+		t.Errorf("delete job = %v, want it created", err)
+	}
+	probe := &batchv1.Job{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: probeJobName(runner, probedImage)}, probe); Classify(err) != ErrorNotFound {
+		t.Errorf("probe job = %v, want none", err)
+	}
+}
+
+func TestProbeJob(t *testing.T) {
+	runner := newTestRunner(PIPELINE_UPDATE)
+	runner.Spec.ControlPlaneSecret = "control-plane"
+	runner.Spec.State = &v1alpha1.StateSpec{}
+	runner.Spec.ServiceParam = map[string]string{"SIZE": "small"}
+	job := probeJob(runner, probedImage, probeJobName(runner, probedImage))
+
+	spec := job.Spec.Template.Spec
+	if len(spec.InitContainers) != 0 || len(spec.Containers) != 1 || len(spec.Volumes) != 0 {
+		t.Fatalf("probe pod = %+v, want a single container", spec)
+	}
+	container := spec.Containers[0]
+	if container.Image != probedImage || container.ImagePullPolicy != corev1.PullAlways || len(container.Env) != 0 || len(container.VolumeMounts) != 0 {
+		t.Errorf("probe container = %+v, want %s pulled anew, with nothing handed to it", container, probedImage)
+	}
+	if job.Labels[JobLabel] != "db" || len(job.OwnerReferences) != 1 || *job.Spec.BackoffLimit != 0 {
+		t.Errorf("probe job = %+v, want a single run owned by the runner", job.ObjectMeta)
+	}
+}
@@ -0,0 +1,151 @@
+package resolve
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Update jobs are told what they change: UpdateContextFile, in
+// UpdateVolume, holds the UpdateContext as JSON, and the outputs the service
+// was last read with are files of UpdateOutputsDir, one per key, in
+// UpdateOutputsVolume.
+const (
+	UpdateVolume        = "update"
+	UpdateOutputsVolume = "update-outputs"
+	UpdateDir           = "/var/run/servicerunner.io/update"
+	UpdateContextFile   = UpdateDir + "/context.json"
+	UpdateOutputsDir    = UpdateDir + "/outputs"
+
+	// UpdateContextAnnotation carries the UpdateContext on the pods of update
+	// jobs, from which it is projected into UpdateContextFile.
+	UpdateContextAnnotation = "servicerunner.io/update-context"
+)
+
+// The context of an update is also in the environment of its jobs: each
+// previous parameter prefixed with PreviousPrefix, the comma-separated keys
+// of the ChangeSet in UPDATE_ADDED, UPDATE_REMOVED and UPDATE_CHANGED, and
+// each output prefixed with OutputPrefix.
+const (
+	PreviousPrefix = "PREVIOUS_"
+	OutputPrefix   = "OUTPUT_"
+)
+
+// ChangeSet lists the keys of the parameters an update adds, removes and
+// changes the value of, in order.
+type ChangeSet struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// Diff returns the changes from previous to params.
+func Diff(previous, params map[string]string) ChangeSet {
+	changes := ChangeSet{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for key, value := range params {
+		old, ok := previous[key]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, key)
+		case old != value:
+			changes.Changed = append(changes.Changed, key)
+		}
+	}
+	for key := range previous {
+		if _, ok := params[key]; !ok {
+			changes.Removed = append(changes.Removed, key)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+	return changes
+}
+
+// UpdateContext is what an update job is told about the update it runs.
+type UpdateContext struct {
+	// Previous are the parameters the service was applied with.
+	Previous map[string]string `json:"previous"`
+
+	// Params are the parameters the update applies.
+	Params map[string]string `json:"params"`
+
+	Changes ChangeSet `json:"changes"`
+}
+
+// withUpdateContext hands the context of the update op to the containers of
+// job: the previous parameters and their diff, and the outputs of the
+// binding, if any.
+func withUpdateContext(runner *v1alpha1.ServiceRunner, op Operation, job *batchv1.Job, containers []corev1.Container) {
+	previous := op.Previous
+	if previous == nil {
+		previous = map[string]string{}
+	}
+	params := op.Params
+	if params == nil {
+		params = map[string]string{}
+	}
+	context := UpdateContext{Previous: previous, Params: params, Changes: Diff(previous, params)}
+	raw, _ := json.Marshal(context) // maps of strings always marshal
+	if job.Spec.Template.Annotations == nil {
+		job.Spec.Template.Annotations = map[string]string{}
+	}
+	job.Spec.Template.Annotations[UpdateContextAnnotation] = string(raw)
+
+	job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, corev1.Volume{
+		Name: UpdateVolume,
+		VolumeSource: corev1.VolumeSource{DownwardAPI: &corev1.DownwardAPIVolumeSource{
+			Items: []corev1.DownwardAPIVolumeFile{{
+				Path:     "context.json",
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations['" + UpdateContextAnnotation + "']"},
+			}},
+		}},
+	})
+	mounts := []corev1.VolumeMount{{Name: UpdateVolume, MountPath: UpdateDir, ReadOnly: true}}
+	var envFrom []corev1.EnvFromSource
+	if runner.Status.Binding != nil {
+		// the binding may be gone, e.g. deleted by hand; the update runs
+		// without outputs then
+		optional := true
+		job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name: UpdateOutputsVolume,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+				SecretName: runner.Status.Binding.Name,
+				Optional:   &optional,
+			}},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: UpdateOutputsVolume, MountPath: UpdateOutputsDir, ReadOnly: true})
+		envFrom = []corev1.EnvFromSource{{
+			Prefix: OutputPrefix,
+			SecretRef: &corev1.SecretEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: runner.Status.Binding.Name},
+				Optional:             &optional,
+			},
+		}}
+	}
+
+	keys := make([]string, 0, len(previous))
+	for key := range previous {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	env := []corev1.EnvVar{}
+	for _, key := range keys {
+		env = append(env, corev1.EnvVar{Name: PreviousPrefix + key, Value: previous[key]})
+	}
+	env = append(env,
+		corev1.EnvVar{Name: "UPDATE_ADDED", Value: strings.Join(context.Changes.Added, ",")},
+		corev1.EnvVar{Name: "UPDATE_REMOVED", Value: strings.Join(context.Changes.Removed, ",")},
+		corev1.EnvVar{Name: "UPDATE_CHANGED", Value: strings.Join(context.Changes.Changed, ",")},
+		corev1.EnvVar{Name: "UPDATE_CONTEXT", Value: UpdateContextFile},
+	)
+	for i := range containers {
+		containers[i].Env = append(containers[i].Env, env...)
+		containers[i].EnvFrom = append(containers[i].EnvFrom, envFrom...)
+		containers[i].VolumeMounts = append(containers[i].VolumeMounts, mounts...)
+	}
+}
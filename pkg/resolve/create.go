@@ -2,7 +2,6 @@ package resolve
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -14,11 +13,12 @@ type Create struct {
 	Pipeline
 }
 
-func MakeCreate(runner *v1alpha1.ServiceRunner, client client.Client) *Create {
+func MakeCreate(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Create {
 	return &Create{
 		Pipeline: Pipeline{
 			serviceRunner: runner,
 			client:        client,
+			executors:     executors,
 		},
 	}
 }
@@ -26,18 +26,21 @@ func MakeCreate(runner *v1alpha1.ServiceRunner, client client.Client) *Create {
 var _ Resolver = &Create{}
 
 func (c *Create) JobName() string {
-	return fmt.Sprintf("%s-create", c.serviceRunner.Name)
+	return stageJobName(c.serviceRunner, OPERATION_CREATE, c.serviceRunner.Generation)
 }
 
+// Params returns the parameters of the current generation
+func (c *Create) Params() map[string]string {
+	return c.serviceRunner.Spec.ServiceParam
+}
+
+// Resolve launches the create job for the current generation
 func (c *Create) Resolve(ctx context.Context) (ctrl.Result, error) {
-	res := ctrl.Result{}
-	job := JobTemplate(c, "/create")
-	err := c.client.Create(ctx, job)
-	if err != nil {
-		res.Requeue = true
+	op := Operation{Name: OPERATION_CREATE, ID: c.JobName(), Params: c.Params()}
+	if err := c.Launch(ctx, op); err != nil {
+		return ctrl.Result{}, err
 	}
 
-	c.serviceRunner.Status.State = PIPELINE_CREATE
-	c.serviceRunner.Status.ObservedGeneration = c.ServiceRunner().Generation
-	return res, err
+	c.applying()
+	return ctrl.Result{}, nil
 }
@@ -0,0 +1,122 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// DeleteRetryDelay is how long after a delete failed it is launched again,
+// while the runner is still being deleted; the delay doubles with every
+// attempt, up to MaxDeleteRetryDelay.
+const (
+	DeleteRetryDelay    = 30 * time.Second
+	MaxDeleteRetryDelay = 30 * time.Minute
+)
+
+// Delete represents the pipeline stage where we need to run the delete job
+type Delete struct {
+	Pipeline
+}
+
+var _ Resolver = &Delete{}
+
+func MakeDelete(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Delete {
+	return &Delete{
+		Pipeline: Pipeline{
+			serviceRunner: runner,
+			client:        client,
+			executors:     executors,
+		},
+	}
+}
+
+// JobName names the delete job after the generation being applied, and the
+// attempt when launched again after it failed.
+func (d *Delete) JobName() string {
+	name := stageJobName(d.serviceRunner, OPERATION_DELETE, applyingGeneration(d.serviceRunner))
+	if attempt := d.attempt(OPERATION_DELETE); attempt > 1 {
+		name = fmt.Sprintf("%s-%d", name, attempt)
+	}
+	return name
+}
+
+// deleteRetryIn returns how long until the failed delete of runner is due to
+// be launched again: DeleteRetryDelay after it failed, doubled with every
+// attempt up to MaxDeleteRetryDelay.  It is 0 when it is due, or when
+// deleting or expiring the runner doesn't delete the service.
+func deleteRetryIn(runner *v1alpha1.ServiceRunner) time.Duration {
+	operation := runner.Status.Operation
+	if runner.Status.State != PIPELINE_FAILED || !deleteFailed.Check(runner) || orphan.Check(runner) || importing.Check(runner) ||
+		operation.FinishedAt == nil {
+		return 0
+	}
+	delay := DeleteRetryDelay
+	for attempt := int32(1); attempt < operation.Attempt && delay < MaxDeleteRetryDelay; attempt++ {
+		delay *= 2
+	}
+	if delay > MaxDeleteRetryDelay {
+		delay = MaxDeleteRetryDelay
+	}
+	return time.Until(operation.FinishedAt.Add(delay))
+}
+
+// Resolve launches the delete job.  Once the service is gone, the service it
+// was replacing, if still around, is deleted in turn
+func (d *Delete) Resolve(ctx context.Context) (ctrl.Result, error) {
+	replaced := d.serviceRunner.Status.Replaced
+	if d.serviceRunner.Status.State != PIPELINE_DELETE || replaced == nil {
+		op := Operation{Name: OPERATION_DELETE, ID: d.JobName(), Params: d.Params()}
+		return ctrl.Result{}, d.Launch(ctx, op)
+	}
+
+	op := Operation{
+		Name:      OPERATION_DELETE,
+		ID:        stageJobName(d.serviceRunner, OPERATION_DELETE, replaced.Generation),
+		Params:    replaced.Params,
+		ServiceID: replaced.ServiceId,
+	}
+	if err := d.Launch(ctx, op); err != nil {
+		return ctrl.Result{}, err
+	}
+	d.serviceRunner.Status.Replaced = nil
+	return ctrl.Result{}, nil
+}
+
+// Deleted represents the end of the pipeline, where the service is gone and
+// the runner can be released
+type Deleted struct {
+	Pipeline
+}
+
+var _ Resolver = &Deleted{}
+
+func MakeDeleted(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Deleted {
+	return &Deleted{
+		Pipeline: Pipeline{
+			serviceRunner: runner,
+			client:        client,
+			executors:     executors,
+		},
+	}
+}
+
+// We shouldn't need to make a job in this state
+func (*Deleted) JobName() string {
+	return ""
+}
+
+// Resolve removes the finalizer, letting the runner go
+func (d *Deleted) Resolve(ctx context.Context) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(d.serviceRunner, Finalizer) {
+		return ctrl.Result{}, nil
+	}
+	patch := client.MergeFrom(d.serviceRunner.DeepCopy())
+	controllerutil.RemoveFinalizer(d.serviceRunner, Finalizer)
+	return ctrl.Result{}, d.client.Patch(ctx, d.serviceRunner, patch)
+}
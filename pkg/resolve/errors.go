@@ -0,0 +1,180 @@
+package resolve
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// ErrorClass categorizes the errors raised while resolving a runner; the class
+// decides how the request is requeued and how the error shows in the status.
+type ErrorClass string
+
+const (
+	// ErrorNotFound means an object the stage depends on (a job, its pod) is
+	// missing.  It may show up later, so the runner is checked again after
+	// NotFoundRequeueDelay.
+	ErrorNotFound ErrorClass = "NotFound"
+
+	// ErrorTransient covers API and network failures.  The error is returned
+	// to the controller, which requeues with exponential backoff, unless the
+	// backend said when to retry.
+	ErrorTransient ErrorClass = "TransientError"
+
+	// ErrorInvalidSpec means the runner spec cannot be acted upon.  Retrying
+	// won't help; the runner waits until its spec is changed.
+	ErrorInvalidSpec ErrorClass = "InvalidSpec"
+
+	// ErrorJobFailed means a stage job ran and failed, or produced unusable
+	// output.  The runner is not requeued.
+	ErrorJobFailed ErrorClass = "JobFailed"
+
+	// ErrorLocked means another runner holds the lock on the service the
+	// runner operates on.  The runner tries again after LockRequeueDelay.
+	ErrorLocked ErrorClass = "Locked"
+
+	// ErrorDeletionProtected means the runner was to delete a service while
+	// annotated against it.  The runner waits until the annotation is
+	// removed.
+	ErrorDeletionProtected ErrorClass = "DeletionProtected"
+
+	// ErrorIllegalTransition means the runner faces an event its state has
+	// no transition for, such as a rollback request on a runner whose last
+	// operation wasn't an update.  The runner is not requeued.
+	ErrorIllegalTransition ErrorClass = "IllegalTransition"
+)
+
+// NotFoundRequeueDelay is how long to wait before looking again for an object
+// which wasn't found.
+const NotFoundRequeueDelay = 30 * time.Second
+
+// LockRequeueDelay is how long to wait before trying again to take the lock
+// on a service.
+const LockRequeueDelay = 15 * time.Second
+
+// ResolveError is an error carrying its ErrorClass.
+type ResolveError struct {
+	Class ErrorClass
+	Err   error
+
+	// RetryAfter is when a transient error is worth retrying, when its
+	// source said so; the controller backs off otherwise.
+	RetryAfter time.Duration
+}
+
+func (e *ResolveError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+// NotFound reports a missing object the stage depends on.
+func NotFound(format string, args ...interface{}) error {
+	return &ResolveError{Class: ErrorNotFound, Err: fmt.Errorf(format, args...)}
+}
+
+// Unavailable reports a transient failure of a backend which asked to be
+// retried after retryAfter; a zero retryAfter leaves it to the backoff.
+func Unavailable(retryAfter time.Duration, format string, args ...interface{}) error {
+	return &ResolveError{Class: ErrorTransient, Err: fmt.Errorf(format, args...), RetryAfter: retryAfter}
+}
+
+// InvalidSpec reports a runner spec which cannot be acted upon.
+func InvalidSpec(format string, args ...interface{}) error {
+	return &ResolveError{Class: ErrorInvalidSpec, Err: fmt.Errorf(format, args...)}
+}
+
+// JobFailed reports a stage job which failed or produced unusable output.
+func JobFailed(format string, args ...interface{}) error {
+	return &ResolveError{Class: ErrorJobFailed, Err: fmt.Errorf(format, args...)}
+}
+
+// Locked reports a service locked by another runner.
+func Locked(format string, args ...interface{}) error {
+	return &ResolveError{Class: ErrorLocked, Err: fmt.Errorf(format, args...)}
+}
+
+// DeletionProtected reports a deletion refused by the deletion protection of
+// the runner.
+func DeletionProtected(format string, args ...interface{}) error {
+	return &ResolveError{Class: ErrorDeletionProtected, Err: fmt.Errorf(format, args...)}
+}
+
+// Classify returns the class of err.  API errors are classified by their
+// status; anything unknown is assumed to be transient.
+func Classify(err error) ErrorClass {
+	var resolveErr *ResolveError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &resolveErr):
+		return resolveErr.Class
+	case apierrors.IsNotFound(err):
+		return ErrorNotFound
+	case apierrors.IsInvalid(err), apierrors.IsBadRequest(err):
+		return ErrorInvalidSpec
+	default:
+		return ErrorTransient
+	}
+}
+
+// Requeue maps the outcome of a stage to the result handed back to the
+// controller, according to the class of err.
+func Requeue(res ctrl.Result, err error) (ctrl.Result, error) {
+	switch Classify(err) {
+	case "":
+		return res, nil
+	case ErrorNotFound:
+		return ctrl.Result{RequeueAfter: NotFoundRequeueDelay}, nil
+	case ErrorLocked:
+		return ctrl.Result{RequeueAfter: LockRequeueDelay}, nil
+	case ErrorInvalidSpec, ErrorJobFailed, ErrorIllegalTransition, ErrorDeletionProtected:
+		return ctrl.Result{}, nil
+	}
+	var resolveErr *ResolveError
+	if errors.As(err, &resolveErr) && resolveErr.RetryAfter > 0 {
+		return ctrl.Result{RequeueAfter: resolveErr.RetryAfter}, nil
+	}
+	return ctrl.Result{}, err
+}
+
+// SetConditions reflects the state of the runner and the outcome of its last
+// stage in the runner conditions.
+func SetConditions(runner *v1alpha1.ServiceRunner, err error) {
+	synced := metav1.Condition{
+		Type:               v1alpha1.ConditionSynced,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: runner.Generation,
+		Reason:             "ReconcileSuccess",
+	}
+	if err != nil {
+		synced.Status = metav1.ConditionFalse
+		synced.Reason = string(Classify(err))
+		synced.Message = err.Error()
+	}
+	meta.SetStatusCondition(&runner.Status.Conditions, synced)
+
+	ready := metav1.Condition{
+		Type:               v1alpha1.ConditionReady,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: runner.Generation,
+		Reason:             runner.Status.State,
+	}
+	if ready.Reason == "" {
+		ready.Reason = "Pending"
+	}
+	if runner.Status.State == PIPELINE_READY {
+		ready.Status = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(&runner.Status.Conditions, ready)
+
+	setDeletionProtected(runner, err)
+}
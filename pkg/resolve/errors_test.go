@@ -0,0 +1,303 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestClient(t testing.TB, objs ...client.Object) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+}
+
+// testClusterID is the cluster the jobs built by tests run in.
+const testClusterID = "3f1c0a"
+
+// newTestJobTemplate builds the job running op for runner, as the job
+// executor of newTestExecutors does.
+func newTestJobTemplate(runner *v1alpha1.ServiceRunner, op Operation) *batchv1.Job {
+	return NewJobExecutor(nil, nil, nil, testClusterID).JobTemplate(runner, op)
+}
+
+// newTestExecutors registers a job executor using c, serving the logs of
+// pods from logs if set.
+func newTestExecutors(c client.Client, logs LogReader) *Registry {
+	if logs == nil {
+		logs = &FakeLogReader{}
+	}
+	executors := NewRegistry()
+	executors.Register(JobExecutorName, NewJobExecutor(c, nil, logs, testClusterID))
+	return executors
+}
+
+// newTestRunner returns a runner of the CRUD image quay.io/example/crud, in
+// the given state, which has launched the job of the operation behind that
+// state for its first generation.
+func newTestRunner(state string) *v1alpha1.ServiceRunner {
+	runner := &v1alpha1.ServiceRunner{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: v1alpha1.GroupVersion.String(),
+			Kind:       "ServiceRunner",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "db",
+			Namespace:  "apps",
+			UID:        "db-uid",
+			Generation: 1,
+			Finalizers: []string{Finalizer},
+		},
+		Spec: v1alpha1.ServiceRunnerSpec{
+			ServiceImage: v1alpha1.ServiceRunnerImage{CrudImage: "quay.io/example/crud:latest"},
+		},
+		Status: v1alpha1.ServiceRunnerStatus{
+			State: state,
+		},
+	}
+	if state != PIPELINE_NEW {
+		runner.Status.ObservedGeneration, runner.Status.ApplyingGeneration = 1, 1
+	}
+	operations := map[string]string{
+		PIPELINE_CREATE: OPERATION_CREATE,
+		PIPELINE_READ:   OPERATION_READ,
+		PIPELINE_UPDATE: OPERATION_UPDATE,
+		PIPELINE_DELETE: OPERATION_DELETE,
+	}
+	if operation, ok := operations[state]; ok {
+		runner.Status.Operation = &v1alpha1.ServiceRunnerOperation{
+			Name:     operation,
+			Job:      "db-" + operation + "-1",
+			Executor: JobExecutorName,
+		}
+	}
+	return runner
+}
+
+func newTestJob(name string, conditions ...batchv1.JobCondition) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "apps",
+			UID:       "job-uid",
+			Labels:    map[string]string{JobLabel: "db"},
+		},
+		Status: batchv1.JobStatus{Conditions: conditions},
+	}
+}
+
+// conditionOf returns the condition of runner with the given type as
+// "Status/Reason", or "" when the runner doesn't have it.
+func conditionOf(runner *v1alpha1.ServiceRunner, conditionType string) string {
+	condition := meta.FindStatusCondition(runner.Status.Conditions, conditionType)
+	if condition == nil {
+		return ""
+	}
+	return string(condition.Status) + "/" + condition.Reason
+}
+
+// failingClient fails every create with the configured error.
+type failingClient struct {
+	client.Client
+	err error
+}
+
+func (c *failingClient) Create(context.Context, client.Object, ...client.CreateOption) error {
+	return c.err
+}
+
+func TestClassify(t *testing.T) {
+	gr := schema.GroupResource{Group: "batch", Resource: "jobs"}
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{
+		{"nil", nil, ""},
+		{"not found", NotFound("missing"), ErrorNotFound},
+		{"api not found", apierrors.NewNotFound(gr, "db-create-1"), ErrorNotFound},
+		{"invalid spec", InvalidSpec("bad"), ErrorInvalidSpec},
+		{"api invalid", apierrors.NewInvalid(schema.GroupKind{Group: "batch", Kind: "Job"}, "db-create-1", nil), ErrorInvalidSpec},
+		{"job failed", JobFailed("failed"), ErrorJobFailed},
+		{"locked", Locked("locked"), ErrorLocked},
+		{"deletion protected", DeletionProtected("protected"), ErrorDeletionProtected},
+		{"wrapped job failed", fmt.Errorf("read stage: %w", JobFailed("failed")), ErrorJobFailed},
+		{"api conflict", apierrors.NewConflict(gr, "db-create-1", errors.New("conflict")), ErrorTransient},
+		{"api timeout", apierrors.NewServerTimeout(gr, "create", 1), ErrorTransient},
+		{"unknown", errors.New("connection refused"), ErrorTransient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err); got != tt.want {
+				t.Errorf("Classify() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequeue(t *testing.T) {
+	transient := errors.New("connection refused")
+	tests := []struct {
+		name    string
+		err     error
+		want    ctrl.Result
+		wantErr error
+	}{
+		{"success keeps result", nil, ctrl.Result{Requeue: true}, nil},
+		{"not found waits", NotFound("missing"), ctrl.Result{RequeueAfter: NotFoundRequeueDelay}, nil},
+		{"locked waits for the lock", Locked("locked"), ctrl.Result{RequeueAfter: LockRequeueDelay}, nil},
+		{"transient backs off", transient, ctrl.Result{}, transient},
+		{"unavailable backend waits as asked", Unavailable(time.Minute, "throttled"), ctrl.Result{RequeueAfter: time.Minute}, nil},
+		{"invalid spec waits for spec change", InvalidSpec("bad"), ctrl.Result{}, nil},
+		{"job failure is not retried", JobFailed("failed"), ctrl.Result{}, nil},
+		{"protected deletion waits for the annotation to go", DeletionProtected("protected"), ctrl.Result{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Requeue(ctrl.Result{Requeue: true}, tt.err)
+			if got != tt.want {
+				t.Errorf("Requeue() result = %+v, want %+v", got, tt.want)
+			}
+			if err != tt.wantErr {
+				t.Errorf("Requeue() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetConditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		state      string
+		err        error
+		wantSynced metav1.ConditionStatus
+		wantReason string
+		wantReady  metav1.ConditionStatus
+	}{
+		{"ready", PIPELINE_READY, nil, metav1.ConditionTrue, "ReconcileSuccess", metav1.ConditionTrue},
+		{"not found", PIPELINE_READ, NotFound("missing"), metav1.ConditionFalse, string(ErrorNotFound), metav1.ConditionFalse},
+		{"transient", PIPELINE_CREATE, errors.New("timeout"), metav1.ConditionFalse, string(ErrorTransient), metav1.ConditionFalse},
+		{"invalid spec", "", InvalidSpec("bad"), metav1.ConditionFalse, string(ErrorInvalidSpec), metav1.ConditionFalse},
+		{"job failed", PIPELINE_CREATE, JobFailed("failed"), metav1.ConditionFalse, string(ErrorJobFailed), metav1.ConditionFalse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := newTestRunner(tt.state)
+			SetConditions(runner, tt.err)
+			synced := meta.FindStatusCondition(runner.Status.Conditions, v1alpha1.ConditionSynced)
+			if synced == nil || synced.Status != tt.wantSynced || synced.Reason != tt.wantReason {
+				t.Errorf("Synced condition = %+v, want status %s reason %s", synced, tt.wantSynced, tt.wantReason)
+			}
+			ready := meta.FindStatusCondition(runner.Status.Conditions, v1alpha1.ConditionReady)
+			if ready == nil || ready.Status != tt.wantReady {
+				t.Errorf("Ready condition = %+v, want status %s", ready, tt.wantReady)
+			}
+		})
+	}
+}
+
+func TestStageErrors(t *testing.T) {
+	failed := batchv1.JobCondition{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded"}
+	complete := batchv1.JobCondition{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}
+
+	tests := []struct {
+		name   string
+		runner *v1alpha1.ServiceRunner
+		objs   []client.Object
+		wrap   func(c client.Client) client.Client
+		want   ErrorClass
+	}{
+		{
+			name:   "missing job is not found",
+			runner: newTestRunner(PIPELINE_CREATE),
+			want:   ErrorNotFound,
+		},
+		{
+			name:   "failed create job",
+			runner: newTestRunner(PIPELINE_CREATE),
+			objs:   []client.Object{newTestJob("db-create-1", failed)},
+			want:   ErrorJobFailed,
+		},
+		{
+			name:   "failed read job",
+			runner: newTestRunner(PIPELINE_READ),
+			objs:   []client.Object{newTestJob("db-read-1", failed)},
+			want:   ErrorJobFailed,
+		},
+		{
+			name:   "read job without pod is not found",
+			runner: newTestRunner(PIPELINE_READ),
+			objs: []client.Object{func() client.Object {
+				job := newTestJob("db-read-1", complete)
+				job.Status.Succeeded = 1
+				return job
+			}()},
+			want: ErrorNotFound,
+		},
+		{
+			name: "missing image is an invalid spec",
+			runner: func() *v1alpha1.ServiceRunner {
+				runner := newTestRunner(PIPELINE_NEW)
+				runner.Spec.ServiceImage.CrudImage = ""
+				return runner
+			}(),
+			want: ErrorInvalidSpec,
+		},
+		{
+			name: "bad parameter name is an invalid spec",
+			runner: func() *v1alpha1.ServiceRunner {
+				runner := newTestRunner(PIPELINE_NEW)
+				runner.Spec.ServiceParam = map[string]string{"1-size": "small"}
+				return runner
+			}(),
+			want: ErrorInvalidSpec,
+		},
+		{
+			name:   "api failure is transient",
+			runner: newTestRunner(PIPELINE_NEW),
+			wrap: func(c client.Client) client.Client {
+				return &failingClient{Client: c, err: apierrors.NewServiceUnavailable("etcd is down")}
+			},
+			want: ErrorTransient,
+		},
+		{
+			name:   "running job is no error",
+			runner: newTestRunner(PIPELINE_CREATE),
+			objs:   []client.Object{newTestJob("db-create-1")},
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, tt.objs...)
+			if tt.wrap != nil {
+				c = tt.wrap(c)
+			}
+			_, err := Advance(context.Background(), tt.runner, c, newTestExecutors(c, nil))
+			if got := Classify(err); got != tt.want {
+				t.Errorf("Advance() error = %v (class %q), want class %q", err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package resolve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+)
+
+// Operation is an operation the pipeline asks an executor to run against the
+// underlying service.
+type Operation struct {
+	// Name is one of the OPERATION_* constants.
+	Name string
+
+	// ID names the run deterministically from the runner, the operation and
+	// the generation it applies, e.g. "db-update-3".  Launching an operation
+	// whose ID has already been launched must not run it a second time.
+	ID string
+
+	// Params are the service parameters the operation runs with.
+	Params map[string]string
+
+	// Previous are the parameters the service was applied with before an
+	// update; they are unset for other operations.
+	Previous map[string]string
+
+	// ServiceID identifies the service the operation runs against, once
+	// known: the service of the runner, or the one a replacement retires.
+	ServiceID string
+
+	// Attempt numbers the consecutive launches of the operation, from 1.
+	Attempt int32
+
+	// StateVersion is the version of the state the operation leaves, for
+	// runners keeping state; every launch works on a version of its own.
+	StateVersion int64
+}
+
+// RunState is how far a launched operation has got.
+type RunState string
+
+const (
+	RunRunning   RunState = "Running"
+	RunSucceeded RunState = "Succeeded"
+	RunFailed    RunState = "Failed"
+	RunTimedOut  RunState = "TimedOut"
+)
+
+// RunStatus is what polling a launched operation reports.
+type RunStatus struct {
+	State RunState
+
+	// Message explains a failure.
+	Message string
+
+	// Steps report the progress of a run made of steps.
+	Steps []v1alpha1.OperationStepStatus
+
+	// RetryAfter is when to poll a running operation again, when the
+	// backend says so.
+	RetryAfter time.Duration
+}
+
+// PollInterval is how often a running operation is polled when its executor
+// doesn't watch its runs and the backend didn't say when to poll again.
+const PollInterval = 30 * time.Second
+
+// States of the steps of a run.
+const (
+	StepWaiting   = "Waiting"
+	StepRunning   = "Running"
+	StepSucceeded = "Succeeded"
+	StepFailed    = "Failed"
+)
+
+// Executor runs the operations of the pipeline with some backend.  The
+// pipeline drives the runner through its states and only delegates running
+// operations, so that a new backend needs none of the state logic.
+//
+// Runs are identified by the reference Launch returns, which is recorded in
+// the runner status and handed back to the other methods.
+type Executor interface {
+	// Launch starts op for runner and returns the reference of the run.
+	Launch(ctx context.Context, runner *v1alpha1.ServiceRunner, op Operation) (string, error)
+
+	// Poll reports the state of the run; a run which is gone is reported as
+	// a NotFound error.
+	Poll(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (RunStatus, error)
+
+	// Outputs returns the binding data produced by a succeeded read.
+	Outputs(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (map[string]string, error)
+
+	// Cancel stops the run if it is still going, and releases whatever it
+	// holds.  Cancelling a run which is gone is no error.
+	Cancel(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) error
+}
+
+// Watcher is implemented by executors whose runs are objects owned by the
+// runner, so that the runner is reconciled as they progress.
+type Watcher interface {
+	// Watches returns an empty object of each kind of run.
+	Watches() []client.Object
+}
+
+// SingleInstance is implemented by executors running a single service per
+// runner, whatever the operation, e.g. as they address it by the runner UID:
+// such a runner can't create a replacement next to the service it replaces.
+type SingleInstance interface {
+	// SingleInstance only marks the executor.
+	SingleInstance()
+}
+
+// JobExecutorName is the name of the executor running operations as Jobs,
+// used when a runner doesn't select one.
+const JobExecutorName = "job"
+
+// Registry holds the executors runners may select by name, and where the
+// operations they launch are locked.
+type Registry struct {
+	executors map[string]Executor
+
+	// unwatched are the executors whose runs couldn't be watched.
+	unwatched map[string]bool
+
+	// LockNamespace is where the Leases locking services are kept; when
+	// empty, they are kept in the namespace of the runner, and only runners
+	// of the same namespace exclude each other.
+	LockNamespace string
+
+	// Reader reads the objects the manager doesn't cache, such as
+	// namespaces; when nil, they are read through the client of runners.
+	Reader client.Reader
+
+	// maxTTLs caches the max TTL annotations of namespaces, not to read
+	// them on every reconcile.
+	maxTTLs   map[string]namespaceTTL
+	maxTTLsMu sync.Mutex
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{executors: map[string]Executor{}, unwatched: map[string]bool{}, maxTTLs: map[string]namespaceTTL{}}
+}
+
+// Register makes executor available under name.
+func (r *Registry) Register(name string, executor Executor) {
+	r.executors[name] = executor
+}
+
+// Names lists the registered executors.
+func (r *Registry) Names() []string {
+	var names []string
+	for name := range r.executors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Watches collects the kinds of run of the registered executors.
+func (r *Registry) Watches() []client.Object {
+	var objects []client.Object
+	for _, name := range r.Names() {
+		objects = append(objects, r.WatchesOf(name)...)
+	}
+	return objects
+}
+
+// WatchesOf returns the kinds of run of the executor registered under name.
+func (r *Registry) WatchesOf(name string) []client.Object {
+	if watcher, ok := r.executors[name].(Watcher); ok {
+		return watcher.Watches()
+	}
+	return nil
+}
+
+// Unwatch records that the runs of the executor registered under name
+// aren't watched, e.g. because their kind wasn't served when the manager
+// started, so that its running operations are polled instead.
+func (r *Registry) Unwatch(name string) {
+	r.unwatched[name] = true
+}
+
+// watched tells whether the runs of the executor registered under name are
+// watched, so that the runner is reconciled as they progress.
+func (r *Registry) watched(name string) bool {
+	if name == "" {
+		name = JobExecutorName
+	}
+	_, ok := r.executors[name].(Watcher)
+	return ok && !r.unwatched[name]
+}
+
+// Get returns the executor registered under name.
+func (r *Registry) Get(name string) (Executor, error) {
+	if name == "" {
+		name = JobExecutorName
+	}
+	executor, ok := r.executors[name]
+	if !ok {
+		return nil, InvalidSpec("executor %q is not registered (available: %v)", name, r.Names())
+	}
+	return executor, nil
+}
+
+// executorName returns the name of the executor runner selects.
+func executorName(runner *v1alpha1.ServiceRunner) string {
+	if runner.Spec.Executor == nil || runner.Spec.Executor.Name == "" {
+		return JobExecutorName
+	}
+	return runner.Spec.Executor.Name
+}
+
+// DecodeOutputs decodes binding data from its JSON envelope: an object of
+// string values.
+func DecodeOutputs(raw []byte) (map[string]string, error) {
+	outputs := map[string]string{}
+	if err := json.Unmarshal(raw, &outputs); err != nil {
+		return nil, fmt.Errorf("malformed binding data: %v", err)
+	}
+	return outputs, nil
+}
+
+// ParseRetryAfter decodes a Retry-After header, in seconds or as an HTTP
+// date, into how long to wait; it is 0 when the header is missing, malformed
+// or already past.
+func ParseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,258 @@
+package resolve
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// stubExecutor runs operations in memory: every launched run stays Running
+// until its state is set.
+type stubExecutor struct {
+	launched  []Operation
+	states    map[string]RunState
+	outputs   map[string]string
+	cancelled []string
+}
+
+func newStubExecutor() *stubExecutor {
+	return &stubExecutor{states: map[string]RunState{}}
+}
+
+func (e *stubExecutor) Launch(_ context.Context, _ *v1alpha1.ServiceRunner, op Operation) (string, error) {
+	if _, ok := e.states[op.ID]; !ok {
+		e.launched = append(e.launched, op)
+		e.states[op.ID] = RunRunning
+	}
+	return op.ID, nil
+}
+
+func (e *stubExecutor) Poll(_ context.Context, _ *v1alpha1.ServiceRunner, ref string) (RunStatus, error) {
+	state, ok := e.states[ref]
+	if !ok {
+		return RunStatus{}, NotFound("run %s not found", ref)
+	}
+	return RunStatus{State: state, Message: "stub " + string(state)}, nil
+}
+
+func (e *stubExecutor) Outputs(context.Context, *v1alpha1.ServiceRunner, string) (map[string]string, error) {
+	return e.outputs, nil
+}
+
+func (e *stubExecutor) Cancel(_ context.Context, _ *v1alpha1.ServiceRunner, ref string) error {
+	e.cancelled = append(e.cancelled, ref)
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	executors := newTestExecutors(newTestClient(t), nil)
+	if _, err := executors.Get(""); err != nil {
+		t.Errorf("Get(\"\") error = %v, want the job executor", err)
+	}
+	if _, err := executors.Get("missing"); Classify(err) != ErrorInvalidSpec {
+		t.Errorf("Get(\"missing\") error = %v, want an invalid spec", err)
+	}
+	executors.Register("stub", newStubExecutor())
+	if watches := executors.Watches(); len(watches) != 1 {
+		t.Errorf("Watches() = %v, want the jobs only", watches)
+	} else if _, ok := watches[0].(*batchv1.Job); !ok {
+		t.Errorf("Watches() = %v, want the jobs only", watches)
+	}
+}
+
+func TestAdvanceWithExecutor(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_NEW)
+	runner.Spec.ServiceImage.CrudImage = ""
+	runner.Spec.Executor = &v1alpha1.ServiceRunnerExecutor{Name: "stub"}
+	runner.Spec.ServiceParam = map[string]string{"size": "small"}
+	c := newTestClient(t, runner)
+	stub := newStubExecutor()
+	stub.outputs = map[string]string{"host": "db.example.com"}
+	executors := newTestExecutors(c, nil)
+	executors.Register("stub", stub)
+
+	steps := []struct {
+		finish RunState
+		want   string
+	}{
+		{"", PIPELINE_CREATE},
+		{RunSucceeded, PIPELINE_READ},
+		{RunSucceeded, PIPELINE_READY},
+	}
+	for _, step := range steps {
+		if step.finish != "" {
+			stub.states[runner.Status.Operation.Job] = step.finish
+		}
+		if _, err := Advance(ctx, runner, c, executors); err != nil {
+			t.Fatalf("Advance() error = %v", err)
+		}
+		if runner.Status.State != step.want {
+			t.Fatalf("runner in %q, want %q", runner.Status.State, step.want)
+		}
+	}
+
+	if len(stub.launched) != 2 || stub.launched[0].ID != "db-create-1" || stub.launched[1].Name != OPERATION_READ {
+		t.Fatalf("launched %+v, want create then read", stub.launched)
+	}
+	if stub.launched[0].Params["size"] != "small" {
+		t.Errorf("create params = %v, want the spec parameters", stub.launched[0].Params)
+	}
+	if runner.Status.Operation.Executor != "stub" {
+		t.Errorf("operation = %+v, want it launched by the stub executor", runner.Status.Operation)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: "db"}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["host"]) != "db.example.com" {
+		t.Errorf("binding = %v, want the executor outputs", secret.Data)
+	}
+	jobs := &batchv1.JobList{}
+	if err := c.List(ctx, jobs); err != nil || len(jobs.Items) != 0 {
+		t.Errorf("jobs = %v, %v; want none", jobs.Items, err)
+	}
+}
+
+func TestAdvancePollsLaunchingExecutor(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_CREATE)
+	runner.Status.Operation.Executor = "stub"
+	c := newTestClient(t, runner)
+	stub := newStubExecutor()
+	stub.states["db-create-1"] = RunFailed
+	executors := newTestExecutors(c, nil)
+	executors.Register("stub", stub)
+
+	// the runner now selects jobs, but its create ran with the stub
+	_, err := Advance(ctx, runner, c, executors)
+	if Classify(err) != ErrorJobFailed || runner.Status.State != PIPELINE_FAILED {
+		t.Fatalf("Advance() = %v in %q, want the stub failure", err, runner.Status.State)
+	}
+}
+
+func TestAdvanceRequeuesUnwatchedRuns(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_CREATE)
+	runner.Status.Operation.Executor = "stub"
+	c := newTestClient(t, runner)
+	stub := newStubExecutor()
+	stub.states["db-create-1"] = RunRunning
+	executors := newTestExecutors(c, nil)
+	executors.Register("stub", stub)
+
+	// nothing is reconciled as the stub runs progress: they are polled
+	res, err := Advance(ctx, runner, c, executors)
+	if err != nil || res.RequeueAfter != PollInterval || runner.Status.State != PIPELINE_CREATE {
+		t.Fatalf("Advance() = %+v, %v in %q; want a poll after %v", res, err, runner.Status.State, PollInterval)
+	}
+}
+
+func TestAdvanceRequeuesUnwatchedJobs(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_CREATE)
+	c := newTestClient(t, runner, newTestJob("db-create-1"))
+	executors := newTestExecutors(c, nil)
+
+	if res, err := Advance(ctx, runner, c, executors); err != nil || res.RequeueAfter != 0 {
+		t.Fatalf("Advance() = %+v, %v; want to wait for the job to be watched", res, err)
+	}
+	executors.Unwatch(JobExecutorName)
+	if res, err := Advance(ctx, runner, c, executors); err != nil || res.RequeueAfter != PollInterval {
+		t.Fatalf("Advance() = %+v, %v; want a poll after %v", res, err, PollInterval)
+	}
+}
+
+func TestReadNamesCreatedService(t *testing.T) {
+	ctx := context.Background()
+
+	// the outputs of the create are those of its job
+	runner := newTestRunner(PIPELINE_CREATE)
+	c := newTestClient(t, runner, newTestJob("db-create-1"))
+	finishJob(t, c, "db-create-1", batchv1.JobComplete, "")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorNotFound || runner.Status.State != PIPELINE_CREATE {
+		t.Fatalf("Advance() without the pod of the create = %v in %q, want to wait for it", err, runner.Status.State)
+	}
+
+	// other executors aren't asked: their outputs are those of reads
+	runner = newTestRunner(PIPELINE_CREATE)
+	runner.Status.Operation.Executor = "stub"
+	c = newTestClient(t, runner)
+	stub := newStubExecutor()
+	stub.states["db-create-1"] = RunSucceeded
+	stub.outputs = map[string]string{ServiceIDOutput: "db-42"}
+	executors := newTestExecutors(c, nil)
+	executors.Register("stub", stub)
+	if _, err := Advance(ctx, runner, c, executors); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_READ || runner.Status.ServiceId != "" {
+		t.Errorf("runner = %+v, want reading a service yet unnamed", runner.Status)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	ctx := context.Background()
+	stub := newStubExecutor()
+	executors := NewRegistry()
+	executors.Register("stub", stub)
+
+	original := newTestRunner(PIPELINE_CREATE)
+	original.Status.Operation.Executor = "stub"
+
+	same := original.DeepCopy()
+	if err := Release(ctx, executors, original, same); err != nil || len(stub.cancelled) != 0 {
+		t.Fatalf("Release() = %v, cancelled %v; want the current run kept", err, stub.cancelled)
+	}
+
+	moved := original.DeepCopy()
+	moved.Status.Operation = &v1alpha1.ServiceRunnerOperation{Name: OPERATION_READ, Job: "db-read-1", Executor: "stub"}
+	if err := Release(ctx, executors, original, moved); err != nil || len(stub.cancelled) != 1 || stub.cancelled[0] != "db-create-1" {
+		t.Fatalf("Release() = %v, cancelled %v; want the create run cancelled", err, stub.cancelled)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"10", 10 * time.Second},
+		{"-1", 0},
+		{"soon", 0},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := ParseRetryAfter(tt.value); got != tt.want {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+	later := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := ParseRetryAfter(later); got <= 59*time.Minute || got > time.Hour {
+		t.Errorf("ParseRetryAfter(%q) = %v, want about an hour", later, got)
+	}
+}
+
+func TestJobExecutorCancel(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_READ)
+	c := newTestClient(t, newTestJob("db-create-1"))
+	e := NewJobExecutor(c, nil, nil, "")
+
+	if err := e.Cancel(ctx, runner, "db-create-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Poll(ctx, runner, "db-create-1"); Classify(err) != ErrorNotFound {
+		t.Fatalf("Poll() error = %v, want the job gone", err)
+	}
+	if err := e.Cancel(ctx, runner, "db-create-1"); err != nil {
+		t.Fatalf("Cancel() of a gone job = %v, want no error", err)
+	}
+}
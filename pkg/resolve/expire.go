@@ -0,0 +1,188 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// MaxTTLAnnotation caps the TTL of the runners of a namespace, e.g. "72h";
+// runners without a TTL get that one.
+const MaxTTLAnnotation = "servicerunner.io/max-ttl"
+
+// MaxTTLRefresh is how long the max TTL of a namespace is cached before the
+// namespace is read again.
+const MaxTTLRefresh = 5 * time.Minute
+
+// ExpiryWarning is how long before a runner expires its Expired condition
+// warns about it.
+const ExpiryWarning = time.Hour
+
+// Reasons of the Expired condition.
+const (
+	ReasonExpiringSoon = "ExpiringSoon"
+	ReasonExpired      = "Expired"
+)
+
+// expiry returns when runner expires, if ever: the earliest of its TTL,
+// spec.expiresAt and the maximum TTL of its namespace.
+func (p *Pipeline) expiry(ctx context.Context) (*time.Time, error) {
+	runner := p.serviceRunner
+	var expiresAt *time.Time
+	earliest := func(t time.Time) {
+		if expiresAt == nil || t.Before(*expiresAt) {
+			expiresAt = &t
+		}
+	}
+	if runner.Spec.TTL != nil {
+		earliest(runner.CreationTimestamp.Add(runner.Spec.TTL.Duration))
+	}
+	if runner.Spec.ExpiresAt != nil {
+		earliest(runner.Spec.ExpiresAt.Time)
+	}
+
+	value, ok, err := p.maxTTL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		max, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, InvalidSpec("annotation %s of namespace %s is not a duration: %v", MaxTTLAnnotation, runner.Namespace, err)
+		}
+		earliest(runner.CreationTimestamp.Add(max))
+	}
+	return expiresAt, nil
+}
+
+// namespaceTTL is the max TTL annotation of a namespace, as read at readAt.
+type namespaceTTL struct {
+	value  string
+	set    bool
+	readAt time.Time
+}
+
+// maxTTL returns the max TTL annotation of the namespace of the runner, if
+// set.  Namespaces aren't cached by the manager, not to watch them all for
+// one annotation, so it is read at most every MaxTTLRefresh.
+func (p *Pipeline) maxTTL(ctx context.Context) (string, bool, error) {
+	name := p.serviceRunner.Namespace
+	r := p.executors
+	r.maxTTLsMu.Lock()
+	cached, ok := r.maxTTLs[name]
+	r.maxTTLsMu.Unlock()
+	if ok && time.Since(cached.readAt) < MaxTTLRefresh {
+		return cached.value, cached.set, nil
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := p.reader().Get(ctx, client.ObjectKey{Name: name}, namespace); err != nil && !apierrors.IsNotFound(err) {
+		return "", false, err
+	}
+	cached = namespaceTTL{readAt: time.Now()}
+	cached.value, cached.set = namespace.Annotations[MaxTTLAnnotation]
+	r.maxTTLsMu.Lock()
+	r.maxTTLs[name] = cached
+	r.maxTTLsMu.Unlock()
+	return cached.value, cached.set, nil
+}
+
+// setExpired reports the expiry of runner.
+func setExpired(runner *v1alpha1.ServiceRunner, status metav1.ConditionStatus, reason, format string, args ...interface{}) {
+	meta.SetStatusCondition(&runner.Status.Conditions, metav1.Condition{
+		Type:               v1alpha1.ConditionExpired,
+		Status:             status,
+		ObservedGeneration: runner.Generation,
+		Reason:             reason,
+		Message:            fmt.Sprintf(format, args...),
+	})
+}
+
+// expire records when the runner expires, warning about it beforehand, and
+// deletes the runner once it expired unless its expiration policy only
+// deprovisions it; that is left to the state machine.  It returns how long
+// until the expiry needs looking at again.
+func (p *Pipeline) expire(ctx context.Context) (time.Duration, error) {
+	runner := p.serviceRunner
+	expiresAt, err := p.expiry(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if expiresAt == nil {
+		runner.Status.ExpiresAt = nil
+		meta.RemoveStatusCondition(&runner.Status.Conditions, v1alpha1.ConditionExpired)
+		return 0, nil
+	}
+
+	runner.Status.ExpiresAt = &metav1.Time{Time: *expiresAt}
+	at := expiresAt.UTC().Format(time.RFC3339)
+	left := time.Until(*expiresAt)
+	switch {
+	case left <= 0:
+		setExpired(runner, metav1.ConditionTrue, ReasonExpired, "the runner expired at %s", at)
+		if runner.Spec.ExpirationPolicy != v1alpha1.ExpirationDeprovision && runner.DeletionTimestamp.IsZero() {
+			if err := p.client.Delete(ctx, runner); err != nil && !apierrors.IsNotFound(err) {
+				return 0, err
+			}
+		}
+		return 0, nil
+	case left <= ExpiryWarning:
+		setExpired(runner, metav1.ConditionFalse, ReasonExpiringSoon, "the runner expires at %s", at)
+		return left, nil
+	default:
+		meta.RemoveStatusCondition(&runner.Status.Conditions, v1alpha1.ConditionExpired)
+		return left - ExpiryWarning, nil
+	}
+}
+
+// sooner returns res, requeued after wait at the latest.
+func sooner(res ctrl.Result, wait time.Duration) ctrl.Result {
+	if wait > 0 && (res.RequeueAfter == 0 || wait < res.RequeueAfter) {
+		res.RequeueAfter = wait
+	}
+	return res
+}
+
+// Expired represents a runner whose service was deprovisioned once it
+// expired; the runner is kept until deleted, or revived by a spec change
+// pushing its expiry back.
+type Expired struct {
+	Pipeline
+}
+
+var _ Resolver = &Expired{}
+
+func MakeExpired(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Expired {
+	return &Expired{
+		Pipeline: Pipeline{
+			serviceRunner: runner,
+			client:        client,
+			executors:     executors,
+		},
+	}
+}
+
+// We shouldn't need to make a job in this state
+func (*Expired) JobName() string {
+	return ""
+}
+
+// Resolve withdraws the binding of the service, which is gone or no longer
+// managed by the runner.
+func (e *Expired) Resolve(ctx context.Context) (ctrl.Result, error) {
+	secret := &corev1.Secret{}
+	secret.Name, secret.Namespace = e.serviceRunner.Name, e.serviceRunner.Namespace
+	if err := e.client.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	e.serviceRunner.Status.Binding = nil
+	return ctrl.Result{}, nil
+}
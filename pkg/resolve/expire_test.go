@@ -0,0 +1,221 @@
+package resolve
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newNamespace(maxTTL string) *corev1.Namespace {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps"}}
+	if maxTTL != "" {
+		namespace.Annotations = map[string]string{MaxTTLAnnotation: maxTTL}
+	}
+	return namespace
+}
+
+func TestExpiry(t *testing.T) {
+	ctx := context.Background()
+	created := metav1.NewTime(time.Now().Add(-90 * time.Minute).Truncate(time.Second))
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		expiresAt time.Duration
+		maxTTL    string
+		want      time.Duration
+		condition string
+	}{
+		{"none", 0, 0, "", 0, ""},
+		{"far", 4 * time.Hour, 0, "", 4 * time.Hour, ""},
+		{"soon", 2 * time.Hour, 0, "", 2 * time.Hour, "False/" + ReasonExpiringSoon},
+		{"expires at", 4 * time.Hour, 100 * time.Minute, "", 100 * time.Minute, "False/" + ReasonExpiringSoon},
+		{"namespace max", 4 * time.Hour, 0, "3h", 3 * time.Hour, ""},
+		{"namespace max without ttl", 0, 0, "2h", 2 * time.Hour, "False/" + ReasonExpiringSoon},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := newTestRunner(PIPELINE_READY)
+			runner.CreationTimestamp = created
+			if tt.ttl != 0 {
+				runner.Spec.TTL = &metav1.Duration{Duration: tt.ttl}
+			}
+			if tt.expiresAt != 0 {
+				runner.Spec.ExpiresAt = &metav1.Time{Time: created.Add(tt.expiresAt)}
+			}
+			c := newTestClient(t, runner, newNamespace(tt.maxTTL))
+
+			res, err := Advance(ctx, runner, c, newTestExecutors(c, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := runner.Status.ExpiresAt
+			if tt.want == 0 {
+				if got != nil || res.RequeueAfter != 0 {
+					t.Errorf("expiry = %v, requeue after %s; want none", got, res.RequeueAfter)
+				}
+				return
+			}
+			if got == nil || !got.Time.Equal(created.Add(tt.want)) {
+				t.Errorf("expiry = %v, want %s", got, created.Add(tt.want))
+			}
+			if res.RequeueAfter <= 0 || res.RequeueAfter > tt.want {
+				t.Errorf("requeue after %s, want the expiry looked at again", res.RequeueAfter)
+			}
+			if conditionOf(runner, v1alpha1.ConditionExpired) != tt.condition {
+				t.Errorf("Expired = %q, want %q", conditionOf(runner, v1alpha1.ConditionExpired), tt.condition)
+			}
+		})
+	}
+}
+
+func TestExpiryInvalidMaxTTL(t *testing.T) {
+	runner := newTestRunner(PIPELINE_READY)
+	c := newTestClient(t, runner, newNamespace("three days"))
+	if _, err := Advance(context.Background(), runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorInvalidSpec {
+		t.Errorf("Advance() = %v, want an invalid max TTL", err)
+	}
+}
+
+func TestExpiryDeletesRunner(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_READY)
+	runner.Spec.ExpiresAt = &metav1.Time{Time: time.Now().Add(-time.Minute)}
+	c := newTestClient(t, runner)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if conditionOf(runner, v1alpha1.ConditionExpired) != "True/"+ReasonExpired {
+		t.Errorf("Expired = %q, want expired", conditionOf(runner, v1alpha1.ConditionExpired))
+	}
+	latest := &v1alpha1.ServiceRunner{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(runner), latest); err != nil || latest.DeletionTimestamp.IsZero() {
+		t.Errorf("runner = %+v, %v; want it being deleted", latest.ObjectMeta, err)
+	}
+}
+
+func TestExpiryDeprovisions(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_READY)
+	runner.Spec.ExpirationPolicy = v1alpha1.ExpirationDeprovision
+	runner.Spec.ExpiresAt = &metav1.Time{Time: time.Now().Add(-time.Minute)}
+	runner.Status.Binding = &v1alpha1.ServiceRunnerBindingRef{Name: "db"}
+	binding := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "apps"}}
+	c := newTestClient(t, runner, binding)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_DELETE || runner.Status.Operation.Job != "db-delete-1" {
+		t.Fatalf("runner = %+v, want deprovisioning", runner.Status)
+	}
+	finishJob(t, c, "db-delete-1", batchv1.JobComplete, "")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_EXPIRED || runner.Status.Binding != nil || len(runner.Finalizers) == 0 {
+		t.Fatalf("runner = %+v, want it kept expired", runner.Status)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(binding), binding); Classify(err) != ErrorNotFound {
+		t.Errorf("binding = %v, want it withdrawn", err)
+	}
+
+	// pushing the expiry back provisions the service again
+	runner.Generation = 2
+	runner.Spec.ExpiresAt = &metav1.Time{Time: time.Now().Add(24 * time.Hour)}
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_CREATE || runner.Status.Operation.Job != "db-create-2" || conditionOf(runner, v1alpha1.ConditionExpired) != "" {
+		t.Errorf("runner = %+v, want it created anew", runner.Status)
+	}
+}
+
+func TestExpiryRetriesFailedDeprovision(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_READY)
+	runner.Spec.ExpirationPolicy = v1alpha1.ExpirationDeprovision
+	runner.Spec.ExpiresAt = &metav1.Time{Time: time.Now().Add(-time.Minute)}
+	c := newTestClient(t, runner)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	finishJob(t, c, "db-delete-1", batchv1.JobFailed, "BackoffLimitExceeded")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorJobFailed || runner.Status.State != PIPELINE_FAILED {
+		t.Fatalf("Advance() = %v in %q, want failed", err, runner.Status.State)
+	}
+
+	// the failed delete is launched again after a backoff
+	res, err := Advance(ctx, runner, c, newTestExecutors(c, nil))
+	if err != nil || runner.Status.State != PIPELINE_FAILED || res.RequeueAfter <= 0 || res.RequeueAfter > DeleteRetryDelay {
+		t.Fatalf("Advance() = %+v, %v in %q, want to wait for the retry", res, err, runner.Status.State)
+	}
+	failedAt := metav1.NewTime(runner.Status.Operation.FinishedAt.Add(-DeleteRetryDelay))
+	runner.Status.Operation.FinishedAt = &failedAt
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_DELETE || runner.Status.Operation.Job != "db-delete-1-2" {
+		t.Fatalf("runner = %+v, want deprovisioning again", runner.Status)
+	}
+	finishJob(t, c, "db-delete-1-2", batchv1.JobComplete, "")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_EXPIRED {
+		t.Errorf("runner = %+v, want it expired", runner.Status)
+	}
+}
+
+func TestExpiryReadsNamespaceUncached(t *testing.T) {
+	runner := newTestRunner(PIPELINE_READY)
+	c := newTestClient(t, runner, newNamespace("2h"))
+	executors := newTestExecutors(c, nil)
+	// the client of runners doesn't serve namespaces, the reader does
+	executors.Reader = c
+	p := &Pipeline{serviceRunner: runner, client: newTestClient(t, runner), executors: executors}
+
+	expiresAt, err := p.expiry(context.Background())
+	if err != nil || expiresAt == nil || !expiresAt.Equal(runner.CreationTimestamp.Add(2*time.Hour)) {
+		t.Errorf("expiry() = %v, %v; want the max TTL of the namespace", expiresAt, err)
+	}
+}
+
+// countingReader counts the objects read through it.
+type countingReader struct {
+	client.Reader
+	gets int
+}
+
+func (r *countingReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	r.gets++
+	return r.Reader.Get(ctx, key, obj)
+}
+
+func TestExpiryCachesNamespace(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_READY)
+	c := newTestClient(t, runner, newNamespace("2h"))
+	reader := &countingReader{Reader: c}
+	executors := newTestExecutors(c, nil)
+	executors.Reader = reader
+
+	for i := 0; i < 3; i++ {
+		if _, err := Advance(ctx, runner, c, executors); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reader.gets != 1 {
+		t.Errorf("read the namespace %d times, want once", reader.gets)
+	}
+	if runner.Status.ExpiresAt == nil || !runner.Status.ExpiresAt.Equal(&metav1.Time{Time: runner.CreationTimestamp.Add(2 * time.Hour)}) {
+		t.Errorf("expiresAt = %v, want the max TTL of the namespace", runner.Status.ExpiresAt)
+	}
+}
@@ -0,0 +1,48 @@
+package resolve
+
+import (
+	"context"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Failed represents the pipeline stage where an operation failed; the runner
+// stays there until its spec changes or it is deleted
+type Failed struct {
+	Pipeline
+}
+
+var _ Resolver = &Failed{}
+
+func MakeFailed(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Failed {
+	return &Failed{
+		Pipeline: Pipeline{
+			serviceRunner: runner,
+			client:        client,
+			executors:     executors,
+		},
+	}
+}
+
+// We shouldn't need to make a job in this state
+func (*Failed) JobName() string {
+	return ""
+}
+
+// Resolve keeps the failed job around for inspection, and reports whether
+// a failed update can be rolled back
+func (f *Failed) Resolve(context.Context) (ctrl.Result, error) {
+	runner := f.serviceRunner
+	switch {
+	case runner.Status.State == PIPELINE_ROLLBACK:
+		setRolledBack(runner, metav1.ConditionFalse, ReasonRollbackFailed,
+			"rolling generation %d back to the parameters of generation %d failed", runner.Generation, runner.Status.LastReady.Generation)
+	case runner.Status.State == PIPELINE_UPDATE && rollbackAvailable.Check(runner):
+		setRolledBack(runner, metav1.ConditionFalse, ReasonRollbackAvailable,
+			"annotate the runner with %s to roll generation %d back to the parameters of generation %d", RollbackAnnotation, runner.Generation, runner.Status.LastReady.Generation)
+	}
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,58 @@
+package resolve
+
+import (
+	"context"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// STAGE_IMPORT names the runs of the Importing stage, whichever operation
+// imports the service.
+const STAGE_IMPORT = "import"
+
+// Import represents the pipeline stage adopting the service of spec.import
+// instead of creating one.
+type Import struct {
+	Pipeline
+}
+
+func MakeImport(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Import {
+	return &Import{
+		Pipeline: Pipeline{
+			serviceRunner: runner,
+			client:        client,
+			executors:     executors,
+		},
+	}
+}
+
+var _ Resolver = &Import{}
+
+func (i *Import) JobName() string {
+	return stageJobName(i.serviceRunner, STAGE_IMPORT, i.serviceRunner.Generation)
+}
+
+// Params returns the parameters of the current generation
+func (i *Import) Params() map[string]string {
+	return i.serviceRunner.Spec.ServiceParam
+}
+
+// Resolve launches the import of the service of the current generation; its
+// outputs are published once it succeeded, as those of a read.
+func (i *Import) Resolve(ctx context.Context) (ctrl.Result, error) {
+	runner := i.serviceRunner
+	name := runner.Spec.Import.Operation
+	if name == "" {
+		name = OPERATION_IMPORT
+	}
+	runner.Status.ServiceId = runner.Spec.Import.ServiceID
+	op := Operation{Name: name, ID: i.JobName(), Params: i.Params()}
+	if err := i.Launch(ctx, op); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	i.applying()
+	return ctrl.Result{}, nil
+}
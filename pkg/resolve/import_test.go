@@ -0,0 +1,120 @@
+package resolve
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// importingService makes runner import the service db-42 with the given
+// operation.
+func importingService(runner *v1alpha1.ServiceRunner, operation string) *v1alpha1.ServiceRunner {
+	runner.Spec.Import = &v1alpha1.ImportSpec{ServiceID: "db-42", Operation: operation}
+	runner.Spec.ServiceParam = map[string]string{"SIZE": "small"}
+	return runner
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	runner := importingService(newTestRunner(PIPELINE_NEW), "")
+	c := newTestClient(t, runner)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_IMPORT || runner.Status.Operation.Name != OPERATION_IMPORT || runner.Status.ServiceId != "db-42" {
+		t.Fatalf("runner = %+v, want importing db-42", runner.Status)
+	}
+	job := &batchv1.Job{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: "db-import-1"}, job); err != nil {
+		t.Fatal(err)
+	}
+	if command := job.Spec.Template.Spec.Containers[0].Command; command[0] != "/import" {
+		t.Errorf("import job runs %v, want /import", command)
+	}
+	if env := jobEnv(t, c, "db-import-1"); env["RUNNER_SERVICE_ID"] != "db-42" || env["SIZE"] != "small" {
+		t.Errorf("import job env = %v, want the service to import", env)
+	}
+
+	logs := finishRead(t, c, "db-import-1", `{"host":"db.apps.svc"}`)
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_READY || runner.Status.ObservedGeneration != 1 || runner.Status.LastReady == nil {
+		t.Fatalf("runner = %+v, want ready with the imported service", runner.Status)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: "db"}, secret); err != nil || string(secret.Data["host"]) != "db.apps.svc" {
+		t.Errorf("binding = %v, %v, want the outputs of the import", secret.Data, err)
+	}
+
+	// the imported service is updated as any other
+	runner.Generation = 2
+	runner.Spec.ServiceParam = map[string]string{"SIZE": "large"}
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_UPDATE || runner.Status.Operation.Job != "db-update-2" {
+		t.Errorf("runner = %+v, want updating the imported service", runner.Status)
+	}
+}
+
+func TestImportWithExecutor(t *testing.T) {
+	ctx := context.Background()
+	runner := importingService(newTestRunner(PIPELINE_NEW), OPERATION_READ)
+	runner.Spec.Executor = &v1alpha1.ServiceRunnerExecutor{Name: "stub"}
+	c := newTestClient(t, runner)
+	stub := newStubExecutor()
+	executors := newTestExecutors(c, nil)
+	executors.Register("stub", stub)
+
+	if _, err := Advance(ctx, runner, c, executors); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.launched) != 1 || stub.launched[0].Name != OPERATION_READ || stub.launched[0].ServiceID != "db-42" {
+		t.Fatalf("launched %+v, want a read of db-42", stub.launched)
+	}
+}
+
+func TestImportFailure(t *testing.T) {
+	ctx := context.Background()
+	runner := importingService(newTestRunner(PIPELINE_NEW), OPERATION_READ)
+	c := newTestClient(t, runner)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.Operation.Name != OPERATION_READ || runner.Status.Operation.Job != "db-import-1" {
+		t.Fatalf("runner = %+v, want importing with the read operation", runner.Status)
+	}
+	finishJob(t, c, "db-import-1", batchv1.JobFailed, "BackoffLimitExceeded")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorJobFailed || runner.Status.State != PIPELINE_FAILED {
+		t.Fatalf("Advance() = %v in %q, want the import failure", err, runner.Status.State)
+	}
+
+	// a fixed spec imports again
+	runner.Generation = 2
+	runner.Spec.Import.ServiceID = "db-43"
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_IMPORT || runner.Status.Operation.Job != "db-import-2" || runner.Status.ServiceId != "db-43" {
+		t.Fatalf("runner = %+v, want importing db-43", runner.Status)
+	}
+
+	// a service which wasn't adopted isn't deleted with the runner
+	finishJob(t, c, "db-import-2", batchv1.JobFailed, "BackoffLimitExceeded")
+	now := metav1.Now()
+	runner.DeletionTimestamp = &now
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_DELETED || len(runner.Finalizers) != 0 {
+		t.Errorf("runner = %+v, want deleted without running a delete", runner.Status)
+	}
+}
@@ -0,0 +1,59 @@
+package resolve
+
+import (
+	"context"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// OwnerUIDField indexes objects by the UIDs of their owners, so that the jobs
+// of a runner and the pods of a job are looked up without scanning.
+const OwnerUIDField = ".metadata.ownerReferences.uid"
+
+func ownerUIDs(obj client.Object) []string {
+	var uids []string
+	for _, owner := range obj.GetOwnerReferences() {
+		uids = append(uids, string(owner.UID))
+	}
+	return uids
+}
+
+// SetupIndexes registers the field indexes the pipeline queries rely on.
+func SetupIndexes(ctx context.Context, indexer client.FieldIndexer) error {
+	if err := indexer.IndexField(ctx, &batchv1.Job{}, OwnerUIDField, ownerUIDs); err != nil {
+		return err
+	}
+	return indexer.IndexField(ctx, &corev1.Pod{}, OwnerUIDField, ownerUIDs)
+}
+
+// CacheSelectors restricts the cached jobs and pods to those carrying
+// JobLabel, i.e. those the runners launched; no other job or pod in the
+// cluster is ever read.  Objects of other kinds read only here and there,
+// such as the capabilities caches, are read with the API reader rather than
+// through a restricted cache, which would report any other one missing.
+func CacheSelectors() cache.SelectorsByObject {
+	return cache.SelectorsByObject{
+		&batchv1.Job{}: labelled(JobLabel),
+		&corev1.Pod{}:  labelled(JobLabel),
+	}
+}
+
+func labelled(label string) cache.ObjectSelector {
+	exists, err := labels.NewRequirement(label, selection.Exists, nil)
+	if err != nil {
+		panic(err)
+	}
+	return cache.ObjectSelector{Label: labels.NewSelector().Add(*exists)}
+}
+
+// UncachedObjects lists the kinds the manager client reads from the API
+// server rather than a cache: runners only read Secrets here and there, and
+// caching them would take watching every Secret of the cluster.
+func UncachedObjects() []client.Object {
+	return []client.Object{&corev1.Secret{}}
+}
@@ -0,0 +1,101 @@
+package resolve
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newTestPod returns a succeeded pod owned by the job with the given UID.
+func newTestPod(namespace, name string, owner types.UID, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         namespace,
+			Labels:            labels,
+			OwnerReferences:   []metav1.OwnerReference{{APIVersion: "batch/v1", Kind: "Job", Name: name, UID: owner}},
+			CreationTimestamp: metav1.NewTime(time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)),
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodSucceeded},
+	}
+}
+
+func withPhase(pod *corev1.Pod, phase corev1.PodPhase) *corev1.Pod {
+	pod.Status.Phase = phase
+	return pod
+}
+
+func createdAfter(pod *corev1.Pod, d time.Duration) *corev1.Pod {
+	pod.CreationTimestamp = metav1.NewTime(pod.CreationTimestamp.Add(d))
+	return pod
+}
+
+func TestJobPod(t *testing.T) {
+	runner := newTestRunner(PIPELINE_READ)
+	job := newTestJob("db-read-1")
+	label := map[string]string{JobLabel: "db"}
+
+	tests := []struct {
+		name string
+		pods []client.Object
+		want string
+	}{
+		{
+			name: "pod of the job",
+			pods: []client.Object{newTestPod("apps", "db-read-1-x", job.UID, label)},
+			want: "db-read-1-x",
+		},
+		{
+			name: "pod of another job of the runner",
+			pods: []client.Object{newTestPod("apps", "db-create-1-x", "other-job-uid", label)},
+		},
+		{
+			name: "pod in another namespace",
+			pods: []client.Object{newTestPod("other", "db-read-1-x", job.UID, label)},
+		},
+		{
+			name: "pod without the runner label",
+			pods: []client.Object{newTestPod("apps", "db-read-1-x", job.UID, nil)},
+		},
+		{
+			name: "failed pod",
+			pods: []client.Object{withPhase(newTestPod("apps", "db-read-1-x", job.UID, label), corev1.PodFailed)},
+		},
+		{
+			name: "latest succeeded pod of a retried job",
+			pods: []client.Object{
+				newTestPod("apps", "db-read-1-a", job.UID, label),
+				createdAfter(newTestPod("apps", "db-read-1-b", job.UID, label), time.Minute),
+				withPhase(createdAfter(newTestPod("apps", "db-read-1-c", job.UID, label), 2*time.Minute), corev1.PodFailed),
+			},
+			want: "db-read-1-b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewJobExecutor(newTestClient(t, tt.pods...), nil, nil, "")
+			pod, err := e.jobPod(context.Background(), runner, job)
+			if tt.want == "" {
+				if Classify(err) != ErrorNotFound {
+					t.Fatalf("jobPod() = %v, %v; want not found", pod, err)
+				}
+				return
+			}
+			if err != nil || pod.Name != tt.want {
+				t.Fatalf("jobPod() = %v, %v; want %s", pod, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobTemplateLabelsPods(t *testing.T) {
+	job := newTestJobTemplate(newTestRunner(PIPELINE_READY), Operation{Name: OPERATION_READ, ID: "db-read-1"})
+	if job.Spec.Template.Labels[JobLabel] != "db" {
+		t.Fatalf("pod template labels = %v, want %s=db", job.Spec.Template.Labels, JobLabel)
+	}
+}
@@ -0,0 +1,432 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const CONTROL_PLANE_SECRET = "control-plane"
+
+// JobDeadline bounds how long an operation may run before it is considered
+// timed out.
+const JobDeadline = time.Hour
+
+const JobLabel = "servicerunner.io/job"
+
+// StepsVolume is shared by the steps of an operation, mounted at StepsDir.
+const (
+	StepsVolume = "steps"
+	StepsDir    = "/var/run/servicerunner.io/steps"
+)
+
+// JobExecutor runs operations as Jobs of the CRUD image of the runner, whose
+// command is the operation name ("/create", "/read", ...), unless
+// spec.serviceImage.operations configures another image or command; a read
+// outputs the binding data as the last line of its log.
+type JobExecutor struct {
+	client    client.Client
+	reader    client.Reader
+	logs      LogReader
+	clusterID string
+}
+
+var _ Executor = &JobExecutor{}
+
+// NewJobExecutor returns a JobExecutor creating jobs through client and
+// reading their output through logs.  The objects the manager doesn't cache,
+// such as the capabilities caches, are read through reader, or client when
+// nil.  Jobs are told they run in the cluster identified by clusterID.
+func NewJobExecutor(client client.Client, reader client.Reader, logs LogReader, clusterID string) *JobExecutor {
+	if reader == nil {
+		reader = client
+	}
+	return &JobExecutor{client: client, reader: reader, logs: logs, clusterID: clusterID}
+}
+
+// validateJobSpec checks the parts of the runner spec jobs are built from.
+func validateJobSpec(runner *v1alpha1.ServiceRunner, op Operation) error {
+	for name := range runner.Spec.ServiceImage.Operations {
+		if !contains(operations, name) {
+			return InvalidSpec("spec.serviceImage.operations has unknown operation %q (known: %v)", name, operations)
+		}
+	}
+	spec := runner.Spec.ServiceImage.Operations[op.Name]
+	image := operationImage(runner, op.Name)
+	if len(spec.Steps) == 0 && image == "" {
+		return InvalidSpec("spec.serviceImage.crudImage must be set, or an image for operation %s", op.Name)
+	}
+	names := map[string]bool{}
+	for _, step := range spec.Steps {
+		if step.Image == "" && image == "" {
+			return InvalidSpec("step %s of operation %s has no image, and neither the operation nor spec.serviceImage.crudImage set one", step.Name, op.Name)
+		}
+		if errs := validation.IsDNS1123Label(step.Name); len(errs) != 0 {
+			return InvalidSpec("step name %q of operation %s is invalid: %v", step.Name, op.Name, errs)
+		}
+		if names[step.Name] {
+			return InvalidSpec("step name %q of operation %s is not unique", step.Name, op.Name)
+		}
+		names[step.Name] = true
+	}
+	for key := range runner.Spec.ServiceParam {
+		if errs := validation.IsEnvVarName(key); len(errs) != 0 {
+			return InvalidSpec("spec.serviceParams key %q is not a valid environment variable name: %v", key, errs)
+		}
+	}
+	return nil
+}
+
+// Launch creates the job running op.  Jobs are named after op.ID, so
+// launching a job which already exists (e.g. because the status write
+// following a previous launch was lost) adopts it instead of running the
+// operation a second time.
+func (e *JobExecutor) Launch(ctx context.Context, runner *v1alpha1.ServiceRunner, op Operation) (string, error) {
+	if err := validateJobSpec(runner, op); err != nil {
+		return "", err
+	}
+	// deletions aren't checked: a runner refused its delete would never go
+	// away, while a delete the image can't run fails and is retried
+	if runner.Spec.ServiceImage.Capabilities && op.Name != OPERATION_DELETE {
+		image := operationImage(runner, op.Name)
+		caps, err := e.capabilities(ctx, runner, image)
+		if err != nil {
+			return "", err
+		}
+		if err := caps.Check(image, op); err != nil {
+			return "", err
+		}
+	}
+	if runner.Spec.State != nil {
+		if err := e.lockState(ctx, runner, op); err != nil {
+			return "", err
+		}
+		if err := e.ensureStateClaim(ctx, runner); err != nil {
+			return "", err
+		}
+	}
+	job := e.JobTemplate(runner, op)
+	err := e.client.Create(ctx, job)
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", err
+	}
+	return job.Name, nil
+}
+
+// Watches returns the kind of the runs.
+func (e *JobExecutor) Watches() []client.Object {
+	return []client.Object{&batchv1.Job{}}
+}
+
+func (e *JobExecutor) job(ctx context.Context, runner *v1alpha1.ServiceRunner, name string) (*batchv1.Job, error) {
+	job := &batchv1.Job{}
+	err := e.client.Get(ctx, client.ObjectKey{Namespace: runner.Namespace, Name: name}, job)
+	if apierrors.IsNotFound(err) {
+		return nil, NotFound("job %s not found", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Poll reports the state of the job; a job which ran past JobDeadline has
+// timed out.
+func (e *JobExecutor) Poll(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (RunStatus, error) {
+	job, err := e.job(ctx, runner, ref)
+	if err != nil {
+		return RunStatus{}, err
+	}
+	status := RunStatus{State: RunRunning}
+	if job.Status.Succeeded > 0 {
+		status.State = RunSucceeded
+	}
+	for _, cond := range job.Status.Conditions {
+		if status.State == RunSucceeded || cond.Type != batchv1.JobFailed || cond.Status != corev1.ConditionTrue {
+			continue
+		}
+		status = RunStatus{State: RunFailed, Message: fmt.Sprintf("job %s failed: %s", job.Name, cond.Message)}
+		if cond.Reason == "DeadlineExceeded" {
+			status.State = RunTimedOut
+		}
+		break
+	}
+	if len(job.Spec.Template.Spec.InitContainers) != 0 {
+		status.Steps, err = e.steps(ctx, runner, job, status.State == RunSucceeded)
+		if err != nil {
+			return RunStatus{}, err
+		}
+	}
+	return status, nil
+}
+
+// steps reports the progress of the steps of job from its latest pod.  Steps
+// run as init containers, but for the final one.
+func (e *JobExecutor) steps(ctx context.Context, runner *v1alpha1.ServiceRunner, job *batchv1.Job, succeeded bool) ([]v1alpha1.OperationStepStatus, error) {
+	template := job.Spec.Template.Spec
+	containers := append(append([]corev1.Container{}, template.InitContainers...), template.Containers...)
+	steps := make([]v1alpha1.OperationStepStatus, len(containers))
+	for i, c := range containers {
+		steps[i] = v1alpha1.OperationStepStatus{Name: c.Name, State: StepWaiting}
+		if succeeded {
+			// the pods of a finished job may be gone
+			steps[i].State = StepSucceeded
+		}
+	}
+	if succeeded {
+		return steps, nil
+	}
+
+	pod, err := e.latestPod(ctx, runner, job, func(*corev1.Pod) bool { return true })
+	if err != nil || pod == nil {
+		return steps, err
+	}
+	statuses := map[string]corev1.ContainerStatus{}
+	for _, s := range append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...) {
+		statuses[s.Name] = s
+	}
+	for i := range steps {
+		s, ok := statuses[steps[i].Name]
+		switch {
+		case !ok:
+		case s.State.Terminated != nil && s.State.Terminated.ExitCode == 0:
+			steps[i].State = StepSucceeded
+		case s.State.Terminated != nil:
+			steps[i].State = StepFailed
+			steps[i].Message = fmt.Sprintf("exited with %d: %s", s.State.Terminated.ExitCode, s.State.Terminated.Message)
+		case s.State.Running != nil:
+			steps[i].State = StepRunning
+		case s.LastTerminationState.Terminated != nil:
+			// waiting to be restarted after a failure
+			steps[i].State = StepFailed
+			steps[i].Message = fmt.Sprintf("exited with %d, restarting", s.LastTerminationState.Terminated.ExitCode)
+		}
+	}
+	return steps, nil
+}
+
+// Outputs decodes the last line logged by the pod which ran the job to
+// completion.
+func (e *JobExecutor) Outputs(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) (map[string]string, error) {
+	job, err := e.job(ctx, runner, ref)
+	if err != nil {
+		return nil, err
+	}
+	pod, err := e.jobPod(ctx, runner, job)
+	if err != nil {
+		return nil, err
+	}
+	log, err := e.logs.TailLog(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := DecodeOutputs(log)
+	if err != nil {
+		return nil, JobFailed("job %s: %v", job.Name, err)
+	}
+	return outputs, nil
+}
+
+// Cancel deletes the job along with its pods.
+func (e *JobExecutor) Cancel(ctx context.Context, runner *v1alpha1.ServiceRunner, ref string) error {
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: runner.Namespace, Name: ref}}
+	err := e.client.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+	return client.IgnoreNotFound(err)
+}
+
+// ownedBy reports whether obj is owned by the object with the given UID.
+func ownedBy(obj client.Object, uid types.UID) bool {
+	for _, owner := range obj.GetOwnerReferences() {
+		if owner.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// jobPod finds the pod which ran job to completion: when the job was retried
+// with new pods, the latest one which succeeded.  The lookup is confined to
+// the namespace and label of the runner, and served from the owner index;
+// owners are still checked, as readers without the index ignore field
+// selectors.
+func (e *JobExecutor) jobPod(ctx context.Context, runner *v1alpha1.ServiceRunner, job *batchv1.Job) (*corev1.Pod, error) {
+	latest, err := e.latestPod(ctx, runner, job, func(pod *corev1.Pod) bool {
+		return pod.Status.Phase == corev1.PodSucceeded
+	})
+	if err != nil {
+		return nil, err
+	}
+	if latest == nil {
+		return nil, NotFound("no succeeded pod found for job %s", job.Name)
+	}
+	return latest, nil
+}
+
+// latestPod returns the latest pod of job matching filter, if any.
+func (e *JobExecutor) latestPod(ctx context.Context, runner *v1alpha1.ServiceRunner, job *batchv1.Job, filter func(*corev1.Pod) bool) (*corev1.Pod, error) {
+	podList := corev1.PodList{}
+	err := e.client.List(ctx, &podList,
+		client.InNamespace(runner.Namespace),
+		client.MatchingLabels{JobLabel: runner.Name},
+		client.MatchingFields{OwnerUIDField: string(job.UID)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	var latest *corev1.Pod
+	for i := range podList.Items {
+		pod := &podList.Items[i]
+		if !ownedBy(pod, job.UID) || !filter(pod) {
+			continue
+		}
+		if latest == nil || latest.CreationTimestamp.Before(&pod.CreationTimestamp) ||
+			(latest.CreationTimestamp.Equal(&pod.CreationTimestamp) && latest.Name < pod.Name) {
+			latest = pod
+		}
+	}
+	return latest, nil
+}
+
+// newJob returns the bare job of runner with the given name.
+func newJob(runner *v1alpha1.ServiceRunner, name string) *batchv1.Job {
+	job := &batchv1.Job{}
+	job.Name = name
+	job.Namespace = runner.Namespace
+	job.Labels = map[string]string{
+		JobLabel: runner.Name,
+	}
+	// pods carry the label too, so that they are cached (see CacheSelectors)
+	job.Spec.Template.Labels = map[string]string{
+		JobLabel: runner.Name,
+	}
+	job.OwnerReferences = []metav1.OwnerReference{RunnerOwner(runner)}
+	return job
+}
+
+// JobTemplate builds the job running op for runner.
+func (e *JobExecutor) JobTemplate(runner *v1alpha1.ServiceRunner, op Operation) *batchv1.Job {
+	job := newJob(runner, op.ID)
+	spec := runner.Spec.ServiceImage.Operations[op.Name]
+	command := spec.Command
+	if len(command) == 0 {
+		command = DefaultCommand(op.Name)
+	}
+	containers := []corev1.Container{
+		{
+			Name:    "runner",
+			Image:   operationImage(runner, op.Name),
+			Env:     envVars(op.Params),
+			Command: command,
+			Args:    spec.Args,
+		},
+	}
+	if len(spec.Steps) != 0 {
+		containers = stepContainers(runner, op, spec.Steps)
+		job.Spec.Template.Spec.Volumes = []corev1.Volume{
+			{
+				Name:         StepsVolume,
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			},
+		}
+	}
+	if len(runner.Spec.ControlPlaneSecret) != 0 {
+		job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name: CONTROL_PLANE_SECRET,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: runner.Spec.ControlPlaneSecret,
+				},
+			},
+		})
+		for i := range containers {
+			containers[i].VolumeMounts = append(containers[i].VolumeMounts, corev1.VolumeMount{
+				MountPath: "/",
+				Name:      CONTROL_PLANE_SECRET,
+			})
+		}
+	}
+	if op.Name == OPERATION_UPDATE {
+		withUpdateContext(runner, op, job, containers)
+	}
+	withRunnerContext(runner, op, e.clusterID, job, containers)
+	var initContainers []corev1.Container
+	if runner.Spec.State != nil {
+		initContainers = append(initContainers, withState(runner, op, job, containers))
+	}
+	// all steps but the final one run in order as init containers; the
+	// final one logs the output of the operation
+	job.Spec.Template.Spec.InitContainers = append(initContainers, containers[:len(containers)-1]...)
+	job.Spec.Template.Spec.Containers = containers[len(containers)-1:]
+	job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyOnFailure
+	deadline := int64(JobDeadline.Seconds())
+	job.Spec.ActiveDeadlineSeconds = &deadline
+	return job
+}
+
+// DefaultCommand is the command running operation in an image which doesn't
+// configure one: /<operation>, e.g. /create.
+func DefaultCommand(operation string) []string {
+	return []string{"/" + operation}
+}
+
+// operationImage returns the image running operation: its own, or the CRUD
+// image.
+func operationImage(runner *v1alpha1.ServiceRunner, operation string) string {
+	if image := runner.Spec.ServiceImage.Operations[operation].Image; image != "" {
+		return image
+	}
+	return runner.Spec.ServiceImage.CrudImage
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stepContainers builds the containers running the steps of op.
+func stepContainers(runner *v1alpha1.ServiceRunner, op Operation, steps []v1alpha1.OperationStep) []corev1.Container {
+	var containers []corev1.Container
+	for _, step := range steps {
+		image := step.Image
+		if image == "" {
+			image = operationImage(runner, op.Name)
+		}
+		env := append(envVars(op.Params),
+			corev1.EnvVar{Name: "STEPS_DIR", Value: StepsDir},
+			corev1.EnvVar{Name: "STEP_OUTPUT", Value: StepsDir + "/" + step.Name},
+		)
+		containers = append(containers, corev1.Container{
+			Name:         step.Name,
+			Image:        image,
+			Command:      step.Command,
+			Args:         step.Args,
+			Env:          env,
+			VolumeMounts: []corev1.VolumeMount{{Name: StepsVolume, MountPath: StepsDir}},
+		})
+	}
+	return containers
+}
+
+func envVars(vars map[string]string) []corev1.EnvVar {
+	var envVars []corev1.EnvVar
+	for key, value := range vars {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  key,
+			Value: value,
+		})
+	}
+	return envVars
+}
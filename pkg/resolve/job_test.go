@@ -0,0 +1,271 @@
+package resolve
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+)
+
+func withSteps(runner *v1alpha1.ServiceRunner, operation string, steps ...v1alpha1.OperationStep) *v1alpha1.ServiceRunner {
+	if runner.Spec.ServiceImage.Operations == nil {
+		runner.Spec.ServiceImage.Operations = map[string]v1alpha1.OperationSpec{}
+	}
+	runner.Spec.ServiceImage.Operations[operation] = v1alpha1.OperationSpec{Steps: steps}
+	return runner
+}
+
+func TestJobTemplateSteps(t *testing.T) {
+	runner := withSteps(newTestRunner(PIPELINE_NEW), OPERATION_CREATE,
+		v1alpha1.OperationStep{Name: "migrate", Image: "docker.io/library/postgres:14", Command: []string{"psql"}, Args: []string{"-f", "/schema.sql"}},
+		v1alpha1.OperationStep{Name: "register", Command: []string{"/register"}},
+	)
+	job := newTestJobTemplate(runner, Operation{Name: OPERATION_CREATE, ID: "db-create-1", Params: map[string]string{"SIZE": "small"}})
+
+	pod := job.Spec.Template.Spec
+	if len(pod.InitContainers) != 1 || len(pod.Containers) != 1 {
+		t.Fatalf("job runs %d init containers and %d containers, want the first step first and the final one last", len(pod.InitContainers), len(pod.Containers))
+	}
+	migrate, register := pod.InitContainers[0], pod.Containers[0]
+	if migrate.Name != "migrate" || migrate.Image != "docker.io/library/postgres:14" || migrate.Command[0] != "psql" || len(migrate.Args) != 2 {
+		t.Errorf("first step = %+v, want the migrate step", migrate)
+	}
+	if register.Name != "register" || register.Image != runner.Spec.ServiceImage.CrudImage {
+		t.Errorf("final step = %+v, want the register step of the CRUD image", register)
+	}
+	for _, c := range []corev1.Container{migrate, register} {
+		env := map[string]string{}
+		for _, v := range c.Env {
+			env[v.Name] = v.Value
+		}
+		if env["SIZE"] != "small" || env["STEPS_DIR"] != StepsDir || env["STEP_OUTPUT"] != StepsDir+"/"+c.Name {
+			t.Errorf("step %s env = %v, want the parameters and the shared directory", c.Name, env)
+		}
+		if len(c.VolumeMounts) == 0 || c.VolumeMounts[0].Name != StepsVolume {
+			t.Errorf("step %s mounts %v, want the steps volume", c.Name, c.VolumeMounts)
+		}
+	}
+
+	// operations without steps run a single container
+	job = newTestJobTemplate(runner, Operation{Name: OPERATION_READ, ID: "db-read-1"})
+	if len(job.Spec.Template.Spec.InitContainers) != 0 || job.Spec.Template.Spec.Containers[0].Command[0] != "/read" {
+		t.Errorf("read job = %+v, want the single read container", job.Spec.Template.Spec)
+	}
+}
+
+func TestValidateSteps(t *testing.T) {
+	tests := []struct {
+		name  string
+		image string
+		steps []v1alpha1.OperationStep
+		valid bool
+	}{
+		{name: "steps with their own images", steps: []v1alpha1.OperationStep{{Name: "one", Image: "a"}, {Name: "two", Image: "b"}}, valid: true},
+		{name: "step without image", steps: []v1alpha1.OperationStep{{Name: "one"}}},
+		{name: "duplicate step", image: "crud", steps: []v1alpha1.OperationStep{{Name: "one"}, {Name: "one"}}},
+		{name: "invalid step name", image: "crud", steps: []v1alpha1.OperationStep{{Name: "One"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := withSteps(newTestRunner(PIPELINE_NEW), OPERATION_CREATE, tt.steps...)
+			runner.Spec.ServiceImage.CrudImage = tt.image
+			err := validateJobSpec(runner, Operation{Name: OPERATION_CREATE})
+			if tt.valid != (err == nil) || (err != nil && Classify(err) != ErrorInvalidSpec) {
+				t.Fatalf("validateJobSpec() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestAdvanceRecordsSteps(t *testing.T) {
+	ctx := context.Background()
+	runner := withSteps(newTestRunner(PIPELINE_CREATE), OPERATION_CREATE,
+		v1alpha1.OperationStep{Name: "migrate"},
+		v1alpha1.OperationStep{Name: "seed"},
+		v1alpha1.OperationStep{Name: "register"},
+	)
+	job := newTestJobTemplate(runner, Operation{Name: OPERATION_CREATE, ID: "db-create-1"})
+	job.UID = "job-uid"
+	pod := withPhase(newTestPod("apps", "db-create-1-x", job.UID, map[string]string{JobLabel: "db"}), corev1.PodPending)
+	pod.Status.InitContainerStatuses = []corev1.ContainerStatus{
+		{Name: "migrate", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}},
+		{Name: "seed", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+	}
+	c := newTestClient(t, runner, job, pod)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	want := []v1alpha1.OperationStepStatus{
+		{Name: "migrate", State: StepSucceeded},
+		{Name: "seed", State: StepRunning},
+		{Name: "register", State: StepWaiting},
+	}
+	steps := runner.Status.Operation.Steps
+	if len(steps) != len(want) {
+		t.Fatalf("steps = %+v, want %+v", steps, want)
+	}
+	for i := range want {
+		if steps[i] != want[i] {
+			t.Errorf("step %d = %+v, want %+v", i, steps[i], want[i])
+		}
+	}
+
+	// a failed step is reported until the runner moves on
+	pod.Status.InitContainerStatuses[1].State = corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 3, Message: "seed data missing"}}
+	if err := c.Status().Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded"}}
+	if err := c.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorJobFailed {
+		t.Fatalf("Advance() error = %v, want the job failure", err)
+	}
+	if seed := runner.Status.Operation.Steps[1]; seed.State != StepFailed || seed.Message != "exited with 3: seed data missing" {
+		t.Errorf("seed step = %+v, want it failed", seed)
+	}
+}
+
+func TestJobTemplateOperationImage(t *testing.T) {
+	runner := newTestRunner(PIPELINE_NEW)
+	runner.Spec.ServiceImage.Operations = map[string]v1alpha1.OperationSpec{
+		OPERATION_UPDATE: {Image: "docker.io/library/postgres:14", Command: []string{"psql"}, Args: []string{"-f", "/migrations/latest.sql"}},
+		OPERATION_DELETE: {Args: []string{"--force"}},
+	}
+
+	update := newTestJobTemplate(runner, Operation{Name: OPERATION_UPDATE, ID: "db-update-2"}).Spec.Template.Spec.Containers[0]
+	if update.Image != "docker.io/library/postgres:14" || update.Command[0] != "psql" || len(update.Args) != 2 {
+		t.Errorf("update container = %+v, want the psql image and command", update)
+	}
+	del := newTestJobTemplate(runner, Operation{Name: OPERATION_DELETE, ID: "db-delete-2"}).Spec.Template.Spec.Containers[0]
+	if del.Image != runner.Spec.ServiceImage.CrudImage || del.Command[0] != "/delete" || del.Args[0] != "--force" {
+		t.Errorf("delete container = %+v, want the CRUD image and default command with args", del)
+	}
+
+	// an operation with its own image needs no CRUD image
+	runner.Spec.ServiceImage.CrudImage = ""
+	if err := validateJobSpec(runner, Operation{Name: OPERATION_UPDATE}); err != nil {
+		t.Errorf("validateJobSpec(update) = %v, want it valid", err)
+	}
+	if err := validateJobSpec(runner, Operation{Name: OPERATION_DELETE}); Classify(err) != ErrorInvalidSpec {
+		t.Errorf("validateJobSpec(delete) = %v, want an invalid spec", err)
+	}
+	runner.Spec.ServiceImage.Operations["restore"] = v1alpha1.OperationSpec{Image: "restore"}
+	if err := validateJobSpec(runner, Operation{Name: OPERATION_UPDATE}); Classify(err) != ErrorInvalidSpec {
+		t.Errorf("validateJobSpec() with an unknown operation = %v, want an invalid spec", err)
+	}
+}
+
+func TestJobTemplateUpdateContext(t *testing.T) {
+	runner := newTestRunner(PIPELINE_READY)
+	runner.Status.Binding = &v1alpha1.ServiceRunnerBindingRef{Name: "db"}
+	op := Operation{
+		Name:     OPERATION_UPDATE,
+		ID:       "db-update-2",
+		Params:   map[string]string{"SIZE": "large", "REGION": "eu", "BACKUPS": "daily"},
+		Previous: map[string]string{"SIZE": "small", "REGION": "eu", "TIER": "gold"},
+	}
+	job := newTestJobTemplate(runner, op)
+
+	context := UpdateContext{}
+	if err := json.Unmarshal([]byte(job.Spec.Template.Annotations[UpdateContextAnnotation]), &context); err != nil {
+		t.Fatal(err)
+	}
+	want := ChangeSet{Added: []string{"BACKUPS"}, Removed: []string{"TIER"}, Changed: []string{"SIZE"}}
+	if !reflect.DeepEqual(context.Changes, want) || context.Previous["SIZE"] != "small" || context.Params["SIZE"] != "large" {
+		t.Errorf("update context = %+v, want the previous parameters and changes %+v", context, want)
+	}
+
+	container := job.Spec.Template.Spec.Containers[0]
+	env := map[string]string{}
+	for _, v := range container.Env {
+		env[v.Name] = v.Value
+	}
+	if env["SIZE"] != "large" || env["PREVIOUS_SIZE"] != "small" || env["PREVIOUS_TIER"] != "gold" ||
+		env["UPDATE_ADDED"] != "BACKUPS" || env["UPDATE_REMOVED"] != "TIER" || env["UPDATE_CHANGED"] != "SIZE" || env["UPDATE_CONTEXT"] != UpdateContextFile {
+		t.Errorf("env = %v, want the parameters, the previous ones and the changes", env)
+	}
+	if len(container.EnvFrom) != 1 || container.EnvFrom[0].Prefix != OutputPrefix || container.EnvFrom[0].SecretRef.Name != "db" {
+		t.Errorf("env from %+v, want the binding outputs prefixed", container.EnvFrom)
+	}
+	mounts := map[string]string{}
+	for _, m := range container.VolumeMounts {
+		mounts[m.Name] = m.MountPath
+	}
+	if mounts[UpdateVolume] != UpdateDir || mounts[UpdateOutputsVolume] != UpdateOutputsDir {
+		t.Errorf("mounts = %v, want the update context and outputs", mounts)
+	}
+
+	// other operations aren't told about updates
+	job = newTestJobTemplate(runner, Operation{Name: OPERATION_CREATE, ID: "db-create-1", Params: op.Params})
+	if _, ok := job.Spec.Template.Annotations[UpdateContextAnnotation]; ok {
+		t.Errorf("create job annotations = %v, want no update context", job.Spec.Template.Annotations)
+	}
+	for _, volume := range job.Spec.Template.Spec.Volumes {
+		if volume.Name == UpdateVolume || volume.Name == UpdateOutputsVolume {
+			t.Errorf("create job mounts %s, want no update context", volume.Name)
+		}
+	}
+}
+
+func TestJobTemplateRunnerContext(t *testing.T) {
+	runner := newTestRunner(PIPELINE_FAILED)
+	runner.Labels = map[string]string{"app.kubernetes.io/part-of": "shop", "tags.servicerunner.io/cost-center": "1234", "tier": "backend"}
+	runner.Annotations = map[string]string{"tags.servicerunner.io/owner": "team-a"}
+	runner = withSteps(runner, OPERATION_CREATE, v1alpha1.OperationStep{Name: "migrate"}, v1alpha1.OperationStep{Name: "register"})
+	job := newTestJobTemplate(runner, Operation{Name: OPERATION_CREATE, ID: "db-create-2", Attempt: 2, ServiceID: "db-42"})
+
+	want := `name="db"
+namespace="apps"
+uid="db-uid"
+generation="1"
+operation="create"
+attempt="2"
+service_id="db-42"
+cluster_id="3f1c0a"
+tag.app.kubernetes.io/part-of="shop"
+tag.cost-center="1234"
+tag.owner="team-a"
+`
+	if got := job.Spec.Template.Annotations[RunnerContextAnnotation]; got != want {
+		t.Errorf("runner context = %q, want %q", got, want)
+	}
+	for _, c := range append(job.Spec.Template.Spec.InitContainers, job.Spec.Template.Spec.Containers...) {
+		env := map[string]string{}
+		for _, v := range c.Env {
+			env[v.Name] = v.Value
+		}
+		if env["RUNNER_NAME"] != "db" || env["RUNNER_UID"] != "db-uid" || env["RUNNER_ATTEMPT"] != "2" || env["RUNNER_CLUSTER_ID"] != "3f1c0a" ||
+			env["RUNNER_TAG_APP_KUBERNETES_IO_PART_OF"] != "shop" || env["RUNNER_TAG_COST_CENTER"] != "1234" || env["RUNNER_CONTEXT"] != RunnerContextFile {
+			t.Errorf("step %s env = %v, want the runner context", c.Name, env)
+		}
+		if _, ok := env["RUNNER_TAG_TIER"]; ok {
+			t.Errorf("step %s env = %v, want only selected labels", c.Name, env)
+		}
+	}
+}
+
+func TestLaunchCountsAttempts(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_FAILED)
+	runner.Status.Operation = &v1alpha1.ServiceRunnerOperation{Name: OPERATION_CREATE, Job: "db-create-1", Executor: JobExecutorName, Attempt: 1}
+	runner.Generation = 2
+	c := newTestClient(t, runner)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_CREATE || runner.Status.Operation.Attempt != 2 {
+		t.Fatalf("runner = %+v, want the second attempt to create", runner.Status)
+	}
+	if env := jobEnv(t, c, "db-create-2"); env["RUNNER_ATTEMPT"] != "2" {
+		t.Errorf("create job env = %v, want the attempt", env)
+	}
+}
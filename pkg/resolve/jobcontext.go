@@ -0,0 +1,135 @@
+package resolve
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Every job is told which runner it runs for, e.g. to name and tag the
+// resources it provisions: RunnerContextFile, in RunnerContextVolume, lists
+// the runner context as key="value" lines, like the files of the downward
+// API, and the environment holds the same as RUNNER_<KEY>.
+const (
+	RunnerContextVolume = "runner"
+	RunnerContextDir    = "/var/run/servicerunner.io/runner"
+	RunnerContextFile   = RunnerContextDir + "/context"
+
+	// RunnerContextAnnotation carries the runner context on the pods of
+	// jobs, from which it is projected into RunnerContextFile.
+	RunnerContextAnnotation = "servicerunner.io/runner-context"
+)
+
+// TagPrefix selects the labels and annotations of a runner handed to its
+// jobs as tags, along with its app.kubernetes.io labels: the tag
+// tags.servicerunner.io/cost-center is "cost-center" in the runner context,
+// in RUNNER_TAG_COST_CENTER.
+const TagPrefix = "tags.servicerunner.io/"
+
+// appLabelPrefix is the prefix of the recommended labels of Kubernetes
+// applications.
+const appLabelPrefix = "app.kubernetes.io/"
+
+// runnerTags returns the labels and annotations of runner its jobs are
+// handed.
+func runnerTags(runner *v1alpha1.ServiceRunner) map[string]string {
+	tags := map[string]string{}
+	for key, value := range runner.Labels {
+		if strings.HasPrefix(key, appLabelPrefix) {
+			tags[key] = value
+		}
+	}
+	for _, meta := range []map[string]string{runner.Labels, runner.Annotations} {
+		for key, value := range meta {
+			if strings.HasPrefix(key, TagPrefix) {
+				tags[strings.TrimPrefix(key, TagPrefix)] = value
+			}
+		}
+	}
+	return tags
+}
+
+// envKey turns key into the suffix of an environment variable name, e.g.
+// "app.kubernetes.io/part-of" into "APP_KUBERNETES_IO_PART_OF".
+func envKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
+
+// runnerContext returns the context of the jobs of op run in the cluster
+// identified by clusterID, as keys and values in order.
+func runnerContext(runner *v1alpha1.ServiceRunner, op Operation, clusterID string) [][2]string {
+	attempt := op.Attempt
+	if attempt == 0 {
+		attempt = 1
+	}
+	context := [][2]string{
+		{"name", runner.Name},
+		{"namespace", runner.Namespace},
+		{"uid", string(runner.UID)},
+		{"generation", strconv.FormatInt(runner.Generation, 10)},
+		{"operation", op.Name},
+		{"attempt", strconv.Itoa(int(attempt))},
+		{"service_id", op.ServiceID},
+		{"cluster_id", clusterID},
+	}
+	tags := runnerTags(runner)
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		context = append(context, [2]string{"tag." + key, tags[key]})
+	}
+	return context
+}
+
+// withRunnerContext hands the runner context of op to the containers of job.
+func withRunnerContext(runner *v1alpha1.ServiceRunner, op Operation, clusterID string, job *batchv1.Job, containers []corev1.Container) {
+	file := &strings.Builder{}
+	var env []corev1.EnvVar
+	for _, entry := range runnerContext(runner, op, clusterID) {
+		key, value := entry[0], entry[1]
+		fmt.Fprintf(file, "%s=%s\n", key, strconv.Quote(value))
+		if strings.HasPrefix(key, "tag.") {
+			key = "TAG_" + strings.TrimPrefix(key, "tag.")
+		}
+		env = append(env, corev1.EnvVar{Name: "RUNNER_" + envKey(key), Value: value})
+	}
+	if job.Spec.Template.Annotations == nil {
+		job.Spec.Template.Annotations = map[string]string{}
+	}
+	job.Spec.Template.Annotations[RunnerContextAnnotation] = file.String()
+	job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, corev1.Volume{
+		Name: RunnerContextVolume,
+		VolumeSource: corev1.VolumeSource{DownwardAPI: &corev1.DownwardAPIVolumeSource{
+			Items: []corev1.DownwardAPIVolumeFile{{
+				Path:     "context",
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations['" + RunnerContextAnnotation + "']"},
+			}},
+		}},
+	})
+	env = append(env, corev1.EnvVar{Name: "RUNNER_CONTEXT", Value: RunnerContextFile})
+	for i := range containers {
+		containers[i].Env = append(containers[i].Env, env...)
+		containers[i].VolumeMounts = append(containers[i].VolumeMounts, corev1.VolumeMount{
+			Name:      RunnerContextVolume,
+			MountPath: RunnerContextDir,
+			ReadOnly:  true,
+		})
+	}
+}
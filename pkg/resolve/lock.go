@@ -0,0 +1,234 @@
+package resolve
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Runners operating on the same external service, e.g. one importing a
+// service another created, run their operations one at a time: launching an
+// operation takes a Lease named after the service, which is released once
+// the operation has finished.
+const (
+	// LockKeyAnnotation records the key of the service on its Lease.
+	LockKeyAnnotation = "servicerunner.io/lock-key"
+
+	// ReasonLockAcquired and ReasonWaitingForLock are the reasons of the
+	// Locked condition.
+	ReasonLockAcquired   = "Acquired"
+	ReasonWaitingForLock = "WaitingForLock"
+)
+
+// LockGracePeriod is how long a Lease is trusted after it was last taken,
+// before its holder is checked: a runner records the lock it took once its
+// status is persisted.
+const LockGracePeriod = time.Minute
+
+// serviceClass identifies what kind of service runner provisions: its
+// executor, and the image, broker service, chart or endpoint behind it.
+func serviceClass(runner *v1alpha1.ServiceRunner) string {
+	name := executorName(runner)
+	target := ""
+	switch {
+	case name == JobExecutorName:
+		target = imageRepository(runner.Spec.ServiceImage.CrudImage)
+	case runner.Spec.Executor.OSB != nil:
+		target = runner.Spec.Executor.OSB.ServiceID
+	case runner.Spec.Executor.Helm != nil:
+		target = runner.Spec.Executor.Helm.Chart
+	case runner.Spec.Executor.Webhook != nil:
+		target = runner.Spec.Executor.Webhook.URL
+	}
+	return name + ":" + target
+}
+
+// imageRepository strips the tag or digest off image.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+// lockKey returns the key identifying the service of runner with serviceID,
+// or "" when it can't be identified yet: the service ID is only known once
+// it exists.
+func lockKey(runner *v1alpha1.ServiceRunner, serviceID string) string {
+	if runner.Spec.LockKey != "" {
+		return runner.Spec.LockKey
+	}
+	if serviceID == "" {
+		return ""
+	}
+	return serviceClass(runner) + "/" + serviceID
+}
+
+// lockLease returns the key of the Lease locking the service with key.
+func (p *Pipeline) lockLease(key string) types.NamespacedName {
+	namespace := p.executors.LockNamespace
+	if namespace == "" {
+		namespace = p.serviceRunner.Namespace
+	}
+	return types.NamespacedName{Namespace: namespace, Name: fmt.Sprintf("servicerunner-lock-%x", sha256.Sum256([]byte(key)))[:35]}
+}
+
+// lockHolder identifies runner as the holder of a Lease.
+func lockHolder(runner *v1alpha1.ServiceRunner) string {
+	return runner.Namespace + "/" + runner.Name + "/" + string(runner.UID)
+}
+
+// setLocked reports on the lock of the service with key.
+func setLocked(runner *v1alpha1.ServiceRunner, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&runner.Status.Conditions, metav1.Condition{
+		Type:               v1alpha1.ConditionLocked,
+		Status:             status,
+		ObservedGeneration: runner.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// lock takes the lock on the service with serviceID before an operation is
+// launched, or returns a Locked error while another runner holds it.
+func (p *Pipeline) lock(ctx context.Context, serviceID string) error {
+	runner := p.serviceRunner
+	key := lockKey(runner, serviceID)
+	if key == "" {
+		return nil
+	}
+	name := p.lockLease(key)
+	holder := lockHolder(runner)
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(LockGracePeriod.Seconds())
+
+	lease := &coordinationv1.Lease{}
+	err := p.client.Get(ctx, name, lease)
+	switch {
+	case apierrors.IsNotFound(err):
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name.Name,
+				Namespace:   name.Namespace,
+				Annotations: map[string]string{LockKeyAnnotation: key},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		err = p.client.Create(ctx, lease)
+		if apierrors.IsAlreadyExists(err) {
+			return p.waitForLock(key, "another runner")
+		}
+	case err != nil:
+		return err
+	default:
+		current := ""
+		if lease.Spec.HolderIdentity != nil {
+			current = *lease.Spec.HolderIdentity
+		}
+		if current != holder {
+			stale, err := p.staleLock(ctx, lease, name)
+			if err != nil {
+				return err
+			}
+			if !stale {
+				return p.waitForLock(key, strings.Join(strings.SplitN(current, "/", 3)[:2], "/"))
+			}
+			lease.Spec.HolderIdentity = &holder
+			lease.Spec.AcquireTime = &now
+			var transitions int32
+			if lease.Spec.LeaseTransitions != nil {
+				transitions = *lease.Spec.LeaseTransitions
+			}
+			transitions++
+			lease.Spec.LeaseTransitions = &transitions
+		}
+		lease.Spec.LeaseDurationSeconds = &seconds
+		lease.Spec.RenewTime = &now
+		err = p.client.Update(ctx, lease)
+		if apierrors.IsConflict(err) {
+			return p.waitForLock(key, "another runner")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	runner.Status.Lock = &v1alpha1.ServiceRunnerLock{Key: key, Lease: name.String()}
+	setLocked(runner, metav1.ConditionTrue, ReasonLockAcquired, fmt.Sprintf("holding the lock on %s", key))
+	return nil
+}
+
+// waitForLock reports that runner waits for holder to release the lock on
+// the service with key.
+func (p *Pipeline) waitForLock(key, holder string) error {
+	message := fmt.Sprintf("waiting for %s to release the lock on %s", holder, key)
+	setLocked(p.serviceRunner, metav1.ConditionFalse, ReasonWaitingForLock, message)
+	return Locked("%s", message)
+}
+
+// staleLock reports whether lease is held by a runner which no longer holds
+// it: the runner is gone, or doesn't record the lock any more, e.g. as the
+// operator stopped before releasing it.
+func (p *Pipeline) staleLock(ctx context.Context, lease *coordinationv1.Lease, name types.NamespacedName) (bool, error) {
+	if lease.Spec.HolderIdentity == nil {
+		return true, nil
+	}
+	if taken := lease.Spec.RenewTime; taken != nil && time.Since(taken.Time) < LockGracePeriod {
+		return false, nil
+	}
+	parts := strings.SplitN(*lease.Spec.HolderIdentity, "/", 3)
+	if len(parts) != 3 {
+		return true, nil
+	}
+	holder := &v1alpha1.ServiceRunner{}
+	err := p.client.Get(ctx, client.ObjectKey{Namespace: parts[0], Name: parts[1]}, holder)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(holder.UID) != parts[2] || holder.Status.Lock == nil || holder.Status.Lock.Lease != name.String(), nil
+}
+
+// unlock releases the lock the runner took for its last operation, once it
+// has finished.
+func (p *Pipeline) unlock(ctx context.Context) error {
+	runner := p.serviceRunner
+	if runner.Status.Lock == nil {
+		return nil
+	}
+	parts := strings.SplitN(runner.Status.Lock.Lease, "/", 2)
+	lease := &coordinationv1.Lease{}
+	err := p.client.Get(ctx, client.ObjectKey{Namespace: parts[0], Name: parts[len(parts)-1]}, lease)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == lockHolder(runner) {
+		// the lease of a runner taking the lock over isn't deleted
+		err = p.client.Delete(ctx, lease, client.Preconditions{UID: &lease.UID, ResourceVersion: &lease.ResourceVersion})
+		if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+			return err
+		}
+	}
+	runner.Status.Lock = nil
+	meta.RemoveStatusCondition(&runner.Status.Conditions, v1alpha1.ConditionLocked)
+	return nil
+}
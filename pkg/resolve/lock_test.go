@@ -0,0 +1,200 @@
+package resolve
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestLockKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		executor *v1alpha1.ServiceRunnerExecutor
+		key      string
+		id       string
+		want     string
+	}{
+		{"unknown service", "quay.io/example/crud:latest", nil, "", "", ""},
+		{"explicit key", "quay.io/example/crud:latest", nil, "orders-db", "", "orders-db"},
+		{"image by tag", "quay.io/example/crud:latest", nil, "", "42", "job:quay.io/example/crud/42"},
+		{"image by digest", "registry:5000/crud@sha256:0123", nil, "", "42", "job:registry:5000/crud/42"},
+		{"broker service", "", &v1alpha1.ServiceRunnerExecutor{Name: "osb", OSB: &v1alpha1.OSBExecutorSpec{ServiceID: "pg"}}, "", "42", "osb:pg/42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := newTestRunner(PIPELINE_READY)
+			runner.Spec.ServiceImage.CrudImage = tt.image
+			runner.Spec.Executor = tt.executor
+			runner.Spec.LockKey = tt.key
+			if got := lockKey(runner, tt.id); got != tt.want {
+				t.Errorf("lockKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLockExcludesRunners(t *testing.T) {
+	ctx := context.Background()
+	a, b := newTestRunner(PIPELINE_READY), newTestRunner(PIPELINE_READY)
+	a.Name, a.UID, a.Spec.LockKey = "a", "a-uid", "orders-db"
+	b.Name, b.UID, b.Spec.LockKey = "b", "b-uid", "orders-db"
+	c := newTestClient(t, a, b)
+	executors := newTestExecutors(c, nil)
+	pa := &Pipeline{serviceRunner: a, client: c, executors: executors}
+	pb := &Pipeline{serviceRunner: b, client: c, executors: executors}
+
+	if err := pa.Launch(ctx, Operation{Name: OPERATION_UPDATE, ID: "a-update-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if a.Status.Lock == nil || a.Status.Lock.Key != "orders-db" || conditionOf(a, v1alpha1.ConditionLocked) != "True/"+ReasonLockAcquired {
+		t.Fatalf("runner a = %+v, want it holding the lock", a.Status)
+	}
+	if err := pb.Launch(ctx, Operation{Name: OPERATION_UPDATE, ID: "b-update-2"}); Classify(err) != ErrorLocked {
+		t.Fatalf("Launch() of b = %v, want it locked out", err)
+	}
+	if b.Status.Lock != nil || conditionOf(b, v1alpha1.ConditionLocked) != "False/"+ReasonWaitingForLock {
+		t.Errorf("runner b = %+v, want it waiting for the lock", b.Status)
+	}
+
+	// once the grace period is over, the lease is trusted as long as its
+	// holder records it
+	lease := &coordinationv1.Lease{}
+	key := client.ObjectKey{Namespace: "apps", Name: pa.lockLease("orders-db").Name}
+	if err := c.Get(ctx, key, lease); err != nil {
+		t.Fatal(err)
+	}
+	renewed := metav1.NewMicroTime(time.Now().Add(-2 * LockGracePeriod))
+	lease.Spec.RenewTime = &renewed
+	if err := c.Update(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Status().Update(ctx, a.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.Launch(ctx, Operation{Name: OPERATION_UPDATE, ID: "b-update-2"}); Classify(err) != ErrorLocked {
+		t.Fatalf("Launch() of b while a records the lock = %v, want it locked out", err)
+	}
+
+	// a stopped without releasing it: the lease is stale
+	stale := &v1alpha1.ServiceRunner{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(a), stale); err != nil {
+		t.Fatal(err)
+	}
+	stale.Status.Lock = nil
+	if err := c.Status().Update(ctx, stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := pb.Launch(ctx, Operation{Name: OPERATION_UPDATE, ID: "b-update-2"}); err != nil {
+		t.Fatalf("Launch() of b over a stale lock = %v", err)
+	}
+	if b.Status.Lock == nil || conditionOf(b, v1alpha1.ConditionLocked) != "True/"+ReasonLockAcquired {
+		t.Errorf("runner b = %+v, want it holding the lock", b.Status)
+	}
+
+	// a releasing leaves the lease of b alone
+	if err := pa.unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, lease); err != nil || *lease.Spec.HolderIdentity != lockHolder(b) {
+		t.Errorf("lease = %+v, %v, want it held by b", lease.Spec, err)
+	}
+	if err := pb.unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, lease); Classify(err) != ErrorNotFound || b.Status.Lock != nil || conditionOf(b, v1alpha1.ConditionLocked) != "" {
+		t.Errorf("lease = %v, runner b = %+v, want the lock released", err, b.Status)
+	}
+}
+
+func TestAdvanceReleasesLock(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_READ)
+	runner.Spec.LockKey = "orders-db"
+	c := newTestClient(t, runner, newTestJob("db-read-1"))
+	p := &Pipeline{serviceRunner: runner, client: c, executors: newTestExecutors(c, nil)}
+	if err := p.lock(ctx, runner.Status.ServiceId); err != nil {
+		t.Fatal(err)
+	}
+	logs := finishRead(t, c, "db-read-1", `{"host":"db.apps.svc"}`)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); err != nil {
+		t.Fatal(err)
+	}
+	lease := &coordinationv1.Lease{}
+	err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: p.lockLease("orders-db").Name}, lease)
+	if runner.Status.State != PIPELINE_READY || runner.Status.Lock != nil || Classify(err) != ErrorNotFound {
+		t.Errorf("runner = %+v, lease = %v, want the lock released once ready", runner.Status, err)
+	}
+}
+
+func TestLockNamespace(t *testing.T) {
+	ctx := context.Background()
+	a, b := newTestRunner(PIPELINE_READY), newTestRunner(PIPELINE_READY)
+	a.Spec.LockKey, b.Spec.LockKey = "orders-db", "orders-db"
+	b.Namespace = "shop"
+	c := newTestClient(t, a, b)
+	executors := newTestExecutors(c, nil)
+	executors.LockNamespace = "locks"
+	pa := &Pipeline{serviceRunner: a, client: c, executors: executors}
+	pb := &Pipeline{serviceRunner: b, client: c, executors: executors}
+
+	if err := pa.Launch(ctx, Operation{Name: OPERATION_UPDATE, ID: "db-update-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if a.Status.Lock == nil || a.Status.Lock.Lease != "locks/"+pa.lockLease("orders-db").Name {
+		t.Errorf("lock = %+v, want a lease in the lock namespace", a.Status.Lock)
+	}
+	if err := pb.Launch(ctx, Operation{Name: OPERATION_UPDATE, ID: "db-update-2"}); Classify(err) != ErrorLocked {
+		t.Errorf("Launch() in another namespace = %v, want it locked out", err)
+	}
+}
+
+func TestLockCreatedService(t *testing.T) {
+	ctx := context.Background()
+	creator := newTestRunner(PIPELINE_CREATE)
+	importer := importingService(newTestRunner(PIPELINE_NEW), "")
+	importer.Name, importer.UID = "orders", "orders-uid"
+	c := newTestClient(t, creator, importer, newTestJob("db-create-1"))
+
+	// the service is known once the create outputs its ID, before the read
+	logs := finishRead(t, c, "db-create-1", `{"service_id":"db-42"}`)
+	if _, err := Advance(ctx, creator, c, newTestExecutors(c, logs)); err != nil {
+		t.Fatal(err)
+	}
+	if creator.Status.State != PIPELINE_READ || creator.Status.ServiceId != "db-42" || creator.Status.Lock == nil ||
+		creator.Status.Lock.Key != "job:quay.io/example/crud/db-42" {
+		t.Fatalf("creator = %+v, want it reading db-42 under its lock", creator.Status)
+	}
+	if err := c.Status().Update(ctx, creator.DeepCopy()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Advance(ctx, importer, c, newTestExecutors(c, nil)); Classify(err) != ErrorLocked {
+		t.Fatalf("Advance() of the importer = %v, want it locked out", err)
+	}
+	if importer.Status.Operation != nil || conditionOf(importer, v1alpha1.ConditionLocked) != "False/"+ReasonWaitingForLock {
+		t.Errorf("importer = %+v, want it waiting for the creator", importer.Status)
+	}
+
+	// reads name the service too; once ready, the creator lets the importer
+	// in
+	logs = finishRead(t, c, "db-read-1", `{"host":"db.apps.svc","service_id":"db-42"}`)
+	if _, err := Advance(ctx, creator, c, newTestExecutors(c, logs)); err != nil {
+		t.Fatal(err)
+	}
+	if creator.Status.State != PIPELINE_READY || creator.Status.ServiceId != "db-42" || creator.Status.Lock != nil {
+		t.Fatalf("creator = %+v, want it ready, the lock released", creator.Status)
+	}
+	if _, err := Advance(ctx, importer, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if importer.Status.State != PIPELINE_IMPORT || importer.Status.Lock == nil {
+		t.Errorf("importer = %+v, want it importing under the lock", importer.Status)
+	}
+}
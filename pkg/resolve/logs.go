@@ -0,0 +1,39 @@
+package resolve
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// LogReader reads what stage job pods wrote to their logs; the output of a
+// stage is the last line its pod logged.
+type LogReader interface {
+	// TailLog returns the last line logged by pod.
+	TailLog(ctx context.Context, pod *corev1.Pod) ([]byte, error)
+}
+
+// podLogReader reads pod logs from the API server.
+type podLogReader struct {
+	clientset kubernetes.Interface
+}
+
+// NewLogReader returns a LogReader talking to the API server described by
+// config, normally the one the manager was configured with.
+func NewLogReader(config *rest.Config) (LogReader, error) {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &podLogReader{clientset: clientset}, nil
+}
+
+func (r *podLogReader) TailLog(ctx context.Context, pod *corev1.Pod) ([]byte, error) {
+	one := int64(1)
+	return r.clientset.CoreV1().
+		Pods(pod.Namespace).
+		GetLogs(pod.Name, &corev1.PodLogOptions{TailLines: &one}).
+		DoRaw(ctx)
+}
@@ -0,0 +1,32 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// FakeLogReader serves canned logs, keyed by pod namespace and name
+// ("namespace/name").
+type FakeLogReader struct {
+	Logs map[string]string
+}
+
+var _ LogReader = &FakeLogReader{}
+
+func (r *FakeLogReader) TailLog(_ context.Context, pod *corev1.Pod) ([]byte, error) {
+	log, ok := r.Logs[pod.Namespace+"/"+pod.Name]
+	if !ok {
+		return nil, NotFound("no logs for pod %s/%s", pod.Namespace, pod.Name)
+	}
+	return []byte(log), nil
+}
+
+// SetLog records the log of the pod with the given namespace and name.
+func (r *FakeLogReader) SetLog(namespace, name, log string) {
+	if r.Logs == nil {
+		r.Logs = map[string]string{}
+	}
+	r.Logs[fmt.Sprintf("%s/%s", namespace, name)] = log
+}
@@ -0,0 +1,565 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Event is something observed about a runner which may move it to another
+// state.
+type Event string
+
+const (
+	EventJobSucceeded    Event = "JobSucceeded"
+	EventJobFailed       Event = "JobFailed"
+	EventJobTimedOut     Event = "JobTimedOut"
+	EventSpecChanged     Event = "SpecChanged"
+	EventDeleteRequested Event = "DeleteRequested"
+
+	// EventRollbackRequested is raised by annotating a Failed runner with
+	// RollbackAnnotation.
+	EventRollbackRequested Event = "RollbackRequested"
+
+	// EventRefreshDue is raised once the refresh interval of an ObserveOnly
+	// runner has passed since it last read its service.
+	EventRefreshDue Event = "RefreshDue"
+
+	// EventExpired is raised once a runner whose expiration policy is
+	// Deprovision expired.
+	EventExpired Event = "Expired"
+)
+
+// Events lists every event the state machine knows about.
+var Events = []Event{
+	EventJobSucceeded,
+	EventJobFailed,
+	EventJobTimedOut,
+	EventSpecChanged,
+	EventDeleteRequested,
+	EventRollbackRequested,
+	EventRefreshDue,
+	EventExpired,
+}
+
+// Guard is a named condition a transition requires to hold.
+type Guard struct {
+	Name  string
+	Check func(runner *v1alpha1.ServiceRunner) bool
+}
+
+// Not negates a guard.
+func Not(g Guard) Guard {
+	return Guard{
+		Name:  "!" + g.Name,
+		Check: func(runner *v1alpha1.ServiceRunner) bool { return !g.Check(runner) },
+	}
+}
+
+// Transition moves a runner in state From to state To on Event, provided its
+// Guard (if any) holds.
+type Transition struct {
+	From  string
+	Event Event
+	Guard *Guard
+	To    string
+}
+
+var (
+	// provisioned holds once the service has been created, i.e. when the
+	// operation that failed was not the create operation, or it created the
+	// replacement of a service still around.
+	provisioned = Guard{
+		Name: "provisioned",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			if runner.Status.Replaced != nil {
+				return true
+			}
+			return runner.Status.Operation != nil && runner.Status.Operation.Name != OPERATION_CREATE
+		},
+	}
+
+	// specChanged holds when the spec was edited since the generation being
+	// applied was launched.
+	specChanged = Guard{
+		Name: "specChanged",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			return runner.Generation != applyingGeneration(runner)
+		},
+	}
+
+	// deleteFailed holds when the failed operation was the delete operation;
+	// it is launched again after a backoff, see deleteRetryIn.  A failure to
+	// delete a replaced service doesn't prevent deleting the runner, which
+	// deletes it again.
+	deleteFailed = Guard{
+		Name: "deleteFailed",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			return runner.Status.Operation != nil && runner.Status.Operation.Name == OPERATION_DELETE && runner.Status.Replaced == nil
+		},
+	}
+
+	// recreate holds when the spec changes immutable parameters of a runner
+	// updating with the Recreate strategy.
+	recreate = Guard{
+		Name: "recreate",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			return runner.Spec.UpdateStrategy == v1alpha1.UpdateRecreate && immutableChanged(runner)
+		},
+	}
+
+	// replace holds when the spec changes immutable parameters of a runner
+	// updating with the CreateBeforeDelete strategy.
+	replace = Guard{
+		Name: "replace",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			return runner.Spec.UpdateStrategy == v1alpha1.UpdateCreateBeforeDelete && immutableChanged(runner)
+		},
+	}
+
+	// inPlace holds when the spec changes can be applied by an update.
+	inPlace = Guard{
+		Name: "inPlace",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			return !recreate.Check(runner) && !replace.Check(runner)
+		},
+	}
+
+	// rollbackAvailable holds when the failed operation was an update, there
+	// is a snapshot to roll it back to, and rolling this generation back
+	// hasn't failed already.
+	rollbackAvailable = Guard{
+		Name: "rollbackAvailable",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			operation := runner.Status.Operation
+			if runner.Status.LastReady == nil || operation == nil || operation.Name != OPERATION_UPDATE {
+				return false
+			}
+			rolledBack := meta.FindStatusCondition(runner.Status.Conditions, v1alpha1.ConditionRolledBack)
+			return rolledBack == nil || rolledBack.Reason != ReasonRollbackFailed || rolledBack.ObservedGeneration != runner.Generation
+		},
+	}
+
+	// autoRollback holds when a failed update is rolled back right away.
+	autoRollback = Guard{
+		Name: "autoRollback",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			return runner.Spec.RollbackPolicy == v1alpha1.RollbackAutomatic && rollbackAvailable.Check(runner)
+		},
+	}
+
+	// observeOnly holds when the runner only reads its service.
+	observeOnly = Guard{
+		Name: "observeOnly",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			return runner.Spec.ManagementPolicy == v1alpha1.ManagementObserveOnly
+		},
+	}
+
+	// orphan holds when deleting the runner leaves its service around: its
+	// deletion policy says so, or it only observes the service.
+	orphan = Guard{
+		Name: "orphan",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			return runner.Spec.DeletionPolicy == v1alpha1.DeletionOrphan || observeOnly.Check(runner)
+		},
+	}
+
+	// expiring holds once a runner which is to be deprovisioned when it
+	// expires did, unless it is being deleted anyway.
+	expiring = Guard{
+		Name: "expiring",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			expiresAt := runner.Status.ExpiresAt
+			return runner.Spec.ExpirationPolicy == v1alpha1.ExpirationDeprovision && runner.DeletionTimestamp.IsZero() &&
+				expiresAt != nil && !time.Now().Before(expiresAt.Time)
+		},
+	}
+
+	// importing holds while the service of spec.import has yet to be
+	// adopted: the runner never got Ready.
+	importing = Guard{
+		Name: "importing",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			return runner.Spec.Import != nil && runner.Status.ObservedGeneration == 0
+		},
+	}
+
+	// replacing holds while a replaced service is still around.
+	replacing = Guard{
+		Name: "replacing",
+		Check: func(runner *v1alpha1.ServiceRunner) bool {
+			return runner.Status.Replaced != nil
+		},
+	}
+)
+
+func guard(g Guard) *Guard {
+	return &g
+}
+
+// Transitions is the state machine of the runner pipeline.  For a state and
+// an event, the first transition whose guard holds is taken; when there is
+// none, the event is rejected.
+//
+// Spec changes are not acted upon while an operation runs.  Once a create or
+// update finishes, edits made in the meantime are applied by a single update
+// with the newest spec, before the (then stale) service is read.
+//
+// Changes to immutable parameters replace the service instead, as the update
+// strategy says: Recreate deletes it before creating it anew, while
+// CreateBeforeDelete creates and reads the replacement, then retires the
+// replaced service once the binding points at the replacement.
+//
+// A runner importing an existing service reads it with the import operation
+// and gets Ready without creating it; until it did, the service isn't the
+// runner's to delete.
+//
+// Deleting a runner whose deletion policy is Orphan releases it without
+// deleting its service.  A failed delete is launched again once the
+// deletion is observed after a backoff, doubling with every attempt.
+//
+// A runner whose expiration policy is Deprovision deletes its service once it
+// expired, and is kept Expired until it is deleted, or revived by a spec
+// change pushing its expiry back.
+//
+// A runner which only observes its service reads it, on spec changes and
+// every refresh interval, and never creates, updates nor deletes it.
+//
+// A failed update is rolled back by updating the service back to the
+// parameters the runner was last Ready with, right away or once requested as
+// the rollback policy says.  The generation which failed isn't retried.
+var Transitions = []Transition{
+	{From: PIPELINE_NEW, Event: EventSpecChanged, Guard: guard(observeOnly), To: PIPELINE_READ},
+	{From: PIPELINE_NEW, Event: EventSpecChanged, Guard: guard(importing), To: PIPELINE_IMPORT},
+	{From: PIPELINE_NEW, Event: EventSpecChanged, Guard: guard(Not(importing)), To: PIPELINE_CREATE},
+	{From: PIPELINE_NEW, Event: EventDeleteRequested, To: PIPELINE_DELETED},
+	{From: PIPELINE_NEW, Event: EventExpired, To: PIPELINE_EXPIRED},
+
+	{From: PIPELINE_CREATE, Event: EventJobSucceeded, Guard: guard(recreate), To: PIPELINE_RECREATE},
+	{From: PIPELINE_CREATE, Event: EventJobSucceeded, Guard: guard(replace), To: PIPELINE_REPLACE},
+	{From: PIPELINE_CREATE, Event: EventJobSucceeded, Guard: guard(specChanged), To: PIPELINE_UPDATE},
+	{From: PIPELINE_CREATE, Event: EventJobSucceeded, Guard: guard(Not(specChanged)), To: PIPELINE_READ},
+	{From: PIPELINE_CREATE, Event: EventJobFailed, To: PIPELINE_FAILED},
+	{From: PIPELINE_CREATE, Event: EventJobTimedOut, To: PIPELINE_FAILED},
+	{From: PIPELINE_CREATE, Event: EventDeleteRequested, Guard: guard(orphan), To: PIPELINE_DELETED},
+	{From: PIPELINE_CREATE, Event: EventDeleteRequested, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+
+	{From: PIPELINE_READ, Event: EventJobSucceeded, Guard: guard(replacing), To: PIPELINE_RETIRE},
+	{From: PIPELINE_READ, Event: EventJobSucceeded, Guard: guard(Not(replacing)), To: PIPELINE_READY},
+	{From: PIPELINE_READ, Event: EventJobFailed, To: PIPELINE_FAILED},
+	{From: PIPELINE_READ, Event: EventJobTimedOut, To: PIPELINE_FAILED},
+	{From: PIPELINE_READ, Event: EventDeleteRequested, Guard: guard(orphan), To: PIPELINE_DELETED},
+	{From: PIPELINE_READ, Event: EventDeleteRequested, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+
+	{From: PIPELINE_READY, Event: EventSpecChanged, Guard: guard(observeOnly), To: PIPELINE_READ},
+	{From: PIPELINE_READY, Event: EventSpecChanged, Guard: guard(recreate), To: PIPELINE_RECREATE},
+	{From: PIPELINE_READY, Event: EventSpecChanged, Guard: guard(replace), To: PIPELINE_REPLACE},
+	{From: PIPELINE_READY, Event: EventSpecChanged, Guard: guard(inPlace), To: PIPELINE_UPDATE},
+	{From: PIPELINE_READY, Event: EventRefreshDue, Guard: guard(observeOnly), To: PIPELINE_READ},
+	{From: PIPELINE_READY, Event: EventDeleteRequested, Guard: guard(orphan), To: PIPELINE_DELETED},
+	{From: PIPELINE_READY, Event: EventDeleteRequested, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+	{From: PIPELINE_READY, Event: EventExpired, Guard: guard(orphan), To: PIPELINE_EXPIRED},
+	{From: PIPELINE_READY, Event: EventExpired, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+
+	{From: PIPELINE_UPDATE, Event: EventJobSucceeded, Guard: guard(recreate), To: PIPELINE_RECREATE},
+	{From: PIPELINE_UPDATE, Event: EventJobSucceeded, Guard: guard(replace), To: PIPELINE_REPLACE},
+	{From: PIPELINE_UPDATE, Event: EventJobSucceeded, Guard: guard(specChanged), To: PIPELINE_UPDATE},
+	{From: PIPELINE_UPDATE, Event: EventJobSucceeded, Guard: guard(Not(specChanged)), To: PIPELINE_READ},
+	{From: PIPELINE_UPDATE, Event: EventJobFailed, Guard: guard(autoRollback), To: PIPELINE_ROLLBACK},
+	{From: PIPELINE_UPDATE, Event: EventJobFailed, Guard: guard(Not(autoRollback)), To: PIPELINE_FAILED},
+	{From: PIPELINE_UPDATE, Event: EventJobTimedOut, Guard: guard(autoRollback), To: PIPELINE_ROLLBACK},
+	{From: PIPELINE_UPDATE, Event: EventJobTimedOut, Guard: guard(Not(autoRollback)), To: PIPELINE_FAILED},
+	{From: PIPELINE_UPDATE, Event: EventDeleteRequested, Guard: guard(orphan), To: PIPELINE_DELETED},
+	{From: PIPELINE_UPDATE, Event: EventDeleteRequested, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+
+	{From: PIPELINE_IMPORT, Event: EventJobSucceeded, To: PIPELINE_READY},
+	{From: PIPELINE_IMPORT, Event: EventJobFailed, To: PIPELINE_FAILED},
+	{From: PIPELINE_IMPORT, Event: EventJobTimedOut, To: PIPELINE_FAILED},
+	{From: PIPELINE_IMPORT, Event: EventDeleteRequested, To: PIPELINE_DELETED},
+
+	{From: PIPELINE_RECREATE, Event: EventJobSucceeded, To: PIPELINE_CREATE},
+	{From: PIPELINE_RECREATE, Event: EventJobFailed, To: PIPELINE_FAILED},
+	{From: PIPELINE_RECREATE, Event: EventJobTimedOut, To: PIPELINE_FAILED},
+	{From: PIPELINE_RECREATE, Event: EventDeleteRequested, Guard: guard(orphan), To: PIPELINE_DELETED},
+	{From: PIPELINE_RECREATE, Event: EventDeleteRequested, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+
+	{From: PIPELINE_REPLACE, Event: EventJobSucceeded, To: PIPELINE_READ},
+	{From: PIPELINE_REPLACE, Event: EventJobFailed, To: PIPELINE_FAILED},
+	{From: PIPELINE_REPLACE, Event: EventJobTimedOut, To: PIPELINE_FAILED},
+	{From: PIPELINE_REPLACE, Event: EventDeleteRequested, Guard: guard(orphan), To: PIPELINE_DELETED},
+	{From: PIPELINE_REPLACE, Event: EventDeleteRequested, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+
+	{From: PIPELINE_RETIRE, Event: EventJobSucceeded, To: PIPELINE_READY},
+	{From: PIPELINE_RETIRE, Event: EventJobFailed, To: PIPELINE_FAILED},
+	{From: PIPELINE_RETIRE, Event: EventJobTimedOut, To: PIPELINE_FAILED},
+	{From: PIPELINE_RETIRE, Event: EventDeleteRequested, Guard: guard(orphan), To: PIPELINE_DELETED},
+	{From: PIPELINE_RETIRE, Event: EventDeleteRequested, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+
+	{From: PIPELINE_ROLLBACK, Event: EventJobSucceeded, To: PIPELINE_READ},
+	{From: PIPELINE_ROLLBACK, Event: EventJobFailed, To: PIPELINE_FAILED},
+	{From: PIPELINE_ROLLBACK, Event: EventJobTimedOut, To: PIPELINE_FAILED},
+	{From: PIPELINE_ROLLBACK, Event: EventDeleteRequested, Guard: guard(orphan), To: PIPELINE_DELETED},
+	{From: PIPELINE_ROLLBACK, Event: EventDeleteRequested, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+
+	{From: PIPELINE_FAILED, Event: EventSpecChanged, Guard: guard(observeOnly), To: PIPELINE_READ},
+	{From: PIPELINE_FAILED, Event: EventSpecChanged, Guard: guard(importing), To: PIPELINE_IMPORT},
+	{From: PIPELINE_FAILED, Event: EventSpecChanged, Guard: guard(Not(provisioned)), To: PIPELINE_CREATE},
+	{From: PIPELINE_FAILED, Event: EventSpecChanged, Guard: guard(recreate), To: PIPELINE_RECREATE},
+	{From: PIPELINE_FAILED, Event: EventSpecChanged, Guard: guard(replace), To: PIPELINE_REPLACE},
+	{From: PIPELINE_FAILED, Event: EventSpecChanged, Guard: guard(provisioned), To: PIPELINE_UPDATE},
+	{From: PIPELINE_FAILED, Event: EventDeleteRequested, Guard: guard(orphan), To: PIPELINE_DELETED},
+	{From: PIPELINE_FAILED, Event: EventDeleteRequested, Guard: guard(importing), To: PIPELINE_DELETED},
+	{From: PIPELINE_FAILED, Event: EventDeleteRequested, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+	{From: PIPELINE_FAILED, Event: EventRollbackRequested, Guard: guard(rollbackAvailable), To: PIPELINE_ROLLBACK},
+	{From: PIPELINE_FAILED, Event: EventRefreshDue, Guard: guard(observeOnly), To: PIPELINE_READ},
+	{From: PIPELINE_FAILED, Event: EventExpired, Guard: guard(orphan), To: PIPELINE_EXPIRED},
+	{From: PIPELINE_FAILED, Event: EventExpired, Guard: guard(importing), To: PIPELINE_EXPIRED},
+	{From: PIPELINE_FAILED, Event: EventExpired, Guard: guard(Not(orphan)), To: PIPELINE_DELETE},
+
+	{From: PIPELINE_DELETE, Event: EventJobSucceeded, Guard: guard(replacing), To: PIPELINE_DELETE},
+	{From: PIPELINE_DELETE, Event: EventJobSucceeded, Guard: guard(expiring), To: PIPELINE_EXPIRED},
+	{From: PIPELINE_DELETE, Event: EventJobSucceeded, Guard: guard(Not(replacing)), To: PIPELINE_DELETED},
+	{From: PIPELINE_DELETE, Event: EventJobFailed, To: PIPELINE_FAILED},
+	{From: PIPELINE_DELETE, Event: EventJobTimedOut, To: PIPELINE_FAILED},
+
+	{From: PIPELINE_EXPIRED, Event: EventSpecChanged, Guard: guard(expiring), To: PIPELINE_EXPIRED},
+	{From: PIPELINE_EXPIRED, Event: EventSpecChanged, Guard: guard(observeOnly), To: PIPELINE_READ},
+	{From: PIPELINE_EXPIRED, Event: EventSpecChanged, Guard: guard(Not(observeOnly)), To: PIPELINE_CREATE},
+	{From: PIPELINE_EXPIRED, Event: EventDeleteRequested, To: PIPELINE_DELETED},
+}
+
+// States lists every state of the state machine, in the order they first
+// appear in the transition table.
+func States() []string {
+	var states []string
+	seen := map[string]bool{}
+	for _, t := range Transitions {
+		for _, state := range []string{t.From, t.To} {
+			if !seen[state] {
+				seen[state] = true
+				states = append(states, state)
+			}
+		}
+	}
+	return states
+}
+
+// IllegalTransitionError is returned for an event the current state has no
+// (enabled) transition for.
+type IllegalTransitionError struct {
+	From  string
+	Event Event
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("no transition from state %q on event %s", stateName(e.From), e.Event)
+}
+
+// Next returns the state runner moves to on event.
+func Next(runner *v1alpha1.ServiceRunner, event Event) (string, error) {
+	for _, t := range Transitions {
+		if t.From != runner.Status.State || t.Event != event {
+			continue
+		}
+		if t.Guard != nil && !t.Guard.Check(runner) {
+			continue
+		}
+		return t.To, nil
+	}
+	return "", &ResolveError{
+		Class: ErrorIllegalTransition,
+		Err:   &IllegalTransitionError{From: runner.Status.State, Event: event},
+	}
+}
+
+// Advance observes the runner and, if something happened, takes the matching
+// transition: the entry action of the next state runs, and only once it has
+// succeeded is the runner moved to that state.  When the event was a job
+// failure, the failure is returned once the runner has moved; a job which
+// succeeded but whose outputs can't be used counts as failed.  Operations run
+// with the executors registered in executors.  The expiry of the runner is
+// looked at first.
+func Advance(ctx context.Context, runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) (ctrl.Result, error) {
+	p := &Pipeline{serviceRunner: runner, client: client, executors: executors}
+	wait, err := p.expire(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	res, err := p.advance(ctx)
+	return sooner(res, wait), err
+}
+
+// advance takes the transition matching what the runner is facing, if any.
+func (p *Pipeline) advance(ctx context.Context) (ctrl.Result, error) {
+	runner := p.serviceRunner
+	observed, err := p.Observe(ctx)
+	if err != nil || observed.Event == "" {
+		return ctrl.Result{RequeueAfter: observed.RequeueAfter}, err
+	}
+
+	next, err := Next(runner, observed.Event)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := p.unlock(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+	if observed.Event == EventJobSucceeded {
+		// the state the operation left is the one the next works on
+		commitState(runner)
+	}
+	if observed.Event == EventJobSucceeded || observed.Event == EventJobFailed || observed.Event == EventJobTimedOut {
+		now := metav1.Now()
+		runner.Status.Operation.FinishedAt = &now
+	}
+	res, err := p.enter(ctx, next)
+	if observed.Event == EventJobSucceeded && Classify(err) == ErrorJobFailed {
+		// the run succeeded, but what it output can't be used, e.g. a read
+		// whose output is malformed: it failed after all
+		failed, illegal := Next(runner, EventJobFailed)
+		if illegal != nil {
+			return ctrl.Result{}, illegal
+		}
+		observed.Cause = err
+		res, err = p.enter(ctx, failed)
+	}
+	if err != nil {
+		return res, err
+	}
+	return res, observed.Cause
+}
+
+// enter resolves the state next, and moves the runner to it once resolved.
+func (p *Pipeline) enter(ctx context.Context, next string) (ctrl.Result, error) {
+	resolver, err := GetResolver(next, p.serviceRunner, p.client, p.executors)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	res, err := resolver.Resolve(ctx)
+	if err != nil {
+		return res, err
+	}
+	p.serviceRunner.Status.State = next
+	return res, nil
+}
+
+// Observation is the event a runner is facing.
+type Observation struct {
+	// Event is empty when nothing happened.
+	Event Event
+
+	// Cause is the job failure behind a failure event.
+	Cause error
+
+	// RequeueAfter is when to look again, when nothing happened but
+	// something is due, such as a refresh.
+	RequeueAfter time.Duration
+}
+
+// Observe determines the event the runner is facing, if any.  While the
+// current operation runs, nothing happens, not even a deletion, and it is
+// polled again when due; once it has finished, a deletion request takes
+// precedence over its result.
+func (p *Pipeline) Observe(ctx context.Context) (Observation, error) {
+	runner := p.serviceRunner
+	deleting := !runner.DeletionTimestamp.IsZero()
+
+	switch runner.Status.State {
+	case PIPELINE_CREATE, PIPELINE_READ, PIPELINE_UPDATE, PIPELINE_DELETE, PIPELINE_IMPORT,
+		PIPELINE_RECREATE, PIPELINE_REPLACE, PIPELINE_RETIRE, PIPELINE_ROLLBACK:
+		status, err := p.Poll(ctx)
+		if err != nil {
+			return Observation{}, err
+		}
+		switch {
+		case status.State == RunRunning:
+			return Observation{RequeueAfter: status.RetryAfter}, nil
+		case deleting && runner.Status.State != PIPELINE_DELETE:
+			return Observation{Event: EventDeleteRequested}, nil
+		case status.State == RunTimedOut:
+			return Observation{Event: EventJobTimedOut, Cause: JobFailed("%s", status.Message)}, nil
+		case status.State == RunFailed:
+			return Observation{Event: EventJobFailed, Cause: JobFailed("%s", status.Message)}, nil
+		default:
+			return Observation{Event: EventJobSucceeded}, nil
+		}
+	}
+
+	switch {
+	case deleting:
+		if wait := deleteRetryIn(runner); wait > 0 {
+			return Observation{RequeueAfter: wait}, nil
+		}
+		return Observation{Event: EventDeleteRequested}, nil
+	case specChanged.Check(runner):
+		return Observation{Event: EventSpecChanged}, nil
+	case runner.Status.State != PIPELINE_EXPIRED && expiring.Check(runner):
+		if wait := deleteRetryIn(runner); wait > 0 {
+			return Observation{RequeueAfter: wait}, nil
+		}
+		return Observation{Event: EventExpired}, nil
+	case runner.Status.State == PIPELINE_FAILED && rollbackRequested(runner):
+		return Observation{Event: EventRollbackRequested}, nil
+	}
+	if due, ok := refreshDue(runner); ok {
+		if wait := time.Until(due); wait > 0 {
+			return Observation{RequeueAfter: wait}, nil
+		}
+		return Observation{Event: EventRefreshDue}, nil
+	}
+	return Observation{}, nil
+}
+
+func stateName(state string) string {
+	if state == PIPELINE_NEW {
+		return "New"
+	}
+	return state
+}
+
+func transitionLabel(t Transition) string {
+	if t.Guard == nil {
+		return string(t.Event)
+	}
+	return fmt.Sprintf("%s [%s]", t.Event, t.Guard.Name)
+}
+
+// Mermaid renders the state machine as a Mermaid state diagram.
+func Mermaid() string {
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "stateDiagram-v2")
+	for _, t := range Transitions {
+		from := stateName(t.From)
+		if t.From == PIPELINE_NEW {
+			from = "[*]"
+		}
+		fmt.Fprintf(b, "    %s --> %s: %s\n", from, stateName(t.To), transitionLabel(t))
+	}
+	fmt.Fprintf(b, "    %s --> [*]\n", PIPELINE_DELETED)
+	return b.String()
+}
+
+// DOT renders the state machine as a Graphviz digraph.
+func DOT() string {
+	b := &strings.Builder{}
+	fmt.Fprintln(b, "digraph ServiceRunner {")
+	states := States()
+	sort.Strings(states)
+	for _, state := range states {
+		fmt.Fprintf(b, "    %q;\n", stateName(state))
+	}
+	for _, t := range Transitions {
+		fmt.Fprintf(b, "    %q -> %q [label=%q];\n", stateName(t.From), stateName(t.To), transitionLabel(t))
+	}
+	fmt.Fprintln(b, "}")
+	return b.String()
+}
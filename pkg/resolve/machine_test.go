@@ -0,0 +1,445 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// any matches a runner whatever its last operation was, or whether its spec
+// changed.
+const any = "*"
+
+const (
+	changed   = "changed"
+	unchanged = "unchanged"
+)
+
+func TestNext(t *testing.T) {
+	// every legal transition, keyed by state, event, and what the guards look
+	// at: the last operation and whether the spec changed since it launched
+	legal := []struct {
+		from      string
+		event     Event
+		operation string
+		spec      string
+		want      string
+	}{
+		{PIPELINE_NEW, EventSpecChanged, any, any, PIPELINE_CREATE},
+		{PIPELINE_NEW, EventDeleteRequested, any, any, PIPELINE_DELETED},
+		{PIPELINE_NEW, EventExpired, any, any, PIPELINE_EXPIRED},
+
+		{PIPELINE_CREATE, EventJobSucceeded, any, unchanged, PIPELINE_READ},
+		{PIPELINE_CREATE, EventJobSucceeded, any, changed, PIPELINE_UPDATE},
+		{PIPELINE_CREATE, EventJobFailed, any, any, PIPELINE_FAILED},
+		{PIPELINE_CREATE, EventJobTimedOut, any, any, PIPELINE_FAILED},
+		{PIPELINE_CREATE, EventDeleteRequested, any, any, PIPELINE_DELETE},
+
+		{PIPELINE_READ, EventJobSucceeded, any, any, PIPELINE_READY},
+		{PIPELINE_READ, EventJobFailed, any, any, PIPELINE_FAILED},
+		{PIPELINE_READ, EventJobTimedOut, any, any, PIPELINE_FAILED},
+		{PIPELINE_READ, EventDeleteRequested, any, any, PIPELINE_DELETE},
+
+		{PIPELINE_READY, EventSpecChanged, any, any, PIPELINE_UPDATE},
+		{PIPELINE_READY, EventDeleteRequested, any, any, PIPELINE_DELETE},
+		{PIPELINE_READY, EventExpired, any, any, PIPELINE_DELETE},
+
+		{PIPELINE_UPDATE, EventJobSucceeded, any, unchanged, PIPELINE_READ},
+		{PIPELINE_UPDATE, EventJobSucceeded, any, changed, PIPELINE_UPDATE},
+		{PIPELINE_UPDATE, EventJobFailed, any, any, PIPELINE_FAILED},
+		{PIPELINE_UPDATE, EventJobTimedOut, any, any, PIPELINE_FAILED},
+		{PIPELINE_UPDATE, EventDeleteRequested, any, any, PIPELINE_DELETE},
+
+		{PIPELINE_FAILED, EventSpecChanged, "", any, PIPELINE_CREATE},
+		{PIPELINE_FAILED, EventSpecChanged, OPERATION_CREATE, any, PIPELINE_CREATE},
+		{PIPELINE_FAILED, EventSpecChanged, OPERATION_READ, any, PIPELINE_UPDATE},
+		{PIPELINE_FAILED, EventSpecChanged, OPERATION_UPDATE, any, PIPELINE_UPDATE},
+		{PIPELINE_FAILED, EventSpecChanged, OPERATION_DELETE, any, PIPELINE_UPDATE},
+		{PIPELINE_FAILED, EventSpecChanged, OPERATION_IMPORT, any, PIPELINE_UPDATE},
+		{PIPELINE_FAILED, EventDeleteRequested, any, any, PIPELINE_DELETE},
+		{PIPELINE_FAILED, EventExpired, any, any, PIPELINE_DELETE},
+
+		{PIPELINE_IMPORT, EventJobSucceeded, any, any, PIPELINE_READY},
+		{PIPELINE_IMPORT, EventJobFailed, any, any, PIPELINE_FAILED},
+		{PIPELINE_IMPORT, EventJobTimedOut, any, any, PIPELINE_FAILED},
+		{PIPELINE_IMPORT, EventDeleteRequested, any, any, PIPELINE_DELETED},
+
+		{PIPELINE_RECREATE, EventJobSucceeded, any, any, PIPELINE_CREATE},
+		{PIPELINE_RECREATE, EventJobFailed, any, any, PIPELINE_FAILED},
+		{PIPELINE_RECREATE, EventJobTimedOut, any, any, PIPELINE_FAILED},
+		{PIPELINE_RECREATE, EventDeleteRequested, any, any, PIPELINE_DELETE},
+
+		{PIPELINE_REPLACE, EventJobSucceeded, any, any, PIPELINE_READ},
+		{PIPELINE_REPLACE, EventJobFailed, any, any, PIPELINE_FAILED},
+		{PIPELINE_REPLACE, EventJobTimedOut, any, any, PIPELINE_FAILED},
+		{PIPELINE_REPLACE, EventDeleteRequested, any, any, PIPELINE_DELETE},
+
+		{PIPELINE_RETIRE, EventJobSucceeded, any, any, PIPELINE_READY},
+		{PIPELINE_RETIRE, EventJobFailed, any, any, PIPELINE_FAILED},
+		{PIPELINE_RETIRE, EventJobTimedOut, any, any, PIPELINE_FAILED},
+		{PIPELINE_RETIRE, EventDeleteRequested, any, any, PIPELINE_DELETE},
+
+		{PIPELINE_ROLLBACK, EventJobSucceeded, any, any, PIPELINE_READ},
+		{PIPELINE_ROLLBACK, EventJobFailed, any, any, PIPELINE_FAILED},
+		{PIPELINE_ROLLBACK, EventJobTimedOut, any, any, PIPELINE_FAILED},
+		{PIPELINE_ROLLBACK, EventDeleteRequested, any, any, PIPELINE_DELETE},
+
+		{PIPELINE_DELETE, EventJobSucceeded, any, any, PIPELINE_DELETED},
+		{PIPELINE_DELETE, EventJobFailed, any, any, PIPELINE_FAILED},
+		{PIPELINE_DELETE, EventJobTimedOut, any, any, PIPELINE_FAILED},
+
+		{PIPELINE_EXPIRED, EventSpecChanged, any, any, PIPELINE_CREATE},
+		{PIPELINE_EXPIRED, EventDeleteRequested, any, any, PIPELINE_DELETED},
+	}
+	expected := func(from string, event Event, operation, spec string) (string, bool) {
+		for _, l := range legal {
+			if l.from == from && l.event == event &&
+				(l.operation == any || l.operation == operation) &&
+				(l.spec == any || l.spec == spec) {
+				return l.want, true
+			}
+		}
+		return "", false
+	}
+
+	states := States()
+	if len(states) != 14 {
+		t.Fatalf("States() = %v, want the 14 pipeline states", states)
+	}
+	operations := []string{"", OPERATION_CREATE, OPERATION_READ, OPERATION_UPDATE, OPERATION_DELETE, OPERATION_IMPORT}
+	for _, state := range states {
+		for _, event := range Events {
+			for _, operation := range operations {
+				for _, spec := range []string{changed, unchanged} {
+					name := fmt.Sprintf("%s/%s/%s/%s", stateName(state), event, operation, spec)
+					t.Run(name, func(t *testing.T) {
+						runner := newTestRunner(state)
+						runner.Status.Operation = nil
+						if operation != "" {
+							runner.Status.Operation = &v1alpha1.ServiceRunnerOperation{Name: operation}
+						}
+						runner.Status.ApplyingGeneration = 1
+						if spec == changed {
+							runner.Generation = 2
+						}
+
+						got, err := Next(runner, event)
+						want, ok := expected(state, event, operation, spec)
+						if !ok {
+							var illegal *IllegalTransitionError
+							if !errors.As(err, &illegal) || Classify(err) != ErrorIllegalTransition {
+								t.Fatalf("Next() = %q, %v; want an illegal transition", got, err)
+							}
+							return
+						}
+						if err != nil || got != want {
+							t.Fatalf("Next() = %q, %v; want %q", got, err, want)
+						}
+					})
+				}
+			}
+		}
+	}
+}
+
+func TestTransitionsAreDeterministic(t *testing.T) {
+	// transitions sharing a state and an event must be told apart by their
+	// guards; an unguarded one would shadow the others
+	for i, tr := range Transitions {
+		for j, other := range Transitions {
+			if i != j && tr.Guard == nil && other.From == tr.From && other.Event == tr.Event {
+				t.Errorf("unguarded transition %s -> %s on %s overlaps with -> %s", stateName(tr.From), stateName(tr.To), tr.Event, stateName(other.To))
+			}
+		}
+	}
+}
+
+func TestDiagrams(t *testing.T) {
+	mermaid := Mermaid()
+	dot := DOT()
+	if !strings.HasPrefix(mermaid, "stateDiagram-v2\n") {
+		t.Errorf("Mermaid() does not start a state diagram:\n%s", mermaid)
+	}
+	if !strings.HasPrefix(dot, "digraph ServiceRunner {\n") || !strings.HasSuffix(dot, "}\n") {
+		t.Errorf("DOT() is not a digraph:\n%s", dot)
+	}
+	for _, tr := range Transitions {
+		label := transitionLabel(tr)
+		if !strings.Contains(mermaid, fmt.Sprintf("--> %s: %s\n", stateName(tr.To), label)) {
+			t.Errorf("Mermaid() is missing %s -> %s on %s", stateName(tr.From), stateName(tr.To), label)
+		}
+		edge := fmt.Sprintf("%q -> %q [label=%q];", stateName(tr.From), stateName(tr.To), label)
+		if !strings.Contains(dot, edge) {
+			t.Errorf("DOT() is missing %s", edge)
+		}
+	}
+}
+
+func finishJob(t *testing.T, c client.Client, name string, condition batchv1.JobConditionType, reason string) {
+	t.Helper()
+	job := &batchv1.Job{}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "apps", Name: name}, job); err != nil {
+		t.Fatal(err)
+	}
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+		Type:   condition,
+		Status: corev1.ConditionTrue,
+		Reason: reason,
+	})
+	if condition == batchv1.JobComplete {
+		job.Status.Succeeded = 1
+	}
+	if err := c.Status().Update(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("create, read and update", func(t *testing.T) {
+		runner := newTestRunner(PIPELINE_NEW)
+		c := newTestClient(t, runner)
+
+		steps := []struct {
+			finish  string
+			want    string
+			wantJob string
+		}{
+			{"", PIPELINE_CREATE, "db-create-1"},
+			{"db-create-1", PIPELINE_READ, "db-read-1"},
+		}
+		for _, step := range steps {
+			logs := &FakeLogReader{}
+			if step.finish != "" {
+				// the create outputs nothing
+				logs = finishRead(t, c, step.finish, "")
+			}
+			if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); err != nil {
+				t.Fatalf("Advance() error = %v", err)
+			}
+			if runner.Status.State != step.want || runner.Status.Operation.Job != step.wantJob {
+				t.Fatalf("runner in %q running %v, want %q running %s", runner.Status.State, runner.Status.Operation, step.want, step.wantJob)
+			}
+		}
+
+		// nothing happens while the read job runs
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil || runner.Status.State != PIPELINE_READ {
+			t.Fatalf("Advance() = %v in %q, want to wait in %q", err, runner.Status.State, PIPELINE_READ)
+		}
+
+		// once it succeeded, its output is published as the binding
+		finishJob(t, c, "db-read-1", batchv1.JobComplete, "")
+		job := &batchv1.Job{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: "db-read-1"}, job); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Create(ctx, newTestPod("apps", "db-read-1-x", job.UID, job.Spec.Template.Labels)); err != nil {
+			t.Fatal(err)
+		}
+		logs := &FakeLogReader{}
+		logs.SetLog("apps", "db-read-1-x", `{"host":"db.apps.svc"}`)
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); err != nil {
+			t.Fatalf("Advance() error = %v", err)
+		}
+		if runner.Status.State != PIPELINE_READY || runner.Status.ObservedGeneration != 1 || runner.Status.Binding == nil {
+			t.Fatalf("runner = %+v, want ready with a binding", runner.Status)
+		}
+		secret := &corev1.Secret{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: runner.Status.Binding.Name}, secret); err != nil {
+			t.Fatal(err)
+		}
+		if string(secret.Data["host"]) != "db.apps.svc" {
+			t.Fatalf("binding = %v, want the read job output", secret.Data)
+		}
+
+		// a runner which got ready moves on to update once its spec changes
+		runner.Generation = 2
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+			t.Fatalf("Advance() error = %v", err)
+		}
+		if runner.Status.State != PIPELINE_UPDATE || runner.Status.Operation.Job != "db-update-2" || runner.Status.ApplyingGeneration != 2 {
+			t.Fatalf("runner = %+v, want updating generation 2", runner.Status)
+		}
+	})
+
+	t.Run("edits during an operation are coalesced", func(t *testing.T) {
+		runner := newTestRunner(PIPELINE_NEW)
+		runner.Spec.ServiceParam = map[string]string{"SIZE": "small"}
+		c := newTestClient(t, runner)
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+
+		// two edits while the create job runs; neither is acted upon yet
+		for generation, size := range []string{2: "medium", 3: "large"} {
+			if size == "" {
+				continue
+			}
+			runner.Generation = int64(generation)
+			runner.Spec.ServiceParam = map[string]string{"SIZE": size}
+			if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil || runner.Status.State != PIPELINE_CREATE {
+				t.Fatalf("Advance() = %v in %q, want to wait for the create job", err, runner.Status.State)
+			}
+		}
+		if runner.Status.ApplyingGeneration != 1 || runner.Status.AppliedParams["SIZE"] != "small" {
+			t.Fatalf("runner = %+v, want generation 1 still being applied", runner.Status)
+		}
+
+		// once it succeeds, a single update applies the newest spec
+		finishJob(t, c, "db-create-1", batchv1.JobComplete, "")
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if runner.Status.State != PIPELINE_UPDATE || runner.Status.Operation.Job != "db-update-3" {
+			t.Fatalf("runner = %+v, want updating to generation 3", runner.Status)
+		}
+		job := &batchv1.Job{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: "db-update-3"}, job); err != nil {
+			t.Fatal(err)
+		}
+		if env := job.Spec.Template.Spec.Containers[0].Env; env[0].Value != "large" || env[1].Name != "PREVIOUS_SIZE" || env[1].Value != "small" {
+			t.Fatalf("update job env = %v, want the newest parameters, from those of the create", env)
+		}
+
+		// with nothing left to apply, the service is read with what was applied
+		finishJob(t, c, "db-update-3", batchv1.JobComplete, "")
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if runner.Status.State != PIPELINE_READ || runner.Status.Operation.Job != "db-read-3" || runner.Status.ObservedGeneration != 0 {
+			t.Fatalf("runner = %+v, want reading generation 3", runner.Status)
+		}
+	})
+
+	t.Run("failed launch keeps the state", func(t *testing.T) {
+		runner := newTestRunner(PIPELINE_NEW)
+		c := &failingClient{Client: newTestClient(t, runner), err: apierrors.NewServiceUnavailable("etcd is down")}
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorTransient {
+			t.Fatalf("Advance() error = %v, want a transient error", err)
+		}
+		if runner.Status.State != PIPELINE_NEW || runner.Status.ObservedGeneration != 0 || runner.Status.Operation != nil {
+			t.Fatalf("runner = %+v, want it untouched", runner.Status)
+		}
+	})
+
+	t.Run("timed out job fails the runner", func(t *testing.T) {
+		runner := newTestRunner(PIPELINE_NEW)
+		c := newTestClient(t, runner)
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		finishJob(t, c, "db-create-1", batchv1.JobFailed, "DeadlineExceeded")
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorJobFailed {
+			t.Fatalf("Advance() error = %v, want the job failure", err)
+		}
+		if runner.Status.State != PIPELINE_FAILED || runner.Status.Operation.Name != OPERATION_CREATE {
+			t.Fatalf("runner = %+v, want failed on create", runner.Status)
+		}
+
+		// fixing the spec retries the creation
+		runner.Generation = 2
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if runner.Status.State != PIPELINE_CREATE || runner.Status.Operation.Job != "db-create-2" {
+			t.Fatalf("runner = %+v, want creating again", runner.Status)
+		}
+	})
+
+	t.Run("deletion", func(t *testing.T) {
+		runner := newTestRunner(PIPELINE_READY)
+		now := metav1.Now()
+		runner.DeletionTimestamp = &now
+		c := newTestClient(t, runner)
+
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if runner.Status.State != PIPELINE_DELETE || runner.Status.Operation.Job != "db-delete-1" {
+			t.Fatalf("runner = %+v, want deleting", runner.Status)
+		}
+
+		finishJob(t, c, "db-delete-1", batchv1.JobFailed, "BackoffLimitExceeded")
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorJobFailed || runner.Status.State != PIPELINE_FAILED {
+			t.Fatalf("Advance() = %v in %q, want failed", err, runner.Status.State)
+		}
+
+		// a failed deletion is retried after a backoff
+		res, err := Advance(ctx, runner, c, newTestExecutors(c, nil))
+		if err != nil || runner.Status.State != PIPELINE_FAILED || res.RequeueAfter <= 0 || res.RequeueAfter > DeleteRetryDelay {
+			t.Fatalf("Advance() = %+v, %v in %q, want to wait for the retry", res, err, runner.Status.State)
+		}
+		failedAt := metav1.NewTime(runner.Status.Operation.FinishedAt.Add(-DeleteRetryDelay))
+		runner.Status.Operation.FinishedAt = &failedAt
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if runner.Status.State != PIPELINE_DELETE || runner.Status.Operation.Job != "db-delete-1-2" || runner.Status.Operation.Attempt != 2 {
+			t.Fatalf("runner = %+v, want deleting again", runner.Status)
+		}
+
+		// the backoff doubles with every attempt
+		finishJob(t, c, "db-delete-1-2", batchv1.JobFailed, "BackoffLimitExceeded")
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorJobFailed {
+			t.Fatalf("Advance() = %v, want the job failure", err)
+		}
+		res, err = Advance(ctx, runner, c, newTestExecutors(c, nil))
+		if err != nil || runner.Status.State != PIPELINE_FAILED || res.RequeueAfter <= DeleteRetryDelay || res.RequeueAfter > 2*DeleteRetryDelay {
+			t.Fatalf("Advance() = %+v, %v in %q, want to wait twice as long", res, err, runner.Status.State)
+		}
+	})
+
+	t.Run("deleting a new runner releases it", func(t *testing.T) {
+		runner := newTestRunner(PIPELINE_NEW)
+		c := newTestClient(t, runner)
+		now := metav1.Now()
+		runner.DeletionTimestamp = &now
+
+		if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if runner.Status.State != PIPELINE_DELETED || len(runner.Finalizers) != 0 {
+			t.Fatalf("runner = %+v, want released", runner)
+		}
+	})
+}
+
+func TestGetResolverUnknownState(t *testing.T) {
+	runner := newTestRunner(PIPELINE_READY)
+	if resolver, err := GetResolver("Bogus", runner, newTestClient(t, runner), nil); resolver != nil || Classify(err) != ErrorIllegalTransition {
+		t.Errorf("GetResolver() = %v, %v; want an illegal transition", resolver, err)
+	}
+}
+
+func TestAdvanceMalformedOutput(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_READ)
+	c := newTestClient(t, runner, newTestJob("db-read-1"))
+	logs := finishRead(t, c, "db-read-1", "not json")
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); Classify(err) != ErrorJobFailed {
+		t.Fatalf("Advance() error = %v, want the job failure", err)
+	}
+	if runner.Status.State != PIPELINE_FAILED || runner.Status.Binding != nil {
+		t.Fatalf("runner = %+v, want failed without a binding", runner.Status)
+	}
+
+	// fixing the spec recovers the runner
+	runner.Generation = 2
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_UPDATE {
+		t.Errorf("runner = %+v, want updating", runner.Status)
+	}
+}
@@ -0,0 +1,49 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// STAGE_REFRESH names the runs of the reads refreshing the binding of an
+// ObserveOnly runner.
+const STAGE_REFRESH = "refresh"
+
+// refreshDue returns when runner is due to read its service again, if it is
+// an ObserveOnly runner with a refresh interval, done reading.
+func refreshDue(runner *v1alpha1.ServiceRunner) (time.Time, bool) {
+	interval := runner.Spec.RefreshInterval
+	if !observeOnly.Check(runner) || interval == nil || interval.Duration <= 0 || runner.Status.RefreshTime == nil {
+		return time.Time{}, false
+	}
+	if runner.Status.State != PIPELINE_READY && runner.Status.State != PIPELINE_FAILED {
+		return time.Time{}, false
+	}
+	return runner.Status.RefreshTime.Add(interval.Duration), true
+}
+
+// observe launches the read of the service of an ObserveOnly runner, with
+// the parameters of its current generation.  Each read is named after the
+// previous one, so that it's launched once even if its status isn't
+// recorded.
+func (r *Read) observe(ctx context.Context) (ctrl.Result, error) {
+	runner := r.serviceRunner
+	id := stageJobName(runner, OPERATION_READ, runner.Generation)
+	if runner.Status.RefreshTime != nil {
+		id = fmt.Sprintf("%s-%d", stageJobName(runner, STAGE_REFRESH, runner.Generation), runner.Status.RefreshTime.Unix())
+	}
+	op := Operation{Name: OPERATION_READ, ID: id, Params: runner.Spec.ServiceParam}
+	if err := r.Launch(ctx, op); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	r.applying()
+	now := metav1.Now()
+	runner.Status.RefreshTime = &now
+	return ctrl.Result{}, nil
+}
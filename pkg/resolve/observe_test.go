@@ -0,0 +1,79 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestObserveOnly(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_NEW)
+	runner.Spec.ManagementPolicy = v1alpha1.ManagementObserveOnly
+	runner.Spec.RefreshInterval = &metav1.Duration{Duration: time.Minute}
+	runner.Spec.ServiceParam = map[string]string{"SIZE": "small"}
+	c := newTestClient(t, runner)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_READ || runner.Status.Operation.Job != "db-read-1" || runner.Status.RefreshTime == nil {
+		t.Fatalf("runner = %+v, want reading the observed service", runner.Status)
+	}
+	if env := jobEnv(t, c, "db-read-1"); env["SIZE"] != "small" {
+		t.Errorf("read job env = %v, want the parameters of the spec", env)
+	}
+	logs := finishRead(t, c, "db-read-1", `{"host":"db.apps.svc"}`)
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); err != nil {
+		t.Fatal(err)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: "db"}, secret); err != nil || runner.Status.State != PIPELINE_READY {
+		t.Fatalf("runner = %+v, binding: %v; want ready with a binding", runner.Status, err)
+	}
+
+	// the refresh waits for its interval
+	res, err := Advance(ctx, runner, c, newTestExecutors(c, nil))
+	if err != nil || runner.Status.State != PIPELINE_READY || res.RequeueAfter <= 0 || res.RequeueAfter > time.Minute {
+		t.Fatalf("Advance() = %+v, %v in %q, want to wait for the refresh", res, err, runner.Status.State)
+	}
+	refreshed := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+	runner.Status.RefreshTime = &refreshed
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("db-refresh-1-%d", refreshed.Unix())
+	if runner.Status.State != PIPELINE_READ || runner.Status.Operation.Job != want {
+		t.Fatalf("runner = %+v, want refreshing with %s", runner.Status, want)
+	}
+
+	// the observed service is never updated nor deleted
+	finishJob(t, c, want, batchv1.JobFailed, "BackoffLimitExceeded")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorJobFailed {
+		t.Fatalf("Advance() = %v, want the read failure", err)
+	}
+	runner.Generation = 2
+	runner.Spec.ServiceParam = map[string]string{"SIZE": "large"}
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_READ || runner.Status.Operation.Name != OPERATION_READ || runner.Status.AppliedParams["SIZE"] != "large" {
+		t.Fatalf("runner = %+v, want reading with the new parameters", runner.Status)
+	}
+	finishJob(t, c, runner.Status.Operation.Job, batchv1.JobFailed, "BackoffLimitExceeded")
+	now := metav1.Now()
+	runner.DeletionTimestamp = &now
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_DELETED {
+		t.Errorf("runner = %+v, want released without deleting the service", runner.Status)
+	}
+}
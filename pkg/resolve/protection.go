@@ -0,0 +1,45 @@
+package resolve
+
+import (
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DeletionProtectionAnnotation keeps the service of a runner from being
+// deleted, whether by the deletion of the runner or by a replacement, for as
+// long as it is set.
+const DeletionProtectionAnnotation = "servicerunner.io/deletion-protection"
+
+// Reasons of the DeletionProtected condition.
+const (
+	ReasonProtected       = "Protected"
+	ReasonDeletionRefused = "DeletionRefused"
+)
+
+// deletionProtected reports whether runner is annotated against deletions.
+func deletionProtected(runner *v1alpha1.ServiceRunner) bool {
+	_, ok := runner.Annotations[DeletionProtectionAnnotation]
+	return ok
+}
+
+// setDeletionProtected reflects the protection of runner, and whether err
+// refused a deletion, in the DeletionProtected condition.
+func setDeletionProtected(runner *v1alpha1.ServiceRunner, err error) {
+	if !deletionProtected(runner) {
+		meta.RemoveStatusCondition(&runner.Status.Conditions, v1alpha1.ConditionDeletionProtected)
+		return
+	}
+	protected := metav1.Condition{
+		Type:               v1alpha1.ConditionDeletionProtected,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: runner.Generation,
+		Reason:             ReasonProtected,
+		Message:            "the service won't be deleted while the runner is annotated with " + DeletionProtectionAnnotation,
+	}
+	if Classify(err) == ErrorDeletionProtected {
+		protected.Reason = ReasonDeletionRefused
+		protected.Message = err.Error()
+	}
+	meta.SetStatusCondition(&runner.Status.Conditions, protected)
+}
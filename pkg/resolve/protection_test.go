@@ -0,0 +1,74 @@
+package resolve
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestOrphan(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_READY)
+	now := metav1.Now()
+	runner.DeletionTimestamp = &now
+	runner.Spec.DeletionPolicy = v1alpha1.DeletionOrphan
+	c := newTestClient(t, runner)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_DELETED || len(runner.Finalizers) != 0 {
+		t.Errorf("runner = %+v, want released", runner.Status)
+	}
+	jobs := &batchv1.JobList{}
+	if err := c.List(ctx, jobs); err != nil || len(jobs.Items) != 0 {
+		t.Errorf("jobs = %v, %v, want the service left alone", jobs.Items, err)
+	}
+}
+
+func TestDeletionProtection(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_READY)
+	now := metav1.Now()
+	runner.DeletionTimestamp = &now
+	runner.Annotations = map[string]string{DeletionProtectionAnnotation: "true"}
+	c := newTestClient(t, runner)
+
+	_, err := Advance(ctx, runner, c, newTestExecutors(c, nil))
+	if Classify(err) != ErrorDeletionProtected || runner.Status.State != PIPELINE_READY {
+		t.Fatalf("Advance() = %v in %q, want the deletion refused", err, runner.Status.State)
+	}
+	SetConditions(runner, err)
+	if condition := conditionOf(runner, v1alpha1.ConditionDeletionProtected); condition != "True/"+ReasonDeletionRefused {
+		t.Errorf("DeletionProtected = %q, want the refusal", condition)
+	}
+	job := &batchv1.Job{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: "db-delete-1"}, job); Classify(err) != ErrorNotFound {
+		t.Errorf("delete job = %v, want none", err)
+	}
+
+	runner.Annotations = nil
+	_, err = Advance(ctx, runner, c, newTestExecutors(c, nil))
+	if err != nil || runner.Status.State != PIPELINE_DELETE || runner.Status.Operation.Job != "db-delete-1" {
+		t.Fatalf("Advance() = %v, runner = %+v, want deleting once unprotected", err, runner.Status)
+	}
+	SetConditions(runner, err)
+	if conditionOf(runner, v1alpha1.ConditionDeletionProtected) != "" {
+		t.Errorf("conditions = %v, want no protection", runner.Status.Conditions)
+	}
+}
+
+func TestDeletionProtectionRefusesRecreate(t *testing.T) {
+	ctx := context.Background()
+	runner := regionChanged(newTestRunner(PIPELINE_READY), v1alpha1.UpdateRecreate)
+	runner.Annotations = map[string]string{DeletionProtectionAnnotation: ""}
+	c := newTestClient(t, runner)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorDeletionProtected || runner.Status.State != PIPELINE_READY {
+		t.Errorf("Advance() = %v in %q, want the recreation refused", err, runner.Status.State)
+	}
+}
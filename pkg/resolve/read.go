@@ -2,7 +2,6 @@ package resolve
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -14,51 +13,44 @@ type Read struct {
 	Pipeline
 }
 
-func MakeRead(runner *v1alpha1.ServiceRunner, client client.Client) *Read {
+func MakeRead(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Read {
 	return &Read{
 		Pipeline: Pipeline{
 			serviceRunner: runner,
 			client:        client,
+			executors:     executors,
 		},
 	}
 }
 
 // JobName implements Resolver
 func (r *Read) JobName() string {
-	return fmt.Sprintf("%s-read", r.serviceRunner.Name)
+	return stageJobName(r.serviceRunner, OPERATION_READ, applyingGeneration(r.serviceRunner))
 }
 
-// Resolve implements Resolver
+// Resolve launches the read job, once the create or update job succeeded; the
+// finished job is pruned once the new state has been recorded.  A create job
+// which output the ID of its service records it first, so that the read
+// locks the service; other executors only output anything from reads.
+// ObserveOnly runners read their service on their own
 func (r *Read) Resolve(ctx context.Context) (reconcile.Result, error) {
-	res := ctrl.Result{Requeue: true}
-
-	// get the status of the create job
-	prevJob, err := r.FindPreviousJob(ctx)
-	if err != nil {
-		return res, err
+	if observeOnly.Check(r.serviceRunner) {
+		return r.observe(ctx)
 	}
-	if prevJob.Status.Succeeded != 1 {
-		// the create job hasn't succeeded yet; did it explicitly fail?
-		for _, cond := range prevJob.Status.Conditions {
-			if cond.Reason == "Failed" && cond.Status == "True" {
-				return ctrl.Result{}, fmt.Errorf("Failed to create service, bailing")
-			}
+	if previous := r.serviceRunner.Status.Operation; previous != nil && previous.Name == OPERATION_CREATE &&
+		(previous.Executor == "" || previous.Executor == JobExecutorName) {
+		outputs, err := r.Outputs(ctx)
+		switch {
+		case Classify(err) == ErrorJobFailed:
+			// creates needn't output anything; the read names the service then
+		case err != nil:
+			return ctrl.Result{}, err
+		case outputs[ServiceIDOutput] != "":
+			r.serviceRunner.Status.ServiceId = outputs[ServiceIDOutput]
 		}
-		return res, fmt.Errorf("Job not yet complete, retrying")
-	}
-
-	r.client.Delete(ctx, prevJob)
-
-	// enqueue the update job
-	job := JobTemplate(r, "/read")
-	err = r.client.Create(ctx, job)
-	if err == nil {
-		res.Requeue = false
 	}
-
-	r.serviceRunner.Status.State = PIPELINE_READ
-	return res, err
-
+	op := Operation{Name: OPERATION_READ, ID: r.JobName(), Params: r.Params()}
+	return ctrl.Result{}, r.Launch(ctx, op)
 }
 
 var _ Resolver = &Read{}
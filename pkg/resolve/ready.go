@@ -2,26 +2,31 @@ package resolve
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 
 	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
+// ServiceIDOutput is the output of a create or read naming the service, which
+// the runner records as status.serviceId, e.g. to lock it.
+const ServiceIDOutput = "service_id"
+
 type Ready struct {
 	Pipeline
 }
 
-func MakeReady(runner *v1alpha1.ServiceRunner, client client.Client) *Ready {
+func MakeReady(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Ready {
 	return &Ready{
 		Pipeline: Pipeline{
 			serviceRunner: runner,
 			client:        client,
+			executors:     executors,
 		},
 	}
 }
@@ -33,65 +38,71 @@ func (*Ready) JobName() string {
 	return ""
 }
 
-// Resolve implements Resolver
+// Resolve publishes the binding data produced by the read job, once it
+// succeeded.  After a replacement, the binding was published before the
+// replaced service was retired; there is nothing left to do but forget it
 func (r *Ready) Resolve(ctx context.Context) (reconcile.Result, error) {
-	res := ctrl.Result{Requeue: true}
+	runner := r.serviceRunner
+	if runner.Status.State == PIPELINE_RETIRE {
+		runner.Status.Replaced = nil
+	} else if err := r.publish(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
 
-	// get the status of the update job
-	prevJob, err := r.FindPreviousJob(ctx)
-	if err != nil {
-		return res, err
+	if rollbackReason(runner) == ReasonRollingBack {
+		setRolledBack(runner, v1.ConditionTrue, ReasonRolledBack,
+			"generation %d was rolled back to the parameters of generation %d", runner.Generation, runner.Status.LastReady.Generation)
+	} else {
+		meta.RemoveStatusCondition(&runner.Status.Conditions, v1alpha1.ConditionRolledBack)
 	}
-	if prevJob.Status.Succeeded != 1 {
-		// the create job hasn't succeeded yet; did it explicitly fail?
-		for _, cond := range prevJob.Status.Conditions {
-			if cond.Reason == "Failed" && cond.Status == "True" {
-				return ctrl.Result{}, fmt.Errorf("Failed to read service binding information, bailing")
-			}
-		}
-		return res, fmt.Errorf("Job not yet complete, retrying")
+	if observeOnly.Check(runner) && runner.Spec.RefreshInterval != nil {
+		return ctrl.Result{RequeueAfter: runner.Spec.RefreshInterval.Duration}, nil
 	}
+	return ctrl.Result{}, nil
+}
 
-	// read the last line of its logs; we're expecting a key-value map
-	// serialized into json, which we'll convert into a secret.
-	log, err := r.JobLog(ctx)
+// publish posts the outputs of the read job as the binding secret of the
+// generation being applied, and snapshots them unless they are those of a
+// rollback to the snapshot.
+func (p *Pipeline) publish(ctx context.Context) error {
+	// the executor hands back the key-value map the read produced, which
+	// we'll convert into a secret.
+	secretData, err := p.Outputs(ctx)
 	if err != nil {
-		return res, err
-	}
-	secretData := map[string]string{}
-	err = json.Unmarshal([]byte(log), &secretData)
-	if err != nil {
-		return res, err
+		return err
 	}
 
-	// post the data as a secret
+	// post the data as a secret; it is written in place, so that replaying
+	// this stage after a lost status write converges on the same binding
 	secret := corev1.Secret{
 		ObjectMeta: v1.ObjectMeta{
-			Name:      r.serviceRunner.Name,
-			Namespace: r.serviceRunner.Namespace,
-			OwnerReferences: []v1.OwnerReference{
-				{
-					APIVersion: r.serviceRunner.APIVersion,
-					Kind:       r.serviceRunner.Kind,
-					Name:       r.serviceRunner.Name,
-					UID:        r.serviceRunner.UID,
-				},
-			},
+			Name:      p.serviceRunner.Name,
+			Namespace: p.serviceRunner.Namespace,
 		},
-		StringData: secretData,
 	}
-	err = r.client.Create(ctx, &secret)
+	_, err = controllerutil.CreateOrUpdate(ctx, p.client, &secret, func() error {
+		secret.OwnerReferences = []v1.OwnerReference{RunnerOwner(p.serviceRunner)}
+		secret.Data = map[string][]byte{}
+		for key, value := range secretData {
+			secret.Data[key] = []byte(value)
+		}
+		return nil
+	})
 	if err != nil {
-		return res, err
+		return err
+	}
+	if rollbackReason(p.serviceRunner) != ReasonRollingBack {
+		if err := p.snapshot(ctx, secretData); err != nil {
+			return err
+		}
 	}
 
-	r.serviceRunner.Status.Binding = &v1alpha1.ServiceRunnerBindingRef{Name: secret.Name}
-
-	// delete the update job; it was successful, and we don't need it anymore
-	if err = r.client.Delete(ctx, prevJob); err != nil {
-		return res, err
+	if id := secretData[ServiceIDOutput]; id != "" {
+		p.serviceRunner.Status.ServiceId = id
 	}
 
-	r.serviceRunner.Status.State = PIPELINE_READY
-	return res, nil
+	// the read job is pruned once the new state has been recorded
+	p.serviceRunner.Status.Binding = &v1alpha1.ServiceRunnerBindingRef{Name: secret.Name}
+	p.serviceRunner.Status.ObservedGeneration = applyingGeneration(p.serviceRunner)
+	return nil
 }
@@ -0,0 +1,171 @@
+package resolve
+
+import (
+	"context"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Stages of the runs replacing a service; they name the runs, which perform
+// create and delete operations.
+const (
+	STAGE_RECREATE = "recreate"
+	STAGE_REPLACE  = "replace"
+	STAGE_RETIRE   = "retire"
+)
+
+// immutableChanged reports whether the spec changes parameters the service
+// can't change in place, compared to those it was applied with.
+func immutableChanged(runner *v1alpha1.ServiceRunner) bool {
+	for _, key := range runner.Spec.ImmutableParams {
+		want, inSpec := runner.Spec.ServiceParam[key]
+		applied, inService := runner.Status.AppliedParams[key]
+		if want != applied || inSpec != inService {
+			return true
+		}
+	}
+	return false
+}
+
+// Recreate represents the pipeline stage where the service is deleted, to be
+// created anew with the current generation
+type Recreate struct {
+	Pipeline
+}
+
+var _ Resolver = &Recreate{}
+
+func MakeRecreate(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Recreate {
+	return &Recreate{
+		Pipeline: Pipeline{
+			serviceRunner: runner,
+			client:        client,
+			executors:     executors,
+		},
+	}
+}
+
+func (r *Recreate) JobName() string {
+	return stageJobName(r.serviceRunner, STAGE_RECREATE, r.serviceRunner.Generation)
+}
+
+// Resolve launches the delete job of the service as it was applied; the
+// create job follows once it succeeded
+func (r *Recreate) Resolve(ctx context.Context) (ctrl.Result, error) {
+	op := Operation{Name: OPERATION_DELETE, ID: r.JobName(), Params: r.Params()}
+	return ctrl.Result{}, r.Launch(ctx, op)
+}
+
+// Replace represents the pipeline stage where the replacement of the service
+// is created with the current generation, next to the replaced one
+type Replace struct {
+	Pipeline
+}
+
+var _ Resolver = &Replace{}
+
+func MakeReplace(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Replace {
+	return &Replace{
+		Pipeline: Pipeline{
+			serviceRunner: runner,
+			client:        client,
+			executors:     executors,
+		},
+	}
+}
+
+func (r *Replace) JobName() string {
+	return stageJobName(r.serviceRunner, STAGE_REPLACE, r.serviceRunner.Generation)
+}
+
+// Params returns the parameters of the current generation
+func (r *Replace) Params() map[string]string {
+	return r.serviceRunner.Spec.ServiceParam
+}
+
+// Resolve launches the create job of the replacement, and records the
+// replaced service so that it is deleted later on.  When a previous
+// replacement failed, the service it was replacing is still the one to
+// retire.  Executors running a single service per runner can't replace it
+func (r *Replace) Resolve(ctx context.Context) (ctrl.Result, error) {
+	name := executorName(r.serviceRunner)
+	executor, err := r.executors.Get(name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if _, ok := executor.(SingleInstance); ok {
+		return ctrl.Result{}, InvalidSpec("the %s executor runs a single service per runner, it can't update with the %s strategy",
+			name, v1alpha1.UpdateCreateBeforeDelete)
+	}
+	// the replaced service is recorded first, for the replacement not to be
+	// launched against it
+	replaced := r.serviceRunner.Status.Replaced
+	if replaced == nil {
+		r.serviceRunner.Status.Replaced = &v1alpha1.ServiceRunnerReplacement{
+			Generation: applyingGeneration(r.serviceRunner),
+			Params:     r.Pipeline.Params(),
+			ServiceId:  r.serviceRunner.Status.ServiceId,
+		}
+	}
+	op := Operation{Name: OPERATION_CREATE, ID: r.JobName(), Params: r.Params()}
+	if err := r.Launch(ctx, op); err != nil {
+		r.serviceRunner.Status.Replaced = replaced
+		return ctrl.Result{}, err
+	}
+	r.applying()
+	return ctrl.Result{}, nil
+}
+
+// serviceID returns the ID of the service of runner, or "" while it is a
+// replacement which hasn't been published yet, whose ID isn't known.
+func serviceID(runner *v1alpha1.ServiceRunner) string {
+	if replaced := runner.Status.Replaced; replaced != nil && replaced.ServiceId == runner.Status.ServiceId {
+		return ""
+	}
+	return runner.Status.ServiceId
+}
+
+// Retire represents the pipeline stage where the binding is switched to the
+// replacement, and the replaced service deleted
+type Retire struct {
+	Pipeline
+}
+
+var _ Resolver = &Retire{}
+
+func MakeRetire(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Retire {
+	return &Retire{
+		Pipeline: Pipeline{
+			serviceRunner: runner,
+			client:        client,
+			executors:     executors,
+		},
+	}
+}
+
+func (r *Retire) JobName() string {
+	return stageJobName(r.serviceRunner, STAGE_RETIRE, r.serviceRunner.Status.Replaced.Generation)
+}
+
+// Params returns the parameters the replaced service was applied with
+func (r *Retire) Params() map[string]string {
+	return r.serviceRunner.Status.Replaced.Params
+}
+
+// Resolve publishes the binding of the replacement, once read, then launches
+// the delete job of the replaced service.  Publishing makes the replacement
+// the service of the runner: the delete runs against the recorded one
+func (r *Retire) Resolve(ctx context.Context) (ctrl.Result, error) {
+	if err := r.publish(ctx); err != nil {
+		return ctrl.Result{}, err
+	}
+	op := Operation{
+		Name:      OPERATION_DELETE,
+		ID:        r.JobName(),
+		Params:    r.Params(),
+		ServiceID: r.serviceRunner.Status.Replaced.ServiceId,
+	}
+	return ctrl.Result{}, r.Launch(ctx, op)
+}
@@ -0,0 +1,208 @@
+package resolve
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// regionChanged makes the second generation of runner change its immutable
+// REGION from eu to us, along with SIZE.
+func regionChanged(runner *v1alpha1.ServiceRunner, strategy v1alpha1.UpdateStrategy) *v1alpha1.ServiceRunner {
+	runner.Generation = 2
+	runner.Spec.UpdateStrategy = strategy
+	runner.Spec.ImmutableParams = []string{"REGION"}
+	runner.Spec.ServiceParam = map[string]string{"REGION": "us", "SIZE": "large"}
+	runner.Status.AppliedParams = map[string]string{"REGION": "eu", "SIZE": "small"}
+	return runner
+}
+
+// jobEnv returns the environment of the job named name.
+func jobEnv(t *testing.T, c client.Client, name string) map[string]string {
+	t.Helper()
+	job := &batchv1.Job{}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "apps", Name: name}, job); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{}
+	for _, v := range job.Spec.Template.Spec.Containers[0].Env {
+		env[v.Name] = v.Value
+	}
+	return env
+}
+
+func TestNextWithImmutableParams(t *testing.T) {
+	tests := []struct {
+		strategy  v1alpha1.UpdateStrategy
+		immutable bool
+		want      string
+	}{
+		{"", true, PIPELINE_UPDATE},
+		{v1alpha1.UpdateInPlace, true, PIPELINE_UPDATE},
+		{v1alpha1.UpdateRecreate, true, PIPELINE_RECREATE},
+		{v1alpha1.UpdateRecreate, false, PIPELINE_UPDATE},
+		{v1alpha1.UpdateCreateBeforeDelete, true, PIPELINE_REPLACE},
+		{v1alpha1.UpdateCreateBeforeDelete, false, PIPELINE_UPDATE},
+	}
+	for _, tt := range tests {
+		runner := regionChanged(newTestRunner(PIPELINE_READY), tt.strategy)
+		if !tt.immutable {
+			runner.Spec.ServiceParam["REGION"] = "eu"
+		}
+		for _, from := range []string{PIPELINE_READY, PIPELINE_FAILED} {
+			runner.Status.State = from
+			runner.Status.Operation = &v1alpha1.ServiceRunnerOperation{Name: OPERATION_UPDATE}
+			if got, err := Next(runner, EventSpecChanged); err != nil || got != tt.want {
+				t.Errorf("Next() from %s with strategy %q, immutable change %v = %q, %v; want %q", stateName(from), tt.strategy, tt.immutable, got, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestRecreate(t *testing.T) {
+	ctx := context.Background()
+	runner := regionChanged(newTestRunner(PIPELINE_READY), v1alpha1.UpdateRecreate)
+	c := newTestClient(t, runner)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_RECREATE || runner.Status.Operation.Name != OPERATION_DELETE || runner.Status.Operation.Job != "db-recreate-2" {
+		t.Fatalf("runner = %+v, want deleting the service to recreate it", runner.Status)
+	}
+	if env := jobEnv(t, c, "db-recreate-2"); env["REGION"] != "eu" {
+		t.Errorf("delete job env = %v, want the service deleted as it was applied", env)
+	}
+
+	finishJob(t, c, "db-recreate-2", batchv1.JobComplete, "")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_CREATE || runner.Status.Operation.Job != "db-create-2" || runner.Status.ApplyingGeneration != 2 {
+		t.Fatalf("runner = %+v, want creating generation 2", runner.Status)
+	}
+	if env := jobEnv(t, c, "db-create-2"); env["REGION"] != "us" || env["SIZE"] != "large" {
+		t.Errorf("create job env = %v, want the new parameters", env)
+	}
+}
+
+func TestCreateBeforeDelete(t *testing.T) {
+	ctx := context.Background()
+	runner := regionChanged(newTestRunner(PIPELINE_READY), v1alpha1.UpdateCreateBeforeDelete)
+	runner.Status.ServiceId = "db-eu"
+	c := newTestClient(t, runner)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_REPLACE || runner.Status.Operation.Name != OPERATION_CREATE || runner.Status.Operation.Job != "db-replace-2" {
+		t.Fatalf("runner = %+v, want creating the replacement", runner.Status)
+	}
+	if replaced := runner.Status.Replaced; replaced == nil || replaced.Generation != 1 || replaced.Params["REGION"] != "eu" || replaced.ServiceId != "db-eu" {
+		t.Fatalf("replaced = %+v, want db-eu, generation 1 in eu", replaced)
+	}
+	if env := jobEnv(t, c, "db-replace-2"); env["RUNNER_SERVICE_ID"] != "" {
+		t.Errorf("replace job env = %v, want no service ID for the replacement", env)
+	}
+
+	logs := finishRead(t, c, "db-replace-2", "")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_READ || runner.Status.Operation.Job != "db-read-2" {
+		t.Fatalf("runner = %+v, want reading the replacement", runner.Status)
+	}
+
+	// the fake client leaves the UIDs of jobs empty: the pod of the create
+	// goes, not to be taken for the pod of the read
+	if err := c.Delete(ctx, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "db-replace-2-x"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// once read, the binding points at the replacement before the replaced
+	// service is deleted
+	logs = finishRead(t, c, "db-read-2", `{"host":"db.us.example.com","service_id":"db-us"}`)
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_RETIRE || runner.Status.Operation.Name != OPERATION_DELETE || runner.Status.Operation.Job != "db-retire-1" {
+		t.Fatalf("runner = %+v, want retiring the replaced service", runner.Status)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: "db"}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["host"]) != "db.us.example.com" || runner.Status.ObservedGeneration != 2 {
+		t.Errorf("binding = %v at generation %d, want the replacement", secret.Data, runner.Status.ObservedGeneration)
+	}
+	if env := jobEnv(t, c, "db-retire-1"); env["REGION"] != "eu" || env["RUNNER_SERVICE_ID"] != "db-eu" {
+		t.Errorf("retire job env = %v, want the replaced service", env)
+	}
+	if runner.Status.ServiceId != "db-us" || runner.Status.Lock == nil || runner.Status.Lock.Key != "job:quay.io/example/crud/db-eu" {
+		t.Errorf("runner = %+v, want the replacement published and the replaced service locked", runner.Status)
+	}
+
+	finishJob(t, c, "db-retire-1", batchv1.JobComplete, "")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_READY || runner.Status.Replaced != nil {
+		t.Fatalf("runner = %+v, want ready with the replaced service gone", runner.Status)
+	}
+}
+
+// singleInstance is a stub executor running a single service per runner.
+type singleInstance struct {
+	*stubExecutor
+}
+
+func (singleInstance) SingleInstance() {}
+
+func TestCreateBeforeDeleteSingleInstance(t *testing.T) {
+	ctx := context.Background()
+	runner := regionChanged(newTestRunner(PIPELINE_READY), v1alpha1.UpdateCreateBeforeDelete)
+	runner.Spec.Executor = &v1alpha1.ServiceRunnerExecutor{Name: "stub"}
+	c := newTestClient(t, runner)
+	stub := newStubExecutor()
+	executors := newTestExecutors(c, nil)
+	executors.Register("stub", singleInstance{stub})
+
+	_, err := Advance(ctx, runner, c, executors)
+	if Classify(err) != ErrorInvalidSpec || runner.Status.State != PIPELINE_READY || runner.Status.Replaced != nil || len(stub.launched) != 0 {
+		t.Fatalf("Advance() = %v, runner = %+v, launched %v; want the strategy refused", err, runner.Status, stub.launched)
+	}
+}
+
+func TestDeleteRetiresReplaced(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_DELETE)
+	runner.Generation, runner.Status.ApplyingGeneration = 2, 2
+	runner.Status.Operation.Job = "db-delete-2"
+	runner.Status.ServiceId = "db-us"
+	runner.Status.Replaced = &v1alpha1.ServiceRunnerReplacement{Generation: 1, Params: map[string]string{"REGION": "eu"}, ServiceId: "db-eu"}
+	c := newTestClient(t, runner, newTestJob("db-delete-2"))
+	finishJob(t, c, "db-delete-2", batchv1.JobComplete, "")
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_DELETE || runner.Status.Operation.Job != "db-delete-1" || runner.Status.Replaced != nil {
+		t.Fatalf("runner = %+v, want deleting the replaced service", runner.Status)
+	}
+	if env := jobEnv(t, c, "db-delete-1"); env["REGION"] != "eu" || env["RUNNER_SERVICE_ID"] != "db-eu" {
+		t.Errorf("delete job env = %v, want the replaced service", env)
+	}
+
+	finishJob(t, c, "db-delete-1", batchv1.JobComplete, "")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_DELETED {
+		t.Fatalf("runner in %q, want deleted", runner.Status.State)
+	}
+}
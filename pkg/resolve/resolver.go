@@ -3,23 +3,16 @@ package resolve
 import (
 	"context"
 	"fmt"
-	"strings"
 
 	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
-	batchv1 "k8s.io/api/batch/v1"
-	corev1 "k8s.io/api/core/v1"
-	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/util/uuid"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Resolver interface {
 	JobName() string
+	Params() map[string]string
 	Resolve(ctx context.Context) (ctrl.Result, error)
 	ServiceRunner() *v1alpha1.ServiceRunner
 }
@@ -27,181 +20,244 @@ type Resolver interface {
 type Pipeline struct {
 	serviceRunner *v1alpha1.ServiceRunner
 	client        client.Client
+	executors     *Registry
 }
 
 const (
-	PIPELINE_CREATE = "Creating"
-	PIPELINE_UPDATE = "Updating"
-	PIPELINE_READ   = "Reading"
-	PIPELINE_READY  = "Ready"
+	PIPELINE_NEW     = ""
+	PIPELINE_CREATE  = "Creating"
+	PIPELINE_UPDATE  = "Updating"
+	PIPELINE_READ    = "Reading"
+	PIPELINE_READY   = "Ready"
+	PIPELINE_DELETE  = "Deleting"
+	PIPELINE_DELETED = "Deleted"
+	PIPELINE_FAILED  = "Failed"
+
+	PIPELINE_RECREATE = "Recreating"
+	PIPELINE_REPLACE  = "Replacing"
+	PIPELINE_RETIRE   = "Retiring"
+
+	PIPELINE_ROLLBACK = "RollingBack"
+
+	PIPELINE_IMPORT = "Importing"
+
+	PIPELINE_EXPIRED = "Expired"
+)
+
+const (
+	OPERATION_CREATE = "create"
+	OPERATION_READ   = "read"
+	OPERATION_UPDATE = "update"
+	OPERATION_DELETE = "delete"
+
+	// OPERATION_IMPORT validates an existing service and fetches its
+	// outputs, like a read of a service the runner didn't create.
+	OPERATION_IMPORT = "import"
 )
 
-// GetResolver fetches the resolver for the current state of the service
-// runner.  State transitions are defined as follows:
-// - No previous state -> Create
-// - Create            -> Read
-// - Read              -> Ready
-// - Ready             -> Update (service runner changed, we need to re-run)
-// - Update            -> Read
-func GetResolver(runner *v1alpha1.ServiceRunner, client client.Client) Resolver {
-	switch runner.Status.State {
+// Operations images may declare which the pipeline doesn't run yet.
+const (
+	OPERATION_HEALTH = "health"
+	OPERATION_BACKUP = "backup"
+)
+
+// operations lists the operations spec.serviceImage.operations may configure.
+var operations = []string{OPERATION_CREATE, OPERATION_READ, OPERATION_UPDATE, OPERATION_DELETE, OPERATION_IMPORT, OPERATION_HEALTH, OPERATION_BACKUP}
+
+// Finalizer keeps a runner around until its service has been deleted.
+const Finalizer = "servicerunner.io/finalizer"
+
+// GetResolver fetches the resolver for the given state of the service runner;
+// its Resolve is the entry action of that state.  See Transitions for how the
+// runner moves between states.  An unknown state is an illegal transition.
+func GetResolver(state string, runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) (Resolver, error) {
+	switch state {
 	case PIPELINE_CREATE:
-		return MakeRead(runner, client)
-	case PIPELINE_UPDATE:
-		return MakeRead(runner, client)
+		return MakeCreate(runner, client, executors), nil
 	case PIPELINE_READ:
-		return MakeReady(runner, client)
+		return MakeRead(runner, client, executors), nil
 	case PIPELINE_READY:
-		return MakeUpdate(runner, client)
+		return MakeReady(runner, client, executors), nil
+	case PIPELINE_UPDATE:
+		return MakeUpdate(runner, client, executors), nil
+	case PIPELINE_DELETE:
+		return MakeDelete(runner, client, executors), nil
+	case PIPELINE_DELETED:
+		return MakeDeleted(runner, client, executors), nil
+	case PIPELINE_FAILED:
+		return MakeFailed(runner, client, executors), nil
+	case PIPELINE_RECREATE:
+		return MakeRecreate(runner, client, executors), nil
+	case PIPELINE_REPLACE:
+		return MakeReplace(runner, client, executors), nil
+	case PIPELINE_RETIRE:
+		return MakeRetire(runner, client, executors), nil
+	case PIPELINE_ROLLBACK:
+		return MakeRollback(runner, client, executors), nil
+	case PIPELINE_IMPORT:
+		return MakeImport(runner, client, executors), nil
+	case PIPELINE_EXPIRED:
+		return MakeExpired(runner, client, executors), nil
 	default:
-		return MakeCreate(runner, client)
+		return nil, &ResolveError{Class: ErrorIllegalTransition, Err: fmt.Errorf("no resolver for state %q", state)}
 	}
 }
 
-func (p *Pipeline) FindPreviousJob(ctx context.Context) (*batchv1.Job, error) {
-	var creator Resolver
-	switch p.serviceRunner.Status.State {
-	case PIPELINE_READ:
-		creator = MakeRead(p.serviceRunner, p.client)
-	case PIPELINE_CREATE:
-		creator = MakeCreate(p.serviceRunner, p.client)
-	case PIPELINE_READY:
-		creator = MakeReady(p.serviceRunner, p.client)
-	case PIPELINE_UPDATE:
-		creator = MakeUpdate(p.serviceRunner, p.client)
-	default:
-		return nil, fmt.Errorf("Unexpected job state %v", p.serviceRunner.Status.State)
-	}
-	jobName := creator.JobName()
+// executor returns the executor of the operation launched last.
+func (p *Pipeline) executor() (Executor, error) {
+	return p.executors.Get(p.serviceRunner.Status.Operation.Executor)
+}
 
-	jobList := batchv1.JobList{}
-	err := p.client.List(ctx, &jobList, &client.ListOptions{
-		Namespace:     p.serviceRunner.Namespace,
-		LabelSelector: labels.SelectorFromSet(labels.Set{JobLabel: p.serviceRunner.Name}),
-	})
+// Launch runs op with the executor the runner selects and records it as the
+// current operation, counting its attempts.  The service is locked first;
+// deletions are refused while the runner is protected against them.
+func (p *Pipeline) Launch(ctx context.Context, op Operation) error {
+	name := executorName(p.serviceRunner)
+	executor, err := p.executors.Get(name)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	op.Attempt = p.attempt(op.Name)
+	if op.ServiceID == "" {
+		op.ServiceID = serviceID(p.serviceRunner)
 	}
-	for _, job := range jobList.Items {
-		if strings.HasPrefix(job.Name, jobName) {
-			return &job, nil
-		}
+	if p.serviceRunner.Spec.State != nil {
+		op.StateVersion = nextState(p.serviceRunner)
 	}
+	if op.Name == OPERATION_DELETE && deletionProtected(p.serviceRunner) {
+		return DeletionProtected("refusing to delete the service of runner %s: it is annotated with %s", p.serviceRunner.Name, DeletionProtectionAnnotation)
+	}
+	if err := p.lock(ctx, op.ServiceID); err != nil {
+		return err
+	}
+	ref, err := executor.Launch(ctx, p.serviceRunner, op)
+	if err != nil {
+		return err
+	}
+	p.serviceRunner.Status.Operation = &v1alpha1.ServiceRunnerOperation{
+		Name:         op.Name,
+		Job:          ref,
+		Executor:     name,
+		Attempt:      op.Attempt,
+		StateVersion: op.StateVersion,
+	}
+	return nil
+}
 
-	return nil, fmt.Errorf("Job not found!")
+// attempt numbers the launch of the operation with the given name: 1, or the
+// attempt after the one which failed.
+func (p *Pipeline) attempt(name string) int32 {
+	previous := p.serviceRunner.Status.Operation
+	if p.serviceRunner.Status.State != PIPELINE_FAILED || previous == nil || previous.Name != name {
+		return 1
+	}
+	// runners recorded before attempts were counted made one
+	if previous.Attempt == 0 {
+		return 2
+	}
+	return previous.Attempt + 1
 }
 
-func (p *Pipeline) ServiceRunner() *v1alpha1.ServiceRunner {
-	return p.serviceRunner
+// Poll reports the state of the operation launched last, and records the
+// progress of its steps.  A running operation whose progress isn't watched
+// is polled again after PollInterval, unless the backend said when.
+func (p *Pipeline) Poll(ctx context.Context) (RunStatus, error) {
+	operation := p.serviceRunner.Status.Operation
+	if operation == nil || operation.Job == "" {
+		return RunStatus{}, fmt.Errorf("Unexpected job state %v", p.serviceRunner.Status.State)
+	}
+	executor, err := p.executor()
+	if err != nil {
+		return RunStatus{}, err
+	}
+	status, err := executor.Poll(ctx, p.serviceRunner, operation.Job)
+	if Classify(err) == ErrorNotFound {
+		return RunStatus{}, NotFound("run %s of operation %s not found: %v", operation.Job, operation.Name, err)
+	}
+	if err != nil {
+		return RunStatus{}, err
+	}
+	operation.Steps = status.Steps
+	if status.State == RunRunning && status.RetryAfter == 0 && !p.executors.watched(operation.Executor) {
+		status.RetryAfter = PollInterval
+	}
+	return status, nil
 }
 
-func (p *Pipeline) JobLog(ctx context.Context) ([]byte, error) {
-	namespace := p.serviceRunner.Namespace
-	job, err := p.FindPreviousJob(ctx)
+// Outputs returns the outputs of the operation launched last.
+func (p *Pipeline) Outputs(ctx context.Context) (map[string]string, error) {
+	executor, err := p.executor()
 	if err != nil {
 		return nil, err
 	}
+	return executor.Outputs(ctx, p.serviceRunner, p.serviceRunner.Status.Operation.Job)
+}
 
-	podList := corev1.PodList{}
-	err = p.client.List(ctx, &podList)
+// Release cancels the run of the operation original had launched, once
+// runner has moved on to another one.  It must only be called once the
+// runner status has been persisted, so that a restart never polls a run
+// which has already been cancelled.  The run of the current operation is
+// kept, e.g. for inspection while the runner is Failed.
+func Release(ctx context.Context, executors *Registry, original, runner *v1alpha1.ServiceRunner) error {
+	previous := original.Status.Operation
+	if previous == nil || previous.Job == "" {
+		return nil
+	}
+	if current := runner.Status.Operation; current != nil && current.Job == previous.Job && current.Executor == previous.Executor {
+		return nil
+	}
+	executor, err := executors.Get(previous.Executor)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return executor.Cancel(ctx, runner, previous.Job)
+}
 
-	var pod *v1.Pod = nil
-	for _, item := range podList.Items {
-		for _, owner := range item.GetOwnerReferences() {
-			if owner.Name == job.Name &&
-				owner.APIVersion == job.APIVersion &&
-				owner.Kind == job.Kind &&
-				owner.UID == job.UID {
-				pod = &item
-				break
-			}
-		}
-		if pod != nil {
-			break
-		}
+// reader returns the reader of the objects the manager doesn't cache.
+func (p *Pipeline) reader() client.Reader {
+	if p.executors.Reader != nil {
+		return p.executors.Reader
 	}
+	return p.client
+}
 
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		return nil, err
+func (p *Pipeline) ServiceRunner() *v1alpha1.ServiceRunner {
+	return p.serviceRunner
+}
+
+// Params returns the service parameters the stage operation runs with: by
+// default, those of the generation being applied.
+func (p *Pipeline) Params() map[string]string {
+	return p.serviceRunner.Status.AppliedParams
+}
+
+// applying records that the spec of the current generation is being applied.
+func (p *Pipeline) applying() {
+	p.serviceRunner.Status.ApplyingGeneration = p.serviceRunner.Generation
+	p.serviceRunner.Status.AppliedParams = map[string]string{}
+	for key, value := range p.serviceRunner.Spec.ServiceParam {
+		p.serviceRunner.Status.AppliedParams[key] = value
 	}
-	clientSet, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
+}
+
+// applyingGeneration returns the generation the runner applies.  Runners
+// recorded before ApplyingGeneration existed apply their ObservedGeneration.
+func applyingGeneration(runner *v1alpha1.ServiceRunner) int64 {
+	if runner.Status.ApplyingGeneration == 0 {
+		return runner.Status.ObservedGeneration
 	}
-	one := int64(1)
-	logRequest := clientSet.CoreV1().
-		Pods(namespace).
-		GetLogs(pod.Name, &v1.PodLogOptions{
-			TailLines: &one,
-		})
-
-	return logRequest.DoRaw(ctx)
-}
-
-func uniqueJobName() string {
-	return string(uuid.NewUUID())[0:4]
-}
-
-const CONTROL_PLANE_SECRET = "control-plane"
-const JobLabel = "servicerunner.io/job"
-
-func JobTemplate(c Resolver, command ...string) *batchv1.Job {
-	job := &batchv1.Job{}
-	serviceRunner := c.ServiceRunner()
-	job.Name = fmt.Sprintf("%s-%s", c.JobName(), uniqueJobName())
-	job.Namespace = serviceRunner.Namespace
-	job.Labels = map[string]string{
-		JobLabel: serviceRunner.Name,
-	}
-	job.OwnerReferences = []metav1.OwnerReference{
-		{
-			APIVersion: serviceRunner.APIVersion,
-			Kind:       serviceRunner.Kind,
-			Name:       serviceRunner.Name,
-			UID:        serviceRunner.GetUID(),
-		},
-	}
-	job.Spec.Template.Spec.Containers = []corev1.Container{
-		{
-			Name:    "runner",
-			Image:   serviceRunner.Spec.ServiceImage.CrudImage,
-			Env:     envVars(serviceRunner.Spec.ServiceParam),
-			Command: command,
-		},
-	}
-	if len(serviceRunner.Spec.ControlPlaneSecret) != 0 {
-		job.Spec.Template.Spec.Volumes = []corev1.Volume{
-			{
-				Name: CONTROL_PLANE_SECRET,
-				VolumeSource: corev1.VolumeSource{
-					Secret: &corev1.SecretVolumeSource{
-						SecretName: serviceRunner.Spec.ControlPlaneSecret,
-					},
-				},
-			},
-		}
-		job.Spec.Template.Spec.Containers[0].VolumeMounts = []v1.VolumeMount{
-			{
-				MountPath: "/",
-				Name:      CONTROL_PLANE_SECRET,
-			},
-		}
-	}
-	job.Spec.Template.Spec.RestartPolicy = v1.RestartPolicyOnFailure
-	return job
-}
-
-func envVars(vars map[string]string) []corev1.EnvVar {
-	var envVars []corev1.EnvVar
-	for key, value := range vars {
-		envVars = append(envVars, corev1.EnvVar{
-			Name:  key,
-			Value: value,
-		})
-	}
-	return envVars
+	return runner.Status.ApplyingGeneration
+}
+
+// stageJobName names the run of the given stage for a generation of the
+// runner.
+func stageJobName(runner *v1alpha1.ServiceRunner, stage string, generation int64) string {
+	return fmt.Sprintf("%s-%s-%d", runner.Name, stage, generation)
+}
+
+// RunnerOwner references runner as the controller of the objects the pipeline
+// and its executors create.  The kind is spelled out, as objects read through
+// a typed client carry no type metadata.
+func RunnerOwner(runner *v1alpha1.ServiceRunner) metav1.OwnerReference {
+	return *metav1.NewControllerRef(runner, v1alpha1.GroupVersion.WithKind("ServiceRunner"))
 }
@@ -0,0 +1,153 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// STAGE_ROLLBACK names the runs of the update operations rolling failed
+// updates back.
+const STAGE_ROLLBACK = "rollback"
+
+// RollbackAnnotation requests the rollback of the failed update of a runner
+// whose rollback policy is Manual; it is removed once the rollback starts.
+const RollbackAnnotation = "servicerunner.io/rollback"
+
+// Reasons of the RolledBack condition.
+const (
+	ReasonRollbackAvailable = "RollbackAvailable"
+	ReasonRollingBack       = "RollingBack"
+	ReasonRolledBack        = "RolledBack"
+	ReasonRollbackFailed    = "RollbackFailed"
+)
+
+// rollbackRequested reports whether runner is annotated for a rollback.
+func rollbackRequested(runner *v1alpha1.ServiceRunner) bool {
+	_, ok := runner.Annotations[RollbackAnnotation]
+	return ok
+}
+
+// rollbackReason returns the reason of the RolledBack condition, if any.
+func rollbackReason(runner *v1alpha1.ServiceRunner) string {
+	if c := meta.FindStatusCondition(runner.Status.Conditions, v1alpha1.ConditionRolledBack); c != nil {
+		return c.Reason
+	}
+	return ""
+}
+
+func setRolledBack(runner *v1alpha1.ServiceRunner, status metav1.ConditionStatus, reason, format string, args ...interface{}) {
+	meta.SetStatusCondition(&runner.Status.Conditions, metav1.Condition{
+		Type:               v1alpha1.ConditionRolledBack,
+		Status:             status,
+		ObservedGeneration: runner.Generation,
+		Reason:             reason,
+		Message:            fmt.Sprintf(format, args...),
+	})
+}
+
+// snapshotSecretName names the Secret holding the outputs of the snapshot of
+// runner.
+func snapshotSecretName(runner *v1alpha1.ServiceRunner) string {
+	return runner.Name + "-last-ready"
+}
+
+// snapshot records the service as published, with outputs, for failed
+// updates to be rolled back to.
+func (p *Pipeline) snapshot(ctx context.Context, outputs map[string]string) error {
+	runner := p.serviceRunner
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      snapshotSecretName(runner),
+			Namespace: runner.Namespace,
+		},
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, p.client, &secret, func() error {
+		secret.OwnerReferences = []metav1.OwnerReference{RunnerOwner(runner)}
+		secret.Data = map[string][]byte{}
+		for key, value := range outputs {
+			secret.Data[key] = []byte(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	params := map[string]string{}
+	for key, value := range runner.Status.AppliedParams {
+		params[key] = value
+	}
+	runner.Status.LastReady = &v1alpha1.ServiceRunnerSnapshot{
+		Generation:    applyingGeneration(runner),
+		Params:        params,
+		OutputsSecret: secret.Name,
+	}
+	return nil
+}
+
+// Rollback represents the pipeline stage where a failed update is rolled
+// back, by updating the service back to the parameters of the snapshot
+type Rollback struct {
+	Pipeline
+}
+
+var _ Resolver = &Rollback{}
+
+func MakeRollback(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Rollback {
+	return &Rollback{
+		Pipeline: Pipeline{
+			serviceRunner: runner,
+			client:        client,
+			executors:     executors,
+		},
+	}
+}
+
+func (r *Rollback) JobName() string {
+	return stageJobName(r.serviceRunner, STAGE_ROLLBACK, r.serviceRunner.Generation)
+}
+
+// Params returns the parameters of the snapshot
+func (r *Rollback) Params() map[string]string {
+	return r.serviceRunner.Status.LastReady.Params
+}
+
+// Resolve launches the update job rolling the service back.  The generation
+// which failed stays the one being applied, so that it isn't retried until
+// the spec changes again
+func (r *Rollback) Resolve(ctx context.Context) (ctrl.Result, error) {
+	runner := r.serviceRunner
+	op := Operation{Name: OPERATION_UPDATE, ID: r.JobName(), Params: r.Params(), Previous: r.Pipeline.Params()}
+	if err := r.Launch(ctx, op); err != nil {
+		return ctrl.Result{}, err
+	}
+	if rollbackRequested(runner) {
+		// the patched runner read back carries the stored status, which
+		// lacks the operation just launched
+		status := runner.Status.DeepCopy()
+		patch := client.MergeFrom(runner.DeepCopy())
+		delete(runner.Annotations, RollbackAnnotation)
+		if err := r.client.Patch(ctx, runner, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+		runner.Status = *status
+	}
+
+	snapshot := runner.Status.LastReady
+	runner.Status.ApplyingGeneration = runner.Generation
+	runner.Status.AppliedParams = map[string]string{}
+	for key, value := range snapshot.Params {
+		runner.Status.AppliedParams[key] = value
+	}
+	setRolledBack(runner, metav1.ConditionFalse, ReasonRollingBack,
+		"rolling generation %d back to the parameters of generation %d", runner.Generation, snapshot.Generation)
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,143 @@
+package resolve
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// finishRead completes the read job name, whose pod logs output; the logs
+// are served by the returned reader.
+func finishRead(t *testing.T, c client.Client, name, output string) *FakeLogReader {
+	t.Helper()
+	finishJob(t, c, name, batchv1.JobComplete, "")
+	job := &batchv1.Job{}
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "apps", Name: name}, job); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create(context.Background(), newTestPod("apps", name+"-x", job.UID, job.Labels)); err != nil {
+		t.Fatal(err)
+	}
+	logs := &FakeLogReader{}
+	logs.SetLog("apps", name+"-x", output)
+	return logs
+}
+
+// snapshotted makes the updating runner update its generation 2, raising
+// SIZE from small to large, after it was Ready with generation 1.
+func snapshotted(runner *v1alpha1.ServiceRunner, policy v1alpha1.RollbackPolicy) *v1alpha1.ServiceRunner {
+	runner.Generation, runner.Status.ApplyingGeneration = 2, 2
+	runner.Status.Operation.Job = "db-update-2"
+	runner.Spec.RollbackPolicy = policy
+	runner.Spec.ServiceParam = map[string]string{"SIZE": "large"}
+	runner.Status.AppliedParams = map[string]string{"SIZE": "large"}
+	runner.Status.LastReady = &v1alpha1.ServiceRunnerSnapshot{Generation: 1, Params: map[string]string{"SIZE": "small"}, OutputsSecret: "db-last-ready"}
+	return runner
+}
+
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_READ)
+	runner.Status.AppliedParams = map[string]string{"SIZE": "small"}
+	c := newTestClient(t, runner, newTestJob("db-read-1"))
+	logs := finishRead(t, c, "db-read-1", `{"host":"db.apps.svc"}`)
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := runner.Status.LastReady
+	if runner.Status.State != PIPELINE_READY || snapshot == nil || snapshot.Generation != 1 || snapshot.Params["SIZE"] != "small" {
+		t.Fatalf("runner = %+v, want ready with a snapshot of generation 1", runner.Status)
+	}
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: snapshot.OutputsSecret}, secret); err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["host"]) != "db.apps.svc" || len(secret.OwnerReferences) != 1 {
+		t.Errorf("snapshot secret = %+v, want the outputs, owned by the runner", secret)
+	}
+}
+
+func TestAutomaticRollback(t *testing.T) {
+	ctx := context.Background()
+	runner := snapshotted(newTestRunner(PIPELINE_UPDATE), v1alpha1.RollbackAutomatic)
+	c := newTestClient(t, runner, newTestJob("db-update-2"))
+	finishJob(t, c, "db-update-2", batchv1.JobFailed, "BackoffLimitExceeded")
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorJobFailed {
+		t.Fatalf("Advance() error = %v, want the update failure", err)
+	}
+	if runner.Status.State != PIPELINE_ROLLBACK || runner.Status.Operation.Name != OPERATION_UPDATE || runner.Status.Operation.Job != "db-rollback-2" {
+		t.Fatalf("runner = %+v, want rolling back", runner.Status)
+	}
+	if env := jobEnv(t, c, "db-rollback-2"); env["SIZE"] != "small" {
+		t.Errorf("rollback job env = %v, want the parameters of the snapshot", env)
+	}
+	if got := conditionOf(runner, v1alpha1.ConditionRolledBack); got != "False/"+ReasonRollingBack {
+		t.Errorf("RolledBack = %s, want rolling back", got)
+	}
+
+	finishJob(t, c, "db-rollback-2", batchv1.JobComplete, "")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_READ || runner.Status.Operation.Job != "db-read-2" {
+		t.Fatalf("runner = %+v, want reading the rolled back service", runner.Status)
+	}
+	logs := finishRead(t, c, "db-read-2", `{"host":"db.apps.svc"}`)
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_READY || conditionOf(runner, v1alpha1.ConditionRolledBack) != "True/"+ReasonRolledBack || runner.Status.LastReady.Generation != 1 {
+		t.Fatalf("runner = %+v, want ready, rolled back to the snapshot of generation 1", runner.Status)
+	}
+
+	// the generation which failed isn't retried
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil || runner.Status.State != PIPELINE_READY {
+		t.Fatalf("Advance() = %v in %q, want to stay ready", err, runner.Status.State)
+	}
+}
+
+func TestManualRollback(t *testing.T) {
+	ctx := context.Background()
+	runner := snapshotted(newTestRunner(PIPELINE_UPDATE), v1alpha1.RollbackManual)
+	c := newTestClient(t, runner, newTestJob("db-update-2"))
+	finishJob(t, c, "db-update-2", batchv1.JobFailed, "BackoffLimitExceeded")
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorJobFailed {
+		t.Fatalf("Advance() error = %v, want the update failure", err)
+	}
+	if runner.Status.State != PIPELINE_FAILED || conditionOf(runner, v1alpha1.ConditionRolledBack) != "False/"+ReasonRollbackAvailable {
+		t.Fatalf("runner = %+v, want failed with a rollback available", runner.Status)
+	}
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil || runner.Status.State != PIPELINE_FAILED {
+		t.Fatalf("Advance() = %v in %q, want to wait for the rollback to be requested", err, runner.Status.State)
+	}
+
+	runner.Annotations = map[string]string{RollbackAnnotation: "true"}
+	if err := c.Update(ctx, runner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if runner.Status.State != PIPELINE_ROLLBACK || runner.Status.Operation.Job != "db-rollback-2" || rollbackRequested(runner) {
+		t.Fatalf("runner = %+v running %+v, want rolling back, the request removed", runner.ObjectMeta, runner.Status.Operation)
+	}
+
+	// a failed rollback isn't available again
+	finishJob(t, c, "db-rollback-2", batchv1.JobFailed, "BackoffLimitExceeded")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); Classify(err) != ErrorJobFailed {
+		t.Fatalf("Advance() error = %v, want the rollback failure", err)
+	}
+	if runner.Status.State != PIPELINE_FAILED || conditionOf(runner, v1alpha1.ConditionRolledBack) != "False/"+ReasonRollbackFailed {
+		t.Fatalf("runner = %+v, want failed to roll back", runner.Status)
+	}
+	if rollbackAvailable.Check(runner) {
+		t.Errorf("rollback available after it failed")
+	}
+}
@@ -0,0 +1,194 @@
+package resolve
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The state of a runner is kept on its StateVolume, mounted at StateMount in
+// its jobs: each launch works on the next version of the state, in the
+// directory versions/<version> ($STATE_DIR), which the StateInitContainer
+// fills with a copy of the current version ($STATE_VERSION) before the
+// operation runs.
+const (
+	StateVolume        = "state"
+	StateMount         = "/var/run/servicerunner.io/state"
+	StateInitContainer = "state"
+
+	// DefaultStateImage prepares the state of runners which don't select
+	// an image.
+	DefaultStateImage = "docker.io/library/busybox:1.36"
+
+	// DefaultStateSize is the size of the state claims of runners which
+	// don't select one.
+	DefaultStateSize = "1Gi"
+)
+
+// StateHistory is how many versions of the state are kept; older ones are
+// pruned by the next job.
+const StateHistory = 3
+
+// stateScript resets the directory of $VERSION to a copy of the $COMMITTED
+// one, after pruning the directories not in $KEEP.  A job retried with a new
+// pod starts over from the committed state.
+const stateScript = `set -eu
+mkdir -p versions
+for dir in versions/*; do
+  [ -d "$dir" ] || continue
+  case " $KEEP " in *" ${dir#versions/} "*) ;; *) rm -rf "$dir" ;; esac
+done
+rm -rf "versions/$VERSION"
+mkdir "versions/$VERSION"
+if [ -n "$COMMITTED" ]; then cp -a "versions/$COMMITTED/." "versions/$VERSION/"; fi
+`
+
+// stateClaimName names the state claim of runner.
+func stateClaimName(runner *v1alpha1.ServiceRunner) string {
+	return runner.Name + "-state"
+}
+
+// currentState returns the current version of the state of runner, if any.
+func currentState(runner *v1alpha1.ServiceRunner) *v1alpha1.StateVersion {
+	storage := runner.Status.StateStorage
+	if storage == nil || len(storage.Versions) == 0 {
+		return nil
+	}
+	return &storage.Versions[len(storage.Versions)-1]
+}
+
+// nextState returns the version of the state the next operation of runner
+// works on.  A job launched again under the same name works on a version of
+// its own; only the version of a failed operation, never committed, is
+// worked on again.
+func nextState(runner *v1alpha1.ServiceRunner) int64 {
+	if current := currentState(runner); current != nil {
+		return current.Version + 1
+	}
+	return 1
+}
+
+// commitState makes the state left by the operation which just succeeded the
+// current version.  Committing the same operation again changes nothing.
+func commitState(runner *v1alpha1.ServiceRunner) {
+	operation := runner.Status.Operation
+	if runner.Spec.State == nil || operation == nil || operation.StateVersion == 0 || executorName(runner) != JobExecutorName || operation.Executor != JobExecutorName {
+		return
+	}
+	if runner.Status.StateStorage == nil {
+		runner.Status.StateStorage = &v1alpha1.StateStorageStatus{Claim: stateClaimName(runner)}
+	}
+	if current := currentState(runner); current != nil && current.Version >= operation.StateVersion {
+		return
+	}
+	storage := runner.Status.StateStorage
+	storage.Versions = append(storage.Versions, v1alpha1.StateVersion{Version: operation.StateVersion, Job: operation.Job})
+	if len(storage.Versions) > StateHistory {
+		storage.Versions = storage.Versions[len(storage.Versions)-StateHistory:]
+	}
+}
+
+// withState mounts the state of runner in the containers of job, and returns
+// the init container preparing the version of the state op works on.
+func withState(runner *v1alpha1.ServiceRunner, op Operation, job *batchv1.Job, containers []corev1.Container) corev1.Container {
+	job.Spec.Template.Spec.Volumes = append(job.Spec.Template.Spec.Volumes, corev1.Volume{
+		Name: StateVolume,
+		VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+			ClaimName: stateClaimName(runner),
+		}},
+	})
+	mount := corev1.VolumeMount{Name: StateVolume, MountPath: StateMount}
+
+	committed, version := "", int64(0)
+	if current := currentState(runner); current != nil {
+		version = current.Version
+		committed = strconv.FormatInt(version, 10)
+	}
+	next := strconv.FormatInt(op.StateVersion, 10)
+	keep := []string{next}
+	if runner.Status.StateStorage != nil {
+		for _, v := range runner.Status.StateStorage.Versions {
+			keep = append(keep, strconv.FormatInt(v.Version, 10))
+		}
+	}
+	env := []corev1.EnvVar{
+		{Name: "STATE_DIR", Value: StateMount + "/versions/" + next},
+		{Name: "STATE_VERSION", Value: strconv.FormatInt(version, 10)},
+	}
+	for i := range containers {
+		containers[i].Env = append(containers[i].Env, env...)
+		containers[i].VolumeMounts = append(containers[i].VolumeMounts, mount)
+	}
+
+	image := runner.Spec.State.Image
+	if image == "" {
+		image = DefaultStateImage
+	}
+	return corev1.Container{
+		Name:       StateInitContainer,
+		Image:      image,
+		Command:    []string{"/bin/sh", "-c", stateScript},
+		WorkingDir: StateMount,
+		Env: []corev1.EnvVar{
+			{Name: "VERSION", Value: next},
+			{Name: "COMMITTED", Value: committed},
+			{Name: "KEEP", Value: strings.Join(keep, " ")},
+		},
+		VolumeMounts: []corev1.VolumeMount{mount},
+	}
+}
+
+// ensureStateClaim creates the state claim of runner, unless it exists.
+func (e *JobExecutor) ensureStateClaim(ctx context.Context, runner *v1alpha1.ServiceRunner) error {
+	size := resource.MustParse(DefaultStateSize)
+	if runner.Spec.State.Size != nil {
+		size = *runner.Spec.State.Size
+	}
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            stateClaimName(runner),
+			Namespace:       runner.Namespace,
+			OwnerReferences: []metav1.OwnerReference{RunnerOwner(runner)},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: runner.Spec.State.StorageClassName,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+		},
+	}
+	if err := e.client.Create(ctx, claim); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// lockState makes sure no job of runner but the one of op still works on its
+// state: the pods of the jobs the pipeline moved on from may still be
+// terminating.  It returns a Locked error while one does.
+func (e *JobExecutor) lockState(ctx context.Context, runner *v1alpha1.ServiceRunner, op Operation) error {
+	pods := corev1.PodList{}
+	if err := e.client.List(ctx, &pods, client.InNamespace(runner.Namespace), client.MatchingLabels{JobLabel: runner.Name}); err != nil {
+		return err
+	}
+	for _, pod := range pods.Items {
+		if pod.Labels["job-name"] == op.ID || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.Name == StateVolume {
+				return Locked("state of runner %s is locked by pod %s", runner.Name, pod.Name)
+			}
+		}
+	}
+	return nil
+}
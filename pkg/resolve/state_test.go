@@ -0,0 +1,186 @@
+package resolve
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestJobTemplateState(t *testing.T) {
+	runner := newTestRunner(PIPELINE_READY)
+	runner.Spec.State = &v1alpha1.StateSpec{}
+	runner.Status.StateStorage = &v1alpha1.StateStorageStatus{Claim: "db-state", Versions: []v1alpha1.StateVersion{
+		{Version: 4, Job: "db-create-1"}, {Version: 5, Job: "db-read-1"},
+	}}
+	runner = withSteps(runner, OPERATION_UPDATE, v1alpha1.OperationStep{Name: "migrate"}, v1alpha1.OperationStep{Name: "apply"})
+	job := newTestJobTemplate(runner, Operation{Name: OPERATION_UPDATE, ID: "db-update-2", StateVersion: 6})
+
+	spec := job.Spec.Template.Spec
+	if len(spec.InitContainers) != 2 || spec.InitContainers[0].Name != StateInitContainer || spec.InitContainers[0].Image != DefaultStateImage {
+		t.Fatalf("init containers = %v, want the state prepared first", spec.InitContainers)
+	}
+	env := map[string]string{}
+	for _, v := range spec.InitContainers[0].Env {
+		env[v.Name] = v.Value
+	}
+	if env["VERSION"] != "6" || env["COMMITTED"] != "5" || env["KEEP"] != "6 4 5" {
+		t.Errorf("state container env = %v, want a copy of the current version", env)
+	}
+	claimed := false
+	for _, volume := range spec.Volumes {
+		if volume.Name == StateVolume && volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == "db-state" {
+			claimed = true
+		}
+	}
+	if !claimed {
+		t.Errorf("volumes = %v, want the state claim", spec.Volumes)
+	}
+	for _, c := range append(spec.InitContainers[1:], spec.Containers...) {
+		env := map[string]string{}
+		for _, v := range c.Env {
+			env[v.Name] = v.Value
+		}
+		if env["STATE_DIR"] != StateMount+"/versions/6" || env["STATE_VERSION"] != "5" {
+			t.Errorf("step %s env = %v, want the state of the job", c.Name, env)
+		}
+		if len(c.VolumeMounts) == 0 || c.VolumeMounts[len(c.VolumeMounts)-1].Name != StateVolume {
+			t.Errorf("step %s mounts %v, want the state", c.Name, c.VolumeMounts)
+		}
+	}
+}
+
+func TestLaunchClaimsState(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_NEW)
+	class := "fast"
+	runner.Spec.State = &v1alpha1.StateSpec{StorageClassName: &class}
+	// the pod of a create job which is still terminating
+	pod := withPhase(newTestPod("apps", "db-create-1-x", types.UID("job-uid"), map[string]string{JobLabel: "db", "job-name": "db-create-1"}), corev1.PodRunning)
+	pod.Spec.Volumes = []corev1.Volume{{Name: StateVolume}}
+	c := newTestClient(t, runner, pod)
+	e := NewJobExecutor(c, nil, nil, "")
+
+	read := Operation{Name: OPERATION_READ, ID: "db-read-1"}
+	if _, err := e.Launch(ctx, runner, read); Classify(err) != ErrorLocked {
+		t.Fatalf("Launch() while the state is locked = %v, want to wait for the lock", err)
+	}
+	pod.Status.Phase = corev1.PodSucceeded
+	if err := c.Update(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Launch(ctx, runner, read); err != nil {
+		t.Fatalf("Launch() once the state is released = %v", err)
+	}
+	claim := &corev1.PersistentVolumeClaim{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: "db-state"}, claim); err != nil {
+		t.Fatal(err)
+	}
+	size := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+	if size.String() != DefaultStateSize || *claim.Spec.StorageClassName != "fast" || claim.OwnerReferences[0].Name != "db" {
+		t.Errorf("claim = %+v, want the default size of the selected class, owned by the runner", claim.Spec)
+	}
+	// launching again is fine: the claim is kept
+	if _, err := e.Launch(ctx, runner, read); err != nil {
+		t.Errorf("Launch() again = %v", err)
+	}
+}
+
+func TestLockState(t *testing.T) {
+	tests := []struct {
+		name    string
+		job     string
+		phase   corev1.PodPhase
+		volumes []corev1.Volume
+		want    ErrorClass
+	}{
+		{"held by another job", "db-create-1", corev1.PodRunning, []corev1.Volume{{Name: StateVolume}}, ErrorLocked},
+		{"held by the job of the operation", "db-read-1", corev1.PodRunning, []corev1.Volume{{Name: StateVolume}}, ""},
+		{"released by a finished job", "db-create-1", corev1.PodFailed, []corev1.Volume{{Name: StateVolume}}, ""},
+		{"job without state", "db-create-1", corev1.PodRunning, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := newTestRunner(PIPELINE_READ)
+			pod := withPhase(newTestPod("apps", tt.job+"-x", types.UID("job-uid"), map[string]string{JobLabel: "db", "job-name": tt.job}), tt.phase)
+			pod.Spec.Volumes = tt.volumes
+			e := NewJobExecutor(newTestClient(t, runner, pod), nil, nil, "")
+
+			err := e.lockState(context.Background(), runner, Operation{Name: OPERATION_READ, ID: "db-read-1"})
+			if got := Classify(err); got != tt.want {
+				t.Errorf("lockState() = %v (class %q), want class %q", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdvanceCommitsState(t *testing.T) {
+	ctx := context.Background()
+	runner := newTestRunner(PIPELINE_CREATE)
+	runner.Spec.State = &v1alpha1.StateSpec{}
+	runner.Status.Operation.StateVersion = 1
+	c := newTestClient(t, runner, newTestJob("db-create-1"))
+	logs := finishRead(t, c, "db-create-1", "")
+
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, logs)); err != nil {
+		t.Fatal(err)
+	}
+	storage := runner.Status.StateStorage
+	if runner.Status.State != PIPELINE_READ || storage == nil || storage.Claim != "db-state" ||
+		len(storage.Versions) != 1 || storage.Versions[0] != (v1alpha1.StateVersion{Version: 1, Job: "db-create-1"}) {
+		t.Fatalf("runner = %+v, want the state of the create job committed", runner.Status)
+	}
+	if env := jobEnv(t, c, "db-read-1"); env["STATE_VERSION"] != "1" || env["STATE_DIR"] != StateMount+"/versions/2" {
+		t.Errorf("read job env = %v, want the committed version", env)
+	}
+
+	// only the last versions are kept
+	for i := 2; i <= StateHistory+1; i++ {
+		runner.Status.Operation.Job = "db-job-" + string(rune('0'+i))
+		runner.Status.Operation.StateVersion = int64(i)
+		commitState(runner)
+		commitState(runner)
+	}
+	if v := runner.Status.StateStorage.Versions; len(v) != StateHistory || v[0].Version != 2 || v[len(v)-1].Version != int64(StateHistory+1) {
+		t.Errorf("versions = %v, want the last %d", v, StateHistory)
+	}
+}
+
+func TestRerunCommitsNewState(t *testing.T) {
+	ctx := context.Background()
+	// the update of generation 2 already succeeded once, and runs again
+	runner := snapshotted(newTestRunner(PIPELINE_UPDATE), v1alpha1.RollbackManual)
+	runner.Spec.State = &v1alpha1.StateSpec{}
+	runner.Status.StateStorage = &v1alpha1.StateStorageStatus{Claim: "db-state", Versions: []v1alpha1.StateVersion{
+		{Version: 1, Job: "db-create-1"}, {Version: 2, Job: "db-update-2"},
+	}}
+	c := newTestClient(t, runner)
+	p := &Pipeline{serviceRunner: runner, client: c, executors: newTestExecutors(c, nil)}
+
+	if err := p.Launch(ctx, Operation{Name: OPERATION_UPDATE, ID: "db-update-2"}); err != nil {
+		t.Fatal(err)
+	}
+	job := &batchv1.Job{}
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: "db-update-2"}, job); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{}
+	for _, v := range job.Spec.Template.Spec.InitContainers[0].Env {
+		env[v.Name] = v.Value
+	}
+	if runner.Status.Operation.StateVersion != 3 || env["VERSION"] != "3" || env["COMMITTED"] != "2" {
+		t.Fatalf("operation = %+v, state container env = %v, want a copy of version 2 as version 3", runner.Status.Operation, env)
+	}
+
+	finishJob(t, c, "db-update-2", batchv1.JobComplete, "")
+	if _, err := Advance(ctx, runner, c, newTestExecutors(c, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if v := runner.Status.StateStorage.Versions; len(v) != 3 || v[2] != (v1alpha1.StateVersion{Version: 3, Job: "db-update-2"}) {
+		t.Errorf("versions = %v, want the state of the rerun committed", v)
+	}
+}
@@ -2,7 +2,6 @@ package resolve
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/openshift-app-service-poc/service-runner/api/v1alpha1"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -16,33 +15,33 @@ type Update struct {
 
 var _ Resolver = &Update{}
 
-func MakeUpdate(runner *v1alpha1.ServiceRunner, client client.Client) *Update {
+func MakeUpdate(runner *v1alpha1.ServiceRunner, client client.Client, executors *Registry) *Update {
 	return &Update{
 		Pipeline: Pipeline{
 			serviceRunner: runner,
 			client:        client,
+			executors:     executors,
 		},
 	}
 }
 
 func (u *Update) JobName() string {
-	return fmt.Sprintf("%s-update", u.serviceRunner.Name)
+	return stageJobName(u.serviceRunner, OPERATION_UPDATE, u.serviceRunner.Generation)
 }
 
+// Params returns the parameters of the current generation
+func (u *Update) Params() map[string]string {
+	return u.serviceRunner.Spec.ServiceParam
+}
+
+// Resolve launches the update job for the current generation, from the
+// parameters applied last
 func (u *Update) Resolve(ctx context.Context) (ctrl.Result, error) {
-	if u.serviceRunner.Status.ObservedGeneration == u.serviceRunner.Generation {
-		// nothing to do, return ready
-		return ctrl.Result{}, nil
-	}
-	res := ctrl.Result{Requeue: true}
-
-	// enqueue the update job
-	job := JobTemplate(u, "/update")
-	err := u.client.Create(ctx, job)
-	if err == nil {
-		res.Requeue = false
-		u.serviceRunner.Status.State = PIPELINE_UPDATE
+	op := Operation{Name: OPERATION_UPDATE, ID: u.JobName(), Params: u.Params(), Previous: u.Pipeline.Params()}
+	if err := u.Launch(ctx, op); err != nil {
+		return ctrl.Result{}, err
 	}
 
-	return res, err
+	u.applying()
+	return ctrl.Result{}, nil
 }
@@ -0,0 +1,221 @@
+// Package testsupport stands in for the parts of a cluster envtest lacks when
+// testing the runner controller: it runs no Job controller nor kubelet, so
+// jobs never complete on their own.
+package testsupport
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+// Outcome is how a fake job ends.
+type Outcome string
+
+const (
+	// Succeed completes the job; its pod logs the behavior output.
+	Succeed Outcome = "Succeed"
+	// Fail fails the job as if it ran out of retries.
+	Fail Outcome = "Fail"
+	// TimeOut fails the job as if it ran past its deadline.
+	TimeOut Outcome = "TimeOut"
+	// Hang leaves the job running forever.
+	Hang Outcome = "Hang"
+)
+
+// Behavior scripts how the jobs of an operation end.
+type Behavior struct {
+	Outcome Outcome
+	// Output is the last line logged by the pod of a succeeded job; the read
+	// operation is expected to output the binding data as a JSON object.
+	Output string
+}
+
+// DefaultBehavior is how jobs end unless scripted otherwise.
+var DefaultBehavior = Behavior{Outcome: Succeed, Output: "{}"}
+
+// FakeJobExecutor plays the Job controller and kubelet for the jobs built by
+// resolve.JobExecutor: for every job it creates a pod, then finishes both as
+// scripted for the operation of the job.  It is also the resolve.LogReader
+// serving the outputs of the pods, to be handed to the reconciler under test.
+type FakeJobExecutor struct {
+	Client client.Client
+
+	mu        sync.Mutex
+	behaviors map[string]Behavior
+	launched  map[string][]string
+	logs      map[string]string
+}
+
+var _ resolve.LogReader = &FakeJobExecutor{}
+
+// NewFakeJobExecutor returns an executor running jobs through c.
+func NewFakeJobExecutor(c client.Client) *FakeJobExecutor {
+	return &FakeJobExecutor{
+		Client:    c,
+		behaviors: map[string]Behavior{},
+		launched:  map[string][]string{},
+		logs:      map[string]string{},
+	}
+}
+
+func runnerKey(namespace, runner string) string {
+	return namespace + "/" + runner
+}
+
+// Script sets how the jobs of operation (one of the resolve.OPERATION_*) of
+// the given runner end from now on.
+func (e *FakeJobExecutor) Script(namespace, runner, operation string, behavior Behavior) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.behaviors[runnerKey(namespace, runner)+"/"+operation] = behavior
+}
+
+// Launched returns the names of the jobs run for the given runner, in the
+// order they were seen.
+func (e *FakeJobExecutor) Launched(namespace, runner string) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.launched[runnerKey(namespace, runner)]...)
+}
+
+// TailLog returns the output of a pod which succeeded.
+func (e *FakeJobExecutor) TailLog(_ context.Context, pod *corev1.Pod) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	log, ok := e.logs[pod.Namespace+"/"+pod.Name]
+	if !ok {
+		return nil, resolve.NotFound("no logs for pod %s/%s", pod.Namespace, pod.Name)
+	}
+	return []byte(log), nil
+}
+
+// behavior records job as launched and returns how it ends.
+func (e *FakeJobExecutor) behavior(job *batchv1.Job) Behavior {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	runner := job.Labels[resolve.JobLabel]
+	key := runnerKey(job.Namespace, runner)
+	seen := false
+	for _, name := range e.launched[key] {
+		seen = seen || name == job.Name
+	}
+	if !seen {
+		e.launched[key] = append(e.launched[key], job.Name)
+	}
+
+	// jobs are named <runner>-<operation>-<generation>
+	operation := strings.TrimPrefix(job.Name, runner+"-")
+	if i := strings.LastIndex(operation, "-"); i >= 0 {
+		operation = operation[:i]
+	}
+	if behavior, ok := e.behaviors[key+"/"+operation]; ok {
+		return behavior
+	}
+	return DefaultBehavior
+}
+
+// Reconcile runs a job to its scripted end.
+func (e *FakeJobExecutor) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	job := &batchv1.Job{}
+	if err := e.Client.Get(ctx, req.NamespacedName, job); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if _, ok := job.Labels[resolve.JobLabel]; !ok || finished(job) {
+		return ctrl.Result{}, nil
+	}
+	behavior := e.behavior(job)
+	if behavior.Outcome == Hang {
+		return ctrl.Result{}, nil
+	}
+
+	phase := corev1.PodFailed
+	if behavior.Outcome == Succeed {
+		phase = corev1.PodSucceeded
+	}
+	pod, err := e.runPod(ctx, job, phase)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if behavior.Outcome == Succeed {
+		e.mu.Lock()
+		e.logs[pod.Namespace+"/"+pod.Name] = behavior.Output
+		e.mu.Unlock()
+	}
+
+	now := metav1.Now()
+	job.Status.StartTime = &now
+	switch behavior.Outcome {
+	case Succeed:
+		job.Status.Succeeded = 1
+		job.Status.CompletionTime = &now
+		job.Status.Conditions = append(job.Status.Conditions, jobCondition(batchv1.JobComplete, "", now))
+	case TimeOut:
+		job.Status.Failed = 1
+		job.Status.Conditions = append(job.Status.Conditions, jobCondition(batchv1.JobFailed, "DeadlineExceeded", now))
+	default:
+		job.Status.Failed = 1
+		job.Status.Conditions = append(job.Status.Conditions, jobCondition(batchv1.JobFailed, "BackoffLimitExceeded", now))
+	}
+	return ctrl.Result{}, e.Client.Status().Update(ctx, job)
+}
+
+// runPod creates the pod of job, as the Job controller would, and moves it to
+// phase, as the kubelet would.
+func (e *FakeJobExecutor) runPod(ctx context.Context, job *batchv1.Job, phase corev1.PodPhase) (*corev1.Pod, error) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            job.Name + "-pod",
+			Namespace:       job.Namespace,
+			Labels:          job.Spec.Template.Labels,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(job, batchv1.SchemeGroupVersion.WithKind("Job"))},
+		},
+		Spec: job.Spec.Template.Spec,
+	}
+	err := e.Client.Create(ctx, pod)
+	if apierrors.IsAlreadyExists(err) {
+		err = e.Client.Get(ctx, client.ObjectKeyFromObject(pod), pod)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pod.Status.Phase = phase
+	return pod, e.Client.Status().Update(ctx, pod)
+}
+
+func jobCondition(conditionType batchv1.JobConditionType, reason string, now metav1.Time) batchv1.JobCondition {
+	return batchv1.JobCondition{
+		Type:               conditionType,
+		Status:             corev1.ConditionTrue,
+		Reason:             reason,
+		LastProbeTime:      now,
+		LastTransitionTime: now,
+	}
+}
+
+func finished(job *batchv1.Job) bool {
+	for _, cond := range job.Status.Conditions {
+		if (cond.Type == batchv1.JobComplete || cond.Type == batchv1.JobFailed) && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// SetupWithManager runs the executor with the manager.
+func (e *FakeJobExecutor) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("fake-job-executor").
+		For(&batchv1.Job{}).
+		Complete(e)
+}
@@ -0,0 +1,123 @@
+package testsupport
+
+import (
+	"context"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/openshift-app-service-poc/service-runner/pkg/resolve"
+)
+
+func newJob(name string) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "apps",
+			UID:       "job-uid",
+			Labels:    map[string]string{resolve.JobLabel: "db"},
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{resolve.JobLabel: "db"}},
+			},
+		},
+	}
+}
+
+func TestFakeJobExecutor(t *testing.T) {
+	tests := []struct {
+		name       string
+		job        string
+		script     *Behavior
+		wantCond   batchv1.JobConditionType
+		wantReason string
+		wantLog    string
+	}{
+		{
+			name:     "succeeds by default",
+			job:      "db-create-1",
+			wantCond: batchv1.JobComplete,
+			wantLog:  "{}",
+		},
+		{
+			name:     "scripted output",
+			job:      "db-read-2",
+			script:   &Behavior{Outcome: Succeed, Output: `{"host":"db"}`},
+			wantCond: batchv1.JobComplete,
+			wantLog:  `{"host":"db"}`,
+		},
+		{
+			name:       "scripted failure",
+			job:        "db-read-2",
+			script:     &Behavior{Outcome: Fail},
+			wantCond:   batchv1.JobFailed,
+			wantReason: "BackoffLimitExceeded",
+		},
+		{
+			name:       "scripted timeout",
+			job:        "db-read-2",
+			script:     &Behavior{Outcome: TimeOut},
+			wantCond:   batchv1.JobFailed,
+			wantReason: "DeadlineExceeded",
+		},
+		{
+			name:   "hanging job",
+			job:    "db-read-2",
+			script: &Behavior{Outcome: Hang},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(newJob(tt.job)).Build()
+			e := NewFakeJobExecutor(c)
+			if tt.script != nil {
+				e.Script("apps", "db", resolve.OPERATION_READ, *tt.script)
+			}
+
+			key := client.ObjectKey{Namespace: "apps", Name: tt.job}
+			if _, err := e.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+				t.Fatal(err)
+			}
+			if got := e.Launched("apps", "db"); len(got) != 1 || got[0] != tt.job {
+				t.Errorf("Launched() = %v, want [%s]", got, tt.job)
+			}
+
+			job := &batchv1.Job{}
+			if err := c.Get(ctx, key, job); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCond == "" {
+				if len(job.Status.Conditions) != 0 {
+					t.Fatalf("job conditions = %v, want none", job.Status.Conditions)
+				}
+				return
+			}
+			if len(job.Status.Conditions) != 1 || job.Status.Conditions[0].Type != tt.wantCond || job.Status.Conditions[0].Reason != tt.wantReason {
+				t.Fatalf("job conditions = %v, want %s (%s)", job.Status.Conditions, tt.wantCond, tt.wantReason)
+			}
+
+			pod := &corev1.Pod{}
+			if err := c.Get(ctx, client.ObjectKey{Namespace: "apps", Name: tt.job + "-pod"}, pod); err != nil {
+				t.Fatal(err)
+			}
+			log, err := e.TailLog(ctx, pod)
+			if tt.wantLog == "" {
+				if err == nil {
+					t.Fatalf("TailLog() = %s, want no output for a failed pod", log)
+				}
+				return
+			}
+			if err != nil || string(log) != tt.wantLog {
+				t.Fatalf("TailLog() = %s, %v; want %s", log, err, tt.wantLog)
+			}
+		})
+	}
+}